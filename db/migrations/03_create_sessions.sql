@@ -0,0 +1,32 @@
+-- +goose Up
+
+-- Refresh tokens are stored as SHA-256 hashes. Each login starts a family;
+-- every refresh marks the presented token used and adds a new one to it.
+CREATE TABLE "refresh_tokens"(
+    id                  SERIAL PRIMARY KEY,
+    user_id             INTEGER NOT NULL REFERENCES app_users(id) ON DELETE CASCADE,
+    family_id           VARCHAR(64) NOT NULL,
+    token_hash          VARCHAR(64) NOT NULL UNIQUE,
+    issued_at           TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at          TIMESTAMPTZ NOT NULL,
+    used_at             TIMESTAMPTZ,
+    revoked_at          TIMESTAMPTZ
+);
+
+CREATE INDEX refresh_tokens_family_idx ON refresh_tokens(family_id);
+CREATE INDEX refresh_tokens_user_idx ON refresh_tokens(user_id);
+
+-- Denylist of access token ids (jti) and session ids (sid), kept until the
+-- tokens they cover would have expired anyway
+CREATE TABLE "revoked_tokens"(
+    token_id            VARCHAR(64) PRIMARY KEY,
+    expires_at          TIMESTAMPTZ NOT NULL
+);
+
+-- Access tokens issued before this instant are rejected
+ALTER TABLE app_users ADD COLUMN tokens_valid_after TIMESTAMPTZ;
+
+-- +goose Down
+ALTER TABLE app_users DROP COLUMN tokens_valid_after;
+DROP TABLE "revoked_tokens";
+DROP TABLE "refresh_tokens";
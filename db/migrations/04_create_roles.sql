@@ -0,0 +1,58 @@
+-- +goose Up
+
+CREATE TABLE "roles"(
+    id                  SERIAL PRIMARY KEY,
+    name                VARCHAR(64) NOT NULL UNIQUE,
+    description         VARCHAR(255)
+);
+
+CREATE TABLE "permissions"(
+    id                  SERIAL PRIMARY KEY,
+    name                VARCHAR(64) NOT NULL UNIQUE,
+    description         VARCHAR(255)
+);
+
+CREATE TABLE "role_permissions"(
+    role_id             INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    permission_id       INTEGER NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE "user_roles"(
+    user_id             INTEGER NOT NULL REFERENCES app_users(id) ON DELETE CASCADE,
+    role_id             INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO roles (name, description) VALUES
+    ('admin', 'Full access to every file and user'),
+    ('instructor', 'Uploads and manages own course recordings'),
+    ('student', 'Uploads and downloads own files'),
+    ('auditor', 'Read-only access to every file')
+;
+
+INSERT INTO permissions (name, description) VALUES
+    ('files:read', 'List and download own files'),
+    ('files:write', 'Upload files'),
+    ('files:read:any', 'List and download files of every user'),
+    ('sessions:manage', 'Revoke sessions of other users'),
+    ('users:manage', 'Manage users and their roles')
+;
+
+INSERT INTO role_permissions (role_id, permission_id)
+    SELECT r.id, p.id FROM roles r, permissions p
+    WHERE (r.name = 'admin')
+       OR (r.name IN ('instructor', 'student') AND p.name IN ('files:read', 'files:write'))
+       OR (r.name = 'auditor' AND p.name IN ('files:read', 'files:read:any'))
+;
+
+INSERT INTO user_roles (user_id, role_id)
+    SELECT u.id, r.id FROM app_users u JOIN roles r
+        ON r.name = CASE WHEN u.username = 'admin' THEN 'admin' ELSE 'student' END
+;
+
+-- +goose Down
+DROP TABLE "user_roles";
+DROP TABLE "role_permissions";
+DROP TABLE "permissions";
+DROP TABLE "roles";
@@ -0,0 +1,22 @@
+-- +goose Up
+
+-- Append-only audit trail. Actors are not foreign keys so entries outlive
+-- the users they mention.
+CREATE TABLE "audit_log"(
+    id                  BIGSERIAL PRIMARY KEY,
+    occurred_at         TIMESTAMPTZ NOT NULL,
+    actor_id            INTEGER,
+    actor               VARCHAR(255),
+    action              VARCHAR(64) NOT NULL,
+    resource            VARCHAR(255),
+    outcome             VARCHAR(16) NOT NULL,
+    client_ip           VARCHAR(64),
+    details             JSONB
+);
+
+CREATE INDEX audit_log_occurred_at_idx ON audit_log(occurred_at);
+CREATE INDEX audit_log_actor_idx ON audit_log(actor_id, occurred_at);
+CREATE INDEX audit_log_action_idx ON audit_log(action, occurred_at);
+
+-- +goose Down
+DROP TABLE "audit_log";
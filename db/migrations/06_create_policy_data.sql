@@ -0,0 +1,52 @@
+-- +goose Up
+
+-- Authorization data managed through the admin API and published to the
+-- policy as data.platform
+
+-- Denies a user (by id) or a client IP one action, or every action with '*'
+CREATE TABLE "authz_denylist"(
+    id                  SERIAL PRIMARY KEY,
+    subject_type        VARCHAR(16) NOT NULL CHECK (subject_type IN ('user', 'ip')),
+    subject             VARCHAR(255) NOT NULL,
+    action              VARCHAR(64) NOT NULL DEFAULT '*',
+    reason              VARCHAR(255) NOT NULL,
+    created_by          INTEGER,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at          TIMESTAMPTZ
+);
+
+CREATE TABLE "user_suspensions"(
+    user_id             INTEGER PRIMARY KEY REFERENCES app_users(id) ON DELETE CASCADE,
+    reason              VARCHAR(255) NOT NULL,
+    suspended_by        INTEGER,
+    suspended_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    suspended_until     TIMESTAMPTZ
+);
+
+-- Overrides the role based upload size limit of the policy
+CREATE TABLE "user_upload_limits"(
+    user_id             INTEGER PRIMARY KEY REFERENCES app_users(id) ON DELETE CASCADE,
+    max_upload_bytes    BIGINT NOT NULL CHECK (max_upload_bytes > 0),
+    updated_by          INTEGER,
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Replaces the user3 literal that used to be in the policy
+INSERT INTO authz_denylist (subject_type, subject, action, reason)
+    SELECT 'user', id::text, '*', 'user is blocked' FROM app_users WHERE username = 'user3'
+;
+
+INSERT INTO permissions (name, description) VALUES
+    ('policy:manage', 'Manage deny lists, suspensions and upload limits')
+;
+
+INSERT INTO role_permissions (role_id, permission_id)
+    SELECT r.id, p.id FROM roles r, permissions p
+    WHERE r.name = 'admin' AND p.name = 'policy:manage'
+;
+
+-- +goose Down
+DELETE FROM permissions WHERE name = 'policy:manage';
+DROP TABLE "user_upload_limits";
+DROP TABLE "user_suspensions";
+DROP TABLE "authz_denylist";
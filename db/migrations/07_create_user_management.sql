@@ -0,0 +1,44 @@
+-- +goose Up
+
+-- Users sign in with their username or email. Both are unique regardless
+-- of case; usernames cannot contain '@', so the two never collide.
+ALTER TABLE app_users
+    ALTER COLUMN username SET NOT NULL,
+    ALTER COLUMN password SET NOT NULL,
+    ADD COLUMN email VARCHAR(255),
+    ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'active'
+        CHECK (status IN ('pending', 'active', 'disabled')),
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ADD COLUMN password_changed_at TIMESTAMPTZ;
+
+CREATE UNIQUE INDEX app_users_username_key ON app_users(LOWER(username));
+CREATE UNIQUE INDEX app_users_email_key ON app_users(LOWER(email));
+
+-- The seed data inserted explicit ids
+SELECT setval('app_users_id_seq', COALESCE((SELECT MAX(id) FROM app_users), 1));
+
+-- Single-use registration invites, stored as SHA-256 hashes. An invite
+-- bound to an email can only be used to register that address.
+CREATE TABLE "invites"(
+    id                  SERIAL PRIMARY KEY,
+    code_hash           VARCHAR(64) NOT NULL UNIQUE,
+    email               VARCHAR(255),
+    role                VARCHAR(64) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+    created_by          INTEGER,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at          TIMESTAMPTZ NOT NULL,
+    used_at             TIMESTAMPTZ,
+    used_by             INTEGER REFERENCES app_users(id) ON DELETE SET NULL
+);
+
+-- +goose Down
+DROP TABLE "invites";
+DROP INDEX app_users_email_key;
+DROP INDEX app_users_username_key;
+ALTER TABLE app_users
+    DROP COLUMN password_changed_at,
+    DROP COLUMN created_at,
+    DROP COLUMN status,
+    DROP COLUMN email,
+    ALTER COLUMN password DROP NOT NULL,
+    ALTER COLUMN username DROP NOT NULL;
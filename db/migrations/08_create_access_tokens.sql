@@ -0,0 +1,23 @@
+-- +goose Up
+
+-- Personal access tokens for scripted clients. Only the SHA-256 hash is
+-- stored; prefix keeps the first characters so users can tell tokens apart.
+-- Scopes are permission names separated by spaces.
+CREATE TABLE "personal_access_tokens"(
+    id                  SERIAL PRIMARY KEY,
+    user_id             INTEGER NOT NULL REFERENCES app_users(id) ON DELETE CASCADE,
+    name                VARCHAR(255) NOT NULL,
+    token_hash          VARCHAR(64) NOT NULL UNIQUE,
+    prefix              VARCHAR(16) NOT NULL,
+    scopes              VARCHAR(1024) NOT NULL,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at          TIMESTAMPTZ NOT NULL,
+    last_used_at        TIMESTAMPTZ,
+    last_used_ip        VARCHAR(64),
+    revoked_at          TIMESTAMPTZ
+);
+
+CREATE INDEX personal_access_tokens_user_idx ON personal_access_tokens(user_id);
+
+-- +goose Down
+DROP TABLE "personal_access_tokens";
@@ -0,0 +1,35 @@
+-- +goose Up
+
+-- TOTP secrets, encrypted when MFA_SECRET_KEY is set. A row without
+-- enabled_at is an enrollment that was not confirmed yet. last_counter is
+-- the last accepted time step, so a code cannot be used twice.
+CREATE TABLE "user_mfa"(
+    user_id             INTEGER PRIMARY KEY REFERENCES app_users(id) ON DELETE CASCADE,
+    secret              VARCHAR(255) NOT NULL,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    enabled_at          TIMESTAMPTZ,
+    last_counter        BIGINT NOT NULL DEFAULT 0
+);
+
+-- Single-use recovery codes, stored as SHA-256 hashes
+CREATE TABLE "mfa_recovery_codes"(
+    id                  SERIAL PRIMARY KEY,
+    user_id             INTEGER NOT NULL REFERENCES app_users(id) ON DELETE CASCADE,
+    code_hash           VARCHAR(64) NOT NULL,
+    used_at             TIMESTAMPTZ,
+    UNIQUE (user_id, code_hash)
+);
+
+-- Issued after a correct password when a second factor is needed, and
+-- exchanged together with a code for the session
+CREATE TABLE "mfa_challenges"(
+    token_hash          VARCHAR(64) PRIMARY KEY,
+    user_id             INTEGER NOT NULL REFERENCES app_users(id) ON DELETE CASCADE,
+    expires_at          TIMESTAMPTZ NOT NULL,
+    attempts            INTEGER NOT NULL DEFAULT 0
+);
+
+-- +goose Down
+DROP TABLE "mfa_challenges";
+DROP TABLE "mfa_recovery_codes";
+DROP TABLE "user_mfa";
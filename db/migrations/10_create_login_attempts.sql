@@ -0,0 +1,15 @@
+-- +goose Up
+
+-- Failed sign-in attempts, shared by all uploader replicas. key is
+-- "user:<id>" for existing accounts, "login:<name>" for unknown names and
+-- "ip:<address>". Failures are forgotten after a quiet period; once they
+-- pass the threshold the key is locked until locked_until.
+CREATE TABLE "login_attempts"(
+    key                 VARCHAR(320) PRIMARY KEY,
+    failures            INTEGER NOT NULL DEFAULT 0,
+    last_failure_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    locked_until        TIMESTAMPTZ
+);
+
+-- +goose Down
+DROP TABLE "login_attempts";
@@ -0,0 +1,32 @@
+-- +goose Up
+
+-- Accounts at an external OpenID Connect provider linked to platform
+-- users, identified by the provider's issuer and subject. Users created
+-- through single sign-on have an empty password and can only sign in there.
+CREATE TABLE "user_identities"(
+    id                  SERIAL PRIMARY KEY,
+    user_id             INTEGER NOT NULL REFERENCES app_users(id) ON DELETE CASCADE,
+    issuer              VARCHAR(255) NOT NULL,
+    subject             VARCHAR(255) NOT NULL,
+    email               VARCHAR(255),
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_login_at       TIMESTAMPTZ,
+    UNIQUE (issuer, subject)
+);
+
+CREATE INDEX user_identities_user_idx ON user_identities(user_id);
+
+-- Authorization requests in flight, keyed by the hash of their state
+-- parameter. link_user_id is set when a signed in user links an identity
+-- instead of signing in.
+CREATE TABLE "oidc_login_states"(
+    state_hash          VARCHAR(64) PRIMARY KEY,
+    nonce               VARCHAR(64) NOT NULL,
+    code_verifier       VARCHAR(128) NOT NULL,
+    link_user_id        INTEGER REFERENCES app_users(id) ON DELETE CASCADE,
+    expires_at          TIMESTAMPTZ NOT NULL
+);
+
+-- +goose Down
+DROP TABLE "oidc_login_states";
+DROP TABLE "user_identities";
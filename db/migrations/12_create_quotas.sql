@@ -0,0 +1,38 @@
+-- +goose Up
+
+-- Storage quotas. A NULL limit is unlimited. Users get the most generous
+-- limits of their roles that have a quota; a user override replaces them
+-- entirely. Users whose roles have no quota are not limited.
+CREATE TABLE "role_quotas"(
+    role_id             INTEGER PRIMARY KEY REFERENCES roles(id) ON DELETE CASCADE,
+    max_bytes           BIGINT CHECK (max_bytes >= 0),
+    max_files           BIGINT CHECK (max_files >= 0),
+    max_file_bytes      BIGINT CHECK (max_file_bytes >= 0),
+    updated_by          INTEGER,
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE "user_quotas"(
+    user_id             INTEGER PRIMARY KEY REFERENCES app_users(id) ON DELETE CASCADE,
+    max_bytes           BIGINT CHECK (max_bytes >= 0),
+    max_files           BIGINT CHECK (max_files >= 0),
+    max_file_bytes      BIGINT CHECK (max_file_bytes >= 0),
+    updated_by          INTEGER,
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Usage is summed per user on every upload
+CREATE INDEX "files_user_id_idx" ON files (user_id);
+
+INSERT INTO role_quotas (role_id, max_bytes, max_files, max_file_bytes)
+    SELECT id, q.max_bytes, q.max_files, q.max_file_bytes FROM roles JOIN (VALUES
+        ('admin', NULL::BIGINT, NULL::BIGINT, NULL::BIGINT),
+        ('instructor', 100::BIGINT << 30, 10000::BIGINT, 10::BIGINT << 30),
+        ('student', 10::BIGINT << 30, 1000::BIGINT, 2::BIGINT << 30)
+    ) AS q(name, max_bytes, max_files, max_file_bytes) ON q.name = roles.name
+;
+
+-- +goose Down
+DROP INDEX "files_user_id_idx";
+DROP TABLE "user_quotas";
+DROP TABLE "role_quotas";
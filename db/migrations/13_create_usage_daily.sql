@@ -0,0 +1,20 @@
+-- +goose Up
+
+-- Transferred bytes per user and UTC day. The uploader adds to the rows in
+-- batches: ingress for uploads by the owner, egress for downloads by the
+-- caller and backup for copies the handler made of the owner's files.
+CREATE TABLE "usage_daily"(
+    user_id             INTEGER NOT NULL REFERENCES app_users(id) ON DELETE CASCADE,
+    day                 DATE NOT NULL,
+    ingress_bytes       BIGINT NOT NULL DEFAULT 0,
+    egress_bytes        BIGINT NOT NULL DEFAULT 0,
+    backup_bytes        BIGINT NOT NULL DEFAULT 0,
+    uploads             INTEGER NOT NULL DEFAULT 0,
+    downloads           INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, day)
+);
+
+CREATE INDEX "usage_daily_day_idx" ON usage_daily (day);
+
+-- +goose Down
+DROP TABLE "usage_daily";
@@ -0,0 +1,27 @@
+-- +goose Up
+
+-- Deleted files stay in the trash, restorable, until they are purged
+-- after TRASH_RETENTION. Purging removes the objects and the row.
+ALTER TABLE files
+    ADD COLUMN status       VARCHAR(16) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'trashed')),
+    ADD COLUMN deleted_at   TIMESTAMPTZ,
+    ADD COLUMN deleted_by   INTEGER;
+
+CREATE INDEX "files_trashed_idx" ON files (deleted_at) WHERE status = 'trashed';
+
+INSERT INTO permissions (name, description) VALUES
+    ('files:delete:any', 'Delete, restore and purge files of every user')
+;
+
+INSERT INTO role_permissions (role_id, permission_id)
+    SELECT r.id, p.id FROM roles r, permissions p
+    WHERE r.name = 'admin' AND p.name = 'files:delete:any'
+;
+
+-- +goose Down
+DELETE FROM permissions WHERE name = 'files:delete:any';
+DROP INDEX "files_trashed_idx";
+ALTER TABLE files
+    DROP COLUMN deleted_by,
+    DROP COLUMN deleted_at,
+    DROP COLUMN status;
@@ -0,0 +1,29 @@
+-- +goose Up
+
+-- Lifecycle state of each copy of a file, kept up to date by the lifecycle
+-- job: the policy that applies, when the copy expires and when it was
+-- removed. A file whose copies are all removed is purged.
+ALTER TABLE files
+    ADD COLUMN primary_policy       VARCHAR(64),
+    ADD COLUMN primary_expires_at   TIMESTAMPTZ,
+    ADD COLUMN primary_deleted_at   TIMESTAMPTZ,
+    ADD COLUMN backup_policy        VARCHAR(64),
+    ADD COLUMN backup_expires_at    TIMESTAMPTZ,
+    ADD COLUMN backup_deleted_at    TIMESTAMPTZ;
+
+-- Set at upload, lifecycle policies can match them
+CREATE TABLE "file_tags"(
+    file_id             INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    tag                 VARCHAR(64) NOT NULL,
+    PRIMARY KEY (file_id, tag)
+);
+
+-- +goose Down
+DROP TABLE "file_tags";
+ALTER TABLE files
+    DROP COLUMN backup_deleted_at,
+    DROP COLUMN backup_expires_at,
+    DROP COLUMN backup_policy,
+    DROP COLUMN primary_deleted_at,
+    DROP COLUMN primary_expires_at,
+    DROP COLUMN primary_policy;
@@ -0,0 +1,31 @@
+-- +goose Up
+
+-- Files under a legal hold, or with a retain_until in the future, cannot
+-- be deleted by users, the trash purge or lifecycle policies.
+ALTER TABLE files
+    ADD COLUMN legal_hold           BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN legal_hold_reason    TEXT,
+    ADD COLUMN retain_until         TIMESTAMPTZ,
+    ADD COLUMN hold_updated_by      INTEGER,
+    ADD COLUMN hold_updated_at      TIMESTAMPTZ;
+
+CREATE INDEX "files_held_idx" ON files (id) WHERE legal_hold OR retain_until IS NOT NULL;
+
+INSERT INTO permissions (name, description) VALUES
+    ('files:hold', 'Place and release legal holds and retention on files')
+;
+
+INSERT INTO role_permissions (role_id, permission_id)
+    SELECT r.id, p.id FROM roles r, permissions p
+    WHERE r.name = 'admin' AND p.name = 'files:hold'
+;
+
+-- +goose Down
+DELETE FROM permissions WHERE name = 'files:hold';
+DROP INDEX "files_held_idx";
+ALTER TABLE files
+    DROP COLUMN hold_updated_at,
+    DROP COLUMN hold_updated_by,
+    DROP COLUMN retain_until,
+    DROP COLUMN legal_hold_reason,
+    DROP COLUMN legal_hold;
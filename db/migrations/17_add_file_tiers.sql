@@ -0,0 +1,43 @@
+-- +goose Up
+
+-- Files are hot while their primary copy exists, archived once only the
+-- backup is left and rehydrating while the backup is restored into the
+-- primary bucket. rehydrated_at keeps restored copies from expiring at
+-- once.
+ALTER TABLE files
+    ADD COLUMN tier             VARCHAR(16) NOT NULL DEFAULT 'hot' CHECK (tier IN ('hot', 'archived', 'rehydrating')),
+    ADD COLUMN tier_changed_at  TIMESTAMPTZ,
+    ADD COLUMN rehydrated_at    TIMESTAMPTZ;
+
+UPDATE files SET tier = 'archived', tier_changed_at = primary_deleted_at WHERE primary_deleted_at IS NOT NULL;
+
+CREATE INDEX "files_rehydrating_idx" ON files (tier_changed_at) WHERE tier = 'rehydrating';
+
+-- Users waiting for a file to be rehydrated, notified when it is ready
+CREATE TABLE "rehydration_requests"(
+    file_id             INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    user_id             INTEGER NOT NULL REFERENCES app_users(id) ON DELETE CASCADE,
+    requested_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (file_id, user_id)
+);
+
+CREATE TABLE "notifications"(
+    id                  SERIAL PRIMARY KEY,
+    user_id             INTEGER NOT NULL REFERENCES app_users(id) ON DELETE CASCADE,
+    kind                VARCHAR(64) NOT NULL,
+    message             TEXT NOT NULL,
+    file_id             INTEGER REFERENCES files(id) ON DELETE SET NULL,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    read_at             TIMESTAMPTZ
+);
+
+CREATE INDEX "notifications_user_id_idx" ON notifications (user_id, created_at DESC);
+
+-- +goose Down
+DROP TABLE "notifications";
+DROP TABLE "rehydration_requests";
+DROP INDEX "files_rehydrating_idx";
+ALTER TABLE files
+    DROP COLUMN rehydrated_at,
+    DROP COLUMN tier_changed_at,
+    DROP COLUMN tier;
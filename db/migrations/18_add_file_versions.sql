@@ -0,0 +1,77 @@
+-- +goose Up
+
+-- Re-uploading a file adds a version instead of a new file. Each version
+-- has its own object, stored under object_key in the primary and backup
+-- buckets, and its own lifecycle state. The content columns of files
+-- describe the current version, which can be changed to an older one.
+CREATE TABLE "file_versions"(
+    id                  SERIAL PRIMARY KEY,
+    file_id             INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    version             INTEGER NOT NULL,
+    object_key          TEXT NOT NULL,
+    filesize            BIGINT NOT NULL,
+    content_type        VARCHAR(255),
+    etag                VARCHAR(255),
+    file_url            TEXT NOT NULL,
+    checksum            VARCHAR(255),
+    uploaded_by         INTEGER,
+    uploaded_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    primary_policy      VARCHAR(64),
+    primary_expires_at  TIMESTAMPTZ,
+    primary_deleted_at  TIMESTAMPTZ,
+    backup_policy       VARCHAR(64),
+    backup_expires_at   TIMESTAMPTZ,
+    backup_deleted_at   TIMESTAMPTZ,
+    rehydrated_at       TIMESTAMPTZ,
+    UNIQUE (file_id, version)
+);
+
+CREATE INDEX "file_versions_object_key_idx" ON file_versions (object_key);
+
+-- Existing files become their first version, stored under their name
+INSERT INTO file_versions (file_id, version, object_key, filesize, content_type, etag, file_url, checksum, uploaded_by,
+        uploaded_at, primary_policy, primary_expires_at, primary_deleted_at, backup_policy, backup_expires_at,
+        backup_deleted_at, rehydrated_at)
+    SELECT id, 1, filename, filesize, content_type, etag, file_url, checksum, user_id,
+        upload_timestamp, primary_policy, primary_expires_at, primary_deleted_at, backup_policy, backup_expires_at,
+        backup_deleted_at, rehydrated_at
+    FROM files
+;
+
+ALTER TABLE files
+    ADD COLUMN version      INTEGER NOT NULL DEFAULT 1,
+    ADD COLUMN object_key   TEXT;
+
+UPDATE files SET object_key = filename;
+
+ALTER TABLE files
+    ALTER COLUMN object_key SET NOT NULL,
+    DROP COLUMN rehydrated_at,
+    DROP COLUMN backup_deleted_at,
+    DROP COLUMN backup_expires_at,
+    DROP COLUMN backup_policy,
+    DROP COLUMN primary_deleted_at,
+    DROP COLUMN primary_expires_at,
+    DROP COLUMN primary_policy;
+
+CREATE INDEX "files_user_id_filename_idx" ON files (user_id, filename) WHERE status = 'active';
+
+-- +goose Down
+DROP INDEX "files_user_id_filename_idx";
+ALTER TABLE files
+    ADD COLUMN primary_policy       VARCHAR(64),
+    ADD COLUMN primary_expires_at   TIMESTAMPTZ,
+    ADD COLUMN primary_deleted_at   TIMESTAMPTZ,
+    ADD COLUMN backup_policy        VARCHAR(64),
+    ADD COLUMN backup_expires_at    TIMESTAMPTZ,
+    ADD COLUMN backup_deleted_at    TIMESTAMPTZ,
+    ADD COLUMN rehydrated_at        TIMESTAMPTZ;
+UPDATE files f SET
+    primary_policy = v.primary_policy, primary_expires_at = v.primary_expires_at, primary_deleted_at = v.primary_deleted_at,
+    backup_policy = v.backup_policy, backup_expires_at = v.backup_expires_at, backup_deleted_at = v.backup_deleted_at,
+    rehydrated_at = v.rehydrated_at
+    FROM file_versions v WHERE v.file_id = f.id AND v.version = f.version;
+ALTER TABLE files
+    DROP COLUMN object_key,
+    DROP COLUMN version;
+DROP TABLE "file_versions";
@@ -0,0 +1,23 @@
+-- +goose Up
+
+-- Objects referenced by file versions, counted so an object is removed
+-- with its last reference. Uploads are stored once per content, under a
+-- key derived from their SHA-256; objects stored before have no sha256.
+CREATE TABLE "blobs"(
+    object_key          TEXT PRIMARY KEY,
+    sha256              CHAR(64) UNIQUE,
+    size                BIGINT NOT NULL,
+    refcount            INTEGER NOT NULL CHECK (refcount >= 0),
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO blobs (object_key, size, refcount)
+    SELECT object_key, MAX(filesize), COUNT(*) FROM file_versions GROUP BY object_key
+;
+
+ALTER TABLE file_versions
+    ADD CONSTRAINT "file_versions_object_key_fkey" FOREIGN KEY (object_key) REFERENCES blobs(object_key);
+
+-- +goose Down
+ALTER TABLE file_versions DROP CONSTRAINT "file_versions_object_key_fkey";
+DROP TABLE "blobs";
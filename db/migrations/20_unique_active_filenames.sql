@@ -0,0 +1,19 @@
+-- +goose Up
+
+-- A user has at most one active file per name, new uploads of the name are
+-- added as its versions. Older duplicates, left by restoring a file after
+-- one with the same name was uploaded, are moved to the trash; the newest
+-- file is the one uploads already added versions to.
+UPDATE files f SET status = 'trashed', deleted_at = NOW()
+    WHERE status = 'active' AND EXISTS (
+        SELECT 1 FROM files n
+        WHERE n.user_id = f.user_id AND n.filename = f.filename AND n.status = 'active' AND n.id > f.id
+    )
+;
+
+DROP INDEX "files_user_id_filename_idx";
+CREATE UNIQUE INDEX "files_user_id_filename_idx" ON files (user_id, filename) WHERE status = 'active';
+
+-- +goose Down
+DROP INDEX "files_user_id_filename_idx";
+CREATE INDEX "files_user_id_filename_idx" ON files (user_id, filename) WHERE status = 'active';
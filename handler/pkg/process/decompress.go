@@ -0,0 +1,21 @@
+package process
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+// DecompressData reverses CompressData.
+func DecompressData(reader io.Reader) (io.Reader, error) {
+	xzReader, err := xz.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, xzReader); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
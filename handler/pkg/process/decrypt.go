@@ -0,0 +1,39 @@
+package process
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io"
+)
+
+// ErrCorrupt is returned for data that was not encrypted with the key or
+// was altered.
+var ErrCorrupt = errors.New("data cannot be decrypted")
+
+// DecryptData reverses EncryptData.
+func DecryptData(reader io.Reader, key string) (io.Reader, error) {
+	block, err := aes.NewCipher([]byte(createHash(key)))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrCorrupt
+	}
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plain, err := gcm.Open(sealed[:0], nonce, sealed, nil)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return bytes.NewReader(plain), nil
+}
@@ -12,7 +12,7 @@ import (
 	"video-platform/uploader/pkg/queue"
 )
 
-func HandleMessage(msg *nats.Msg, minioClient *minio.Client, config *config.ServerConfig, l *zap.SugaredLogger) {
+func HandleMessage(msg *nats.Msg, minioClient *minio.Client, js nats.JetStreamContext, config *config.ServerConfig, l *zap.SugaredLogger) {
 	var message queue.Message
 	err := json.Unmarshal(msg.Data, &message)
 	if err != nil {
@@ -22,6 +22,15 @@ func HandleMessage(msg *nats.Msg, minioClient *minio.Client, config *config.Serv
 
 	l.Infof("Processing file with ETag: %s from bucket: %s", message.Filename, message.Bucket)
 
+	// Identical uploads share a blob, which only needs one backup
+	if _, err := minioClient.StatObject(context.Background(), config.MinioDestBucket, message.Filename, minio.StatObjectOptions{}); err == nil {
+		l.Infow("Backup already stored, skipping", zap.String("filename", message.Filename), zap.String("bucket", config.MinioDestBucket))
+		return
+	} else if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		l.Errorw("Failed to check for backup", zap.String("filename", message.Filename), zap.Error(err))
+		return
+	}
+
 	// Download the file
 	object, err := minioClient.GetObject(context.Background(), message.Bucket, message.Filename, minio.GetObjectOptions{})
 	if err != nil {
@@ -45,11 +54,21 @@ func HandleMessage(msg *nats.Msg, minioClient *minio.Client, config *config.Serv
 	}
 
 	// Store the file in the destination bucket
-	_, err = minioClient.PutObject(context.Background(), config.MinioDestBucket, message.Filename, compressedData, -1, minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	info, err := minioClient.PutObject(context.Background(), config.MinioDestBucket, message.Filename, compressedData, -1, minio.PutObjectOptions{ContentType: "application/octet-stream"})
 	if err != nil {
 		l.Error("Failed to put object to MinIO", zap.Error(err))
 		return
 	}
 
 	l.Infof("Successfully processed and stored file with ETag: %s to bucket: %s", message.Filename, config.MinioDestBucket)
+
+	// Report the backup so the uploader can meter it
+	data, err := json.Marshal(queue.BackupMessage{Bucket: config.MinioDestBucket, Filename: message.Filename, Size: info.Size})
+	if err != nil {
+		l.Error("Failed to marshal backup message", zap.Error(err))
+		return
+	}
+	if _, err := js.Publish(queue.BackedUpSubject, data); err != nil {
+		l.Errorw("Failed to publish backup message", zap.String("filename", message.Filename), zap.Error(err))
+	}
 }
@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+	"video-platform/handler/pkg/config"
+	"video-platform/handler/pkg/process"
+	"video-platform/uploader/pkg/queue"
+)
+
+// Wait before a failed rehydration is retried
+const rehydrateRetryDelay = 30 * time.Second
+
+// errUnrecoverable marks failures that retrying does not fix
+var errUnrecoverable = errors.New("backup cannot be restored")
+
+// HandleRehydrate restores the backup of a file into the source bucket and
+// reports the outcome on the rehydrated subject. Transient failures are
+// retried through redelivery.
+func HandleRehydrate(msg *nats.Msg, minioClient *minio.Client, js nats.JetStreamContext, config *config.ServerConfig, l *zap.SugaredLogger) {
+	var request queue.RehydrateMessage
+	if err := json.Unmarshal(msg.Data, &request); err != nil {
+		l.Errorw("Failed to unmarshal rehydrate message", zap.Error(err))
+		msg.Term()
+		return
+	}
+
+	// Requests from before versioning name the object by the file
+	if request.ObjectKey == "" {
+		request.ObjectKey = request.Filename
+	}
+
+	l.Infow("Rehydrating file", zap.Int("file_id", request.FileID), zap.String("object_key", request.ObjectKey))
+	result := queue.RehydratedMessage{FileID: request.FileID, Filename: request.Filename, ObjectKey: request.ObjectKey, Bucket: config.MinioSourceBucket}
+	size, err := rehydrate(context.Background(), minioClient, config, request)
+	if err != nil && !errors.Is(err, errUnrecoverable) {
+		l.Errorw("Failed to rehydrate file, retrying", zap.Int("file_id", request.FileID), zap.Error(err))
+		msg.NakWithDelay(rehydrateRetryDelay)
+		return
+	}
+	if err != nil {
+		l.Errorw("Failed to rehydrate file", zap.Int("file_id", request.FileID), zap.Error(err))
+		result.Error = err.Error()
+	} else {
+		l.Infow("Rehydrated file", zap.Int("file_id", request.FileID), zap.String("bucket", config.MinioSourceBucket), zap.Int64("size", size))
+		result.Size = size
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		l.Error("Failed to marshal rehydrated message", zap.Error(err))
+		msg.Term()
+		return
+	}
+	if _, err := js.Publish(queue.RehydratedSubject, data); err != nil {
+		l.Errorw("Failed to publish rehydrated message", zap.Int("file_id", request.FileID), zap.Error(err))
+		msg.NakWithDelay(rehydrateRetryDelay)
+		return
+	}
+	msg.Ack()
+}
+
+// rehydrate decompresses and decrypts the backup, checks it against the
+// checksum of the original and stores it. It returns the stored size.
+func rehydrate(ctx context.Context, minioClient *minio.Client, config *config.ServerConfig, request queue.RehydrateMessage) (int64, error) {
+	object, err := minioClient.GetObject(ctx, config.MinioDestBucket, request.ObjectKey, minio.GetObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer object.Close()
+	var backup bytes.Buffer
+	if _, err := io.Copy(&backup, object); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return 0, fmt.Errorf("%w: no backup", errUnrecoverable)
+		}
+		return 0, err
+	}
+
+	// Backups are encrypted, then compressed
+	decompressed, err := process.DecompressData(&backup)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errUnrecoverable, err)
+	}
+	decrypted, err := process.DecryptData(decompressed, config.EncryptionKey)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errUnrecoverable, err)
+	}
+	data, err := io.ReadAll(decrypted)
+	if err != nil {
+		return 0, err
+	}
+	if request.Checksum != "" {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != request.Checksum {
+			return 0, fmt.Errorf("%w: checksum mismatch", errUnrecoverable)
+		}
+	}
+
+	info, err := minioClient.PutObject(ctx, config.MinioSourceBucket, request.ObjectKey, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: request.ContentType})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
@@ -0,0 +1,9 @@
+# Generates a JWT signing key for the uploader, usage: genkey.sh <kid> [rsa|ed25519]
+# Set JWT_ACTIVE_KID=<kid> once every replica can see the new key to rotate.
+KID=${1:?kid required}
+DIR=$(dirname "$0")/../volumes/jwt/keys
+if [ "${2:-rsa}" = "ed25519" ]; then
+    openssl genpkey -algorithm ed25519 -out "$DIR/$KID.pem"
+else
+    openssl genpkey -algorithm RSA -pkeyopt rsa_keygen_bits:2048 -out "$DIR/$KID.pem"
+fi
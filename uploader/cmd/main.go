@@ -3,91 +3,89 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/spf13/viper"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.uber.org/zap"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"video-platform/uploader/pkg/audit"
 	"video-platform/uploader/pkg/auth"
-	"video-platform/uploader/pkg/config"
+	configpkg "video-platform/uploader/pkg/config"
 	"video-platform/uploader/pkg/handlers"
+	"video-platform/uploader/pkg/health"
+	"video-platform/uploader/pkg/holds"
+	"video-platform/uploader/pkg/lifecycle"
+	"video-platform/uploader/pkg/metering"
 	"video-platform/uploader/pkg/monitoring"
+	"video-platform/uploader/pkg/oidc"
+	"video-platform/uploader/pkg/policy"
+	"video-platform/uploader/pkg/queue"
+	"video-platform/uploader/pkg/ratelimit"
+	"video-platform/uploader/pkg/storage"
+	"video-platform/uploader/pkg/tiering"
+	"video-platform/uploader/pkg/trash"
 )
 
-const (
-	portOpt              = "PORT"
-	minioHostOpt         = "MINIO_HOST"
-	minioPortOpt         = "MINIO_PORT"
-	minioUserOpt         = "MINIO_USER"
-	minioPasswordOpt     = "MINIO_PASSWORD"
-	minioBucketOpt       = "MINIO_BUCKET"
-	videoFormFilenameOpt = "VIDEO_FORM_FILENAME"
-	postgresDSNOpt       = "POSTGRES_DSN"
-	jaegerEndpointOpt    = "JAEGER_ENDPOINT"
-)
-
-func buildConfig() *config.ServerConfig {
-	return &config.ServerConfig{
-		Port:              viper.GetInt(portOpt),
-		MinioHost:         viper.GetString(minioHostOpt),
-		MinioPort:         viper.GetInt(minioPortOpt),
-		MinioUser:         viper.GetString(minioUserOpt),
-		MinioPassword:     viper.GetString(minioPasswordOpt),
-		MinioBucket:       viper.GetString(minioBucketOpt),
-		VideoFormFilename: viper.GetString(videoFormFilenameOpt),
-		PostgresDSN:       viper.GetString(postgresDSNOpt),
-		JaegerEndpoint:    viper.GetString(jaegerEndpointOpt),
-	}
-}
-
 var (
-	l *zap.SugaredLogger
+	l     *zap.SugaredLogger
+	level = zap.NewAtomicLevelAt(zap.DebugLevel)
 )
 
 func init() {
-	logger := zap.Must(zap.NewDevelopment())
+	logConfig := zap.NewDevelopmentConfig()
+	logConfig.Level = level
+	logger := zap.Must(logConfig.Build())
 	defer logger.Sync()
 	l = logger.Sugar()
+}
 
-	viper.SetDefault(portOpt, 8080)
-	viper.SetDefault(portOpt, "localhost")
-	viper.SetDefault(portOpt, 9000)
-	viper.SetConfigName("uploader")
-	viper.SetConfigType("props")
-	viper.AddConfigPath(".")
-	viper.AutomaticEnv()
-	err := viper.ReadInConfig()
+func main() {
+	l.Debug("Reading configuration")
+	loader, err := configpkg.NewLoader("uploader", configpkg.ServerConfig{}, os.Args[1:], l)
+	if err != nil {
+		l.Fatalw("Failed to read configuration", zap.Error(err))
+	}
+	config, err := configpkg.Load[configpkg.ServerConfig](loader)
 	if err != nil {
-		l.Info("Did not find config file... Configuring from envs")
+		l.Fatalw("Failed to load configuration", zap.Error(err))
 	}
+	l.Infow("Loaded configuration", zap.Any("config", configpkg.Redacted(config)))
 
-}
+	// Load the token signing keys
+	keys, err := auth.LoadKeySet(config.JWTKeysDir, config.JWTActiveKid, l)
+	if err != nil {
+		l.Fatalw("Failed to load JWT signing keys", zap.Error(err))
+	}
+	tokens := auth.NewTokenService(keys, config.JWTIssuer, config.JWTAudience, config.JWTTTL, config.RefreshTokenTTL)
 
-func main() {
-	l.Debug("Reading configuration")
-	config := buildConfig()
+	// Log level, trash retention and the active signing key can be changed without a restart
+	live := configpkg.NewLive(level, config)
+	configpkg.Watch(loader, func(c *configpkg.ServerConfig) {
+		live.Apply(c)
+		if err := keys.Reload(c.JWTActiveKid); err != nil {
+			l.Errorw("Failed to reload JWT signing keys", zap.Error(err))
+		}
+	})
 
 	// Initialize OpenTelemetry tracer
 	tp, err := monitoring.InitTracer(config)
 	if err != nil {
 		l.Fatal("Failed to initialize OpenTelemetry tracer", zap.Error(err))
 	}
-	defer func() {
-		if err := tp.Shutdown(context.Background()); err != nil {
-			l.Fatal("Failed to shutdown OpenTelemetry tracer", zap.Error(err))
-		}
-	}()
 
 	// Connect to PostgreSQL
-	db, err := sql.Open("pgx", "postgresql://postgres:5432/videos?user=postgres&password=postgres")
+	db, err := sql.Open("pgx", config.PostgresDSN)
 	if err != nil {
 		l.Fatal("Failed to connect to PostgreSQL", zap.Error(err))
 	}
-	defer db.Close()
 
 	// Initialize MinIO client
 	minioClient, err := minio.New(fmt.Sprintf("%s:%d", config.MinioHost, config.MinioPort), &minio.Options{
@@ -99,13 +97,298 @@ func main() {
 		return
 	}
 
-	http.HandleFunc("/login", handlers.Login(db, l))
-	http.Handle("/upload", auth.Authenticate(handlers.UploadFileHandler(config, db, minioClient, l), l))
-	http.Handle("/files", auth.Authenticate(handlers.GetUserFiles(db, l), l))
-	http.Handle("/download", auth.Authenticate(handlers.DownloadFile(db, minioClient, config.MinioBucket, l), l))
+	// Connect to NATS
+	publisher, err := queue.NewPublisher(config.NatsURL, config.ShutdownTimeout, l)
+	if err != nil {
+		l.Fatal("Failed to connect to NATS", zap.Error(err))
+	}
+
+	// Dependency checks only affect readiness, the process keeps running
+	checker := health.NewChecker(config.HealthTimeout)
+	checker.Register("postgres", health.PostgresCheck(db))
+	checker.Register("minio", health.BucketCheck(minioClient, config.MinioBucket))
+	checker.Register("nats", health.StreamCheck(publisher.JetStream(), config.NatsStream))
+	if config.OpaMode == "remote" {
+		checker.Register("opa", health.HTTPCheck(config.OpaURL+"/health"))
+	}
+
+	http.HandleFunc("/healthz", health.LivenessHandler())
+	http.HandleFunc("/readyz", checker.ReadinessHandler(l))
+	accessTokens := auth.NewAccessTokens(db, config.RevocationCacheTTL)
+	revoker := auth.NewRevoker(db, accessTokens, config.RevocationCacheTTL)
+	roles := auth.NewRolePermissions(db, config.RoleCacheTTL)
+
+	// Decisions are logged to the audit trail, which is flushed on shutdown
+	auditLog := audit.NewLogger(db, config.AuditBufferSize, l)
+
+	pollCtx, stopPolling := context.WithCancel(context.Background())
+	defer stopPolling()
+	var backend auth.Authorizer
+	var dataTarget policy.DataTarget
+	var engine *policy.Engine
+	if config.OpaMode == "embedded" {
+		engine, err = policy.NewEngine(pollCtx, policy.NewSource(config.OpaBundle, config.OpaTimeout), config.OpaTimeout, l)
+		if err != nil {
+			l.Fatalw("Failed to load policy", zap.Error(err))
+		}
+		backend, dataTarget = engine, engine
+	} else {
+		backend = auth.NewRemoteAuthorizer(config.OpaURL, config.OpaTimeout, l)
+		dataTarget = policy.NewRemoteData(config.OpaURL, config.OpaTimeout)
+	}
+	authorizer := auth.NewEnforcer(backend, auth.EnforcerOptions{
+		CacheTTL:          config.OpaDecisionCacheTTL,
+		FailMode:          config.OpaFailMode,
+		FailOpenActions:   config.OpaFailOpenActions,
+		FailClosedActions: config.OpaFailClosedActions,
+	}, auditLog, l)
+	if engine != nil {
+		engine.OnChange(authorizer.Reset)
+		go engine.Poll(pollCtx, config.OpaBundlePollInterval)
+	}
+
+	// Publish the admin-managed policy data and the signing keys and keep
+	// them in sync
+	dataSync := policy.NewDataSync(db, keys, dataTarget, l)
+	dataSync.OnChange(authorizer.Reset)
+	keys.OnChange(func() {
+		if err := dataSync.Publish(pollCtx); err != nil {
+			l.Errorw("Failed to publish policy data", zap.Error(err))
+		}
+	})
+	if err := dataSync.Publish(pollCtx); err != nil {
+		l.Errorw("Failed to publish policy data", zap.Error(err))
+	}
+	go dataSync.Run(pollCtx, config.OpaDataSyncInterval)
+	// Transferred bytes are counted in memory and flushed periodically and
+	// on shutdown. Backups are reported by the handler, each to one replica.
+	meter := metering.NewMeter(db, l)
+	go meter.Run(pollCtx, config.MeteringFlushInterval)
+	if config.MeteringTopConsumers > 0 {
+		go meter.ExportTopConsumers(pollCtx, config.MeteringTopConsumers, config.MeteringTopWindow, config.MeteringTopInterval)
+	}
+	_, err = publisher.JetStream().QueueSubscribe(queue.BackedUpSubject, "uploader-metering", meter.HandleBackup,
+		nats.Durable("uploader-metering"), nats.ManualAck())
+	if err != nil {
+		l.Fatalw("Failed to subscribe to backup messages", zap.Error(err))
+	}
+
+	// Deleted files are purged with their backups once they can no longer
+	// be restored
+	bin := trash.New(db, minioClient, []string{config.MinioBucket, config.MinioBackupBucket}, publisher, live, l)
+	go bin.Run(pollCtx, config.TrashPurgeInterval)
+
+	// Legal holds and retention keep files from every delete path
+	fileHolds := holds.New(db, minioClient, []string{config.MinioBucket, config.MinioBackupBucket}, config.ObjectLockMode, l)
+	if err := fileHolds.DetectLocking(pollCtx); err != nil {
+		l.Errorw("Failed to check object locking, holds are only recorded in the database", zap.Error(err))
+	}
+	_, err = publisher.JetStream().QueueSubscribe(queue.BackedUpSubject, "uploader-holds", fileHolds.HandleBackup,
+		nats.Durable("uploader-holds"), nats.ManualAck())
+	if err != nil {
+		l.Fatalw("Failed to subscribe to backup messages", zap.Error(err))
+	}
+
+	// Copies of files expire according to the lifecycle policies, applied
+	// by whichever replica holds the lifecycle lock
+	lifecycleEngine, err := lifecycle.NewEngine(db, minioClient, config.MinioBucket, config.MinioBackupBucket, bin,
+		config.LifecyclePolicies, config.LifecycleDryRun, config.RehydrationTTL, l)
+	if err != nil {
+		l.Fatalw("Failed to load lifecycle policies", zap.Error(err))
+	}
+	go lifecycleEngine.Run(pollCtx, config.LifecycleInterval)
+
+	// Archived files are rehydrated by the handler when downloaded
+	tiers := tiering.New(db, publisher, fileHolds, l)
+	go tiers.Run(pollCtx, config.RehydrationRetry, config.RehydrationRetry)
+	_, err = publisher.JetStream().QueueSubscribe(queue.RehydratedSubject, "uploader-tiering", tiers.HandleRehydrated,
+		nats.Durable("uploader-tiering"), nats.ManualAck())
+	if err != nil {
+		l.Fatalw("Failed to subscribe to rehydrated messages", zap.Error(err))
+	}
+
+	authn := auth.NewAuthenticator(tokens, accessTokens, revoker, roles, authorizer, l)
+	limiter := ratelimit.NewLimiter(live, l)
+	authn.Use(limiter.PerUser)
+	admission := ratelimit.NewAdmission(live, config.UploadRetryAfter)
+	if config.MFASecretKey == "" {
+		l.Warn("MFA_SECRET_KEY is not set, TOTP secrets are stored unencrypted")
+	}
+	mfa, err := auth.NewMFA(db, config.MFAIssuer, config.MFARequiredRoles, config.MFAChallengeTTL, config.MFASecretKey)
+	if err != nil {
+		l.Fatalw("Failed to set up MFA", zap.Error(err))
+	}
+	var hasher auth.PasswordHasher = auth.Argon2idHasher{
+		Memory:      config.PasswordArgon2Memory,
+		Iterations:  config.PasswordArgon2Iterations,
+		Parallelism: config.PasswordArgon2Threads,
+	}
+	if config.PasswordHashAlgorithm == "bcrypt" {
+		hasher = auth.BcryptHasher{Cost: config.PasswordBcryptCost}
+	}
+	passwords, err := auth.NewPasswords(hasher, auth.PasswordPolicy{
+		MinLength:    config.PasswordMinLength,
+		MaxLength:    config.PasswordMaxLength,
+		BreachedList: config.PasswordBreachedList,
+	})
+	if err != nil {
+		l.Fatalw("Failed to set up password policy", zap.Error(err))
+	}
+	if config.PasswordBreachedList != "" {
+		l.Infow("Loaded breached password list", zap.Int("entries", passwords.BreachedCount()))
+	}
+	var provider *oidc.Provider
+	var mapping *oidc.ClaimMapping
+	if config.OIDCIssuer != "" {
+		groupRoles, err := oidc.ParseGroupRoles(config.OIDCRoleMapping)
+		if err != nil {
+			l.Fatalw("Invalid OIDC_ROLE_MAPPING", zap.Error(err))
+		}
+		provider = oidc.NewProvider(oidc.Config{
+			Issuer:       config.OIDCIssuer,
+			ClientID:     config.OIDCClientID,
+			ClientSecret: config.OIDCClientSecret,
+			RedirectURL:  config.OIDCRedirectURL,
+			Scopes:       config.OIDCScopes,
+			Timeout:      config.OIDCTimeout,
+		})
+		mapping = &oidc.ClaimMapping{
+			UsernameClaim: config.OIDCUsernameClaim,
+			EmailClaim:    config.OIDCEmailClaim,
+			GroupsClaim:   config.OIDCGroupsClaim,
+			GroupRoles:    groupRoles,
+			DefaultRoles:  config.OIDCDefaultRoles,
+		}
+	}
+	throttle := auth.NewLoginThrottle(db, auth.LoginThrottleOptions{
+		AccountMaxFailures: config.LoginMaxFailures,
+		IPMaxFailures:      config.LoginIPMaxFailures,
+		LockoutBase:        config.LoginLockoutBase,
+		LockoutMax:         config.LoginLockoutMax,
+		FailureReset:       config.LoginFailureReset,
+	})
+
+	http.HandleFunc("/.well-known/jwks.json", auth.JWKSHandler(keys))
+	http.HandleFunc("/login", handlers.Login(db, tokens, passwords, mfa, throttle, auditLog, l))
+	http.HandleFunc("POST /login/mfa", handlers.LoginMFA(db, tokens, mfa, throttle, auditLog, l))
+	if provider != nil {
+		http.HandleFunc("GET /auth/oidc/login", handlers.OIDCLogin(db, provider, config, l))
+		http.HandleFunc("GET /auth/oidc/callback", handlers.OIDCCallback(db, tokens, provider, mapping, mfa, config, auditLog, l))
+		http.Handle("POST /me/identities/oidc", authn.Authenticate(auth.SessionOnly(handlers.LinkOIDCIdentity(db, provider, config, l))))
+	}
+	http.Handle("GET /me/identities", authn.Authenticate(auth.SessionOnly(handlers.ListIdentities(db, l))))
+	http.Handle("DELETE /me/identities/{id}", authn.Authenticate(auth.SessionOnly(handlers.UnlinkIdentity(db, auditLog, l))))
+	http.HandleFunc("POST /token/refresh", handlers.RefreshToken(db, tokens, revoker, mfa, l))
+	http.Handle("POST /logout", authn.Authenticate(handlers.Logout(db, tokens, revoker, l)))
+	http.HandleFunc("POST /register", handlers.Register(db, config, passwords, auditLog, l))
+	http.Handle("POST /me/password", authn.Authenticate(auth.SessionOnly(handlers.ChangePassword(db, tokens, revoker, passwords, auditLog, l))))
+	http.Handle("GET /me/notifications", authn.Authenticate(handlers.ListNotifications(db, l)))
+	http.Handle("POST /me/notifications/read", authn.Authenticate(handlers.MarkNotificationsRead(db, l)))
+	http.Handle("GET /me/usage", authn.Authenticate(handlers.GetMyUsage(db, l)))
+	http.Handle("GET /me/tokens", authn.Authenticate(auth.SessionOnly(handlers.ListAccessTokens(db, l))))
+	http.Handle("POST /me/tokens", authn.Authenticate(auth.SessionOnly(handlers.CreateAccessToken(db, config.AccessTokenDefaultTTL, config.AccessTokenMaxTTL, auditLog, l))))
+	http.Handle("DELETE /me/tokens/{id}", authn.Authenticate(auth.SessionOnly(handlers.RevokeAccessToken(accessTokens, auditLog, l))))
+	http.Handle("POST /me/mfa/enroll", authn.Authenticate(auth.SessionOnly(handlers.EnrollMFA(mfa, l))))
+	http.Handle("POST /me/mfa/confirm", authn.Authenticate(auth.SessionOnly(handlers.ConfirmMFA(mfa, auditLog, l))))
+	http.Handle("DELETE /me/mfa", authn.Authenticate(auth.SessionOnly(handlers.DisableMFA(mfa, auditLog, l))))
+	http.Handle("POST /me/mfa/recovery-codes", authn.Authenticate(auth.SessionOnly(handlers.RegenerateRecoveryCodes(mfa, auditLog, l))))
+	http.Handle("GET /admin/users", authn.Protect(auth.PermUsersManage, auth.ActionUserList, handlers.ListUsers(db, l)))
+	http.Handle("POST /admin/users", authn.Protect(auth.PermUsersManage, auth.ActionUserCreate, handlers.CreateUser(db, passwords, auditLog, l)))
+	http.Handle("POST /admin/users/{id}/disable", authn.Protect(auth.PermUsersManage, auth.ActionUserStatusUpdate, handlers.SetUserStatus(db, revoker, storage.UserDisabled, auditLog, l)))
+	http.Handle("POST /admin/users/{id}/enable", authn.Protect(auth.PermUsersManage, auth.ActionUserStatusUpdate, handlers.SetUserStatus(db, revoker, storage.UserActive, auditLog, l)))
+	http.Handle("DELETE /admin/users/{id}", authn.Protect(auth.PermUsersManage, auth.ActionUserDelete, handlers.DeleteUser(db, minioClient, []string{config.MinioBucket, config.MinioBackupBucket}, auditLog, l)))
+	http.Handle("POST /admin/users/{id}/reset-password", authn.Protect(auth.PermUsersManage, auth.ActionUserPasswordReset, handlers.ResetPassword(db, revoker, passwords, auditLog, l)))
+	http.Handle("DELETE /admin/users/{id}/mfa", authn.Protect(auth.PermUsersManage, auth.ActionUserMFAReset, handlers.ResetUserMFA(mfa, auditLog, l)))
+	http.Handle("POST /admin/users/{id}/unlock", authn.Protect(auth.PermUsersManage, auth.ActionLoginUnlock, handlers.UnlockUser(throttle, auditLog, l)))
+	http.Handle("GET /admin/lockouts", authn.Protect(auth.PermUsersManage, auth.ActionLoginLockRead, handlers.ListLoginLocks(db, l)))
+	http.Handle("DELETE /admin/lockouts/{key}", authn.Protect(auth.PermUsersManage, auth.ActionLoginUnlock, handlers.UnlockLogin(throttle, auditLog, l)))
+	http.Handle("GET /admin/users/{id}/usage", authn.Protect(auth.PermUsersManage, auth.ActionQuotaRead, handlers.GetUserUsage(db, l)))
+	http.Handle("PUT /admin/users/{id}/quota", authn.Protect(auth.PermUsersManage, auth.ActionQuotaUpdate, handlers.SetUserQuota(db, auditLog, l)))
+	http.Handle("DELETE /admin/users/{id}/quota", authn.Protect(auth.PermUsersManage, auth.ActionQuotaUpdate, handlers.DeleteUserQuota(db, auditLog, l)))
+	http.Handle("GET /admin/quotas", authn.Protect(auth.PermUsersManage, auth.ActionQuotaRead, handlers.ListRoleQuotas(db, l)))
+	http.Handle("PUT /admin/roles/{role}/quota", authn.Protect(auth.PermUsersManage, auth.ActionQuotaUpdate, handlers.SetRoleQuota(db, auditLog, l)))
+	http.Handle("DELETE /admin/roles/{role}/quota", authn.Protect(auth.PermUsersManage, auth.ActionQuotaUpdate, handlers.DeleteRoleQuota(db, auditLog, l)))
+	http.Handle("GET /admin/reports/usage", authn.Protect(auth.PermUsersManage, auth.ActionUsageReport, handlers.UsageReport(db, l)))
+	http.Handle("GET /admin/lifecycle/report", authn.Protect(auth.PermPolicyManage, auth.ActionLifecycleRead, handlers.LifecycleReport(lifecycleEngine, l)))
+	http.Handle("POST /admin/invites", authn.Protect(auth.PermUsersManage, auth.ActionInviteCreate, handlers.CreateInvite(db, config.RegistrationRole, config.InviteTTL, auditLog, l)))
+	http.Handle("POST /admin/users/{id}/revoke-sessions", authn.Protect(auth.PermSessionsManage, auth.ActionSessionsRevoke, handlers.RevokeUserSessions(revoker, l)))
+	http.Handle("PUT /admin/users/{id}/roles", authn.Protect(auth.PermUsersManage, auth.ActionUserRolesUpdate, handlers.SetUserRoles(db, l)))
+	http.Handle("GET /admin/denylist", authn.Protect(auth.PermPolicyManage, auth.ActionPolicyRead, handlers.ListDenylist(db, l)))
+	http.Handle("POST /admin/denylist", authn.Protect(auth.PermPolicyManage, auth.ActionPolicyUpdate, handlers.AddDenylistEntry(db, dataSync, auditLog, l)))
+	http.Handle("DELETE /admin/denylist/{id}", authn.Protect(auth.PermPolicyManage, auth.ActionPolicyUpdate, handlers.DeleteDenylistEntry(db, dataSync, auditLog, l)))
+	http.Handle("GET /admin/suspensions", authn.Protect(auth.PermPolicyManage, auth.ActionPolicyRead, handlers.ListSuspensions(db, l)))
+	http.Handle("PUT /admin/users/{id}/suspension", authn.Protect(auth.PermPolicyManage, auth.ActionPolicyUpdate, handlers.SuspendUser(db, dataSync, auditLog, l)))
+	http.Handle("DELETE /admin/users/{id}/suspension", authn.Protect(auth.PermPolicyManage, auth.ActionPolicyUpdate, handlers.UnsuspendUser(db, dataSync, auditLog, l)))
+	http.Handle("PUT /admin/users/{id}/upload-limit", authn.Protect(auth.PermPolicyManage, auth.ActionPolicyUpdate, handlers.SetUploadLimit(db, dataSync, auditLog, l)))
+	http.Handle("DELETE /admin/users/{id}/upload-limit", authn.Protect(auth.PermPolicyManage, auth.ActionPolicyUpdate, handlers.DeleteUploadLimit(db, dataSync, auditLog, l)))
+	http.Handle("/upload", authn.Protect(auth.PermFilesWrite, auth.ActionFileUpload, admission.Limit(handlers.UploadFileHandler(config, db, minioClient, publisher, authorizer, fileHolds, meter, l))))
+	http.Handle("/files", authn.Protect(auth.PermFilesRead, auth.ActionFileList, handlers.GetUserFiles(db, bin, authorizer, l)))
+	http.Handle("DELETE /files/{id}", authn.Protect(auth.PermFilesWrite, auth.ActionFileDelete, handlers.DeleteFile(db, bin, authorizer, auditLog, l)))
+	http.Handle("POST /files/{id}/restore", authn.Protect(auth.PermFilesWrite, auth.ActionFileRestore, handlers.RestoreFile(db, bin, authorizer, auditLog, l)))
+	http.Handle("GET /files/{id}/versions", authn.Protect(auth.PermFilesRead, auth.ActionFileVersionList, handlers.ListVersions(db, authorizer, l)))
+	http.Handle("GET /files/{id}/versions/{version}", authn.Protect(auth.PermFilesRead, auth.ActionFileDownload, handlers.DownloadVersion(db, minioClient, config.MinioBucket, authorizer, meter, tiers, config.RehydrationRetryAfter, l)))
+	http.Handle("POST /files/{id}/versions/{version}/promote", authn.Protect(auth.PermFilesWrite, auth.ActionFileVersionPromote, handlers.PromoteVersion(db, authorizer, fileHolds, auditLog, l)))
+	http.Handle("GET /admin/holds", authn.Protect(auth.PermFilesHold, auth.ActionFileHoldRead, handlers.ListHeldFiles(db, l)))
+	http.Handle("PUT /admin/files/{id}/legal-hold", authn.Protect(auth.PermFilesHold, auth.ActionFileHoldUpdate, handlers.SetLegalHold(db, fileHolds, auditLog, l)))
+	http.Handle("DELETE /admin/files/{id}/legal-hold", authn.Protect(auth.PermFilesHold, auth.ActionFileHoldUpdate, handlers.ReleaseLegalHold(db, fileHolds, auditLog, l)))
+	http.Handle("PUT /admin/files/{id}/retention", authn.Protect(auth.PermFilesHold, auth.ActionFileHoldUpdate, handlers.SetRetention(db, fileHolds, auditLog, l)))
+	http.Handle("DELETE /admin/files/{id}/retention", authn.Protect(auth.PermFilesHold, auth.ActionFileHoldUpdate, handlers.RemoveRetention(db, fileHolds, auditLog, l)))
+	http.Handle("/download", authn.Protect(auth.PermFilesRead, auth.ActionFileDownload, handlers.DownloadFile(db, minioClient, config.MinioBucket, authorizer, meter, tiers, config.RehydrationRetryAfter, l)))
 
 	// Expose the /metrics endpoint
 	http.Handle("/metrics", promhttp.Handler())
 
-	http.ListenAndServe(fmt.Sprintf(":%d", config.Port), otelhttp.NewHandler(http.DefaultServeMux, "Server"))
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", config.Port),
+		Handler:           otelhttp.NewHandler(limiter.PerIP(http.DefaultServeMux), "Server"),
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		l.Infow("Starting server", zap.Int("port", config.Port))
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.Fatalw("Server failed", zap.Error(err))
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	stopPolling()
+	checker.SetShuttingDown()
+	l.Infow("Shutting down, waiting for in-flight requests", zap.Duration("timeout", config.ShutdownTimeout))
+
+	// Stop accepting connections and let in-flight uploads finish
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		l.Errorw("In-flight requests did not finish in time, closing connections", zap.Error(err))
+		srv.Close()
+	}
+
+	// Flush queued messages and traces before releasing the database
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancelFlush()
+	if err := publisher.Close(flushCtx); err != nil {
+		l.Errorw("Failed to drain NATS connection", zap.Error(err))
+	}
+	if err := meter.Flush(flushCtx); err != nil {
+		l.Errorw("Failed to write usage", zap.Error(err))
+	}
+	if err := auditLog.Close(flushCtx); err != nil {
+		l.Errorw("Failed to flush audit log", zap.Error(err))
+	}
+	if err := tp.Shutdown(flushCtx); err != nil {
+		l.Errorw("Failed to shutdown OpenTelemetry tracer", zap.Error(err))
+	}
+	if err := db.Close(); err != nil {
+		l.Errorw("Failed to close PostgreSQL connection", zap.Error(err))
+	}
+	l.Info("Shutdown complete")
 }
@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/monitoring"
+)
+
+const (
+	OutcomeAllow   = "allow"
+	OutcomeDeny    = "deny"
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+const (
+	batchSize     = 100
+	flushInterval = time.Second
+)
+
+// Event is a single entry of the audit trail.
+type Event struct {
+	Time     time.Time
+	ActorID  int
+	Actor    string
+	Action   string
+	Resource string
+	Outcome  string
+	ClientIP string
+	Details  map[string]interface{}
+}
+
+// Logger writes events to the audit_log table in the background so that
+// recording never blocks a request. Events are dropped, and counted, when
+// the buffer is full.
+type Logger struct {
+	db     *sql.DB
+	events chan Event
+	done   chan struct{}
+	l      *zap.SugaredLogger
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewLogger(db *sql.DB, bufferSize int, l *zap.SugaredLogger) *Logger {
+	a := &Logger{
+		db:     db,
+		events: make(chan Event, bufferSize),
+		done:   make(chan struct{}),
+		l:      l,
+	}
+	go a.run()
+	return a
+}
+
+func (a *Logger) Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.events <- e:
+	default:
+		monitoring.AuditEventsDropped.Inc()
+	}
+}
+
+// Close stops accepting events and waits for the buffered ones to be
+// written or for ctx to expire.
+func (a *Logger) Close(ctx context.Context) error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.events)
+	}
+	a.mu.Unlock()
+
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *Logger) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := storeEvents(context.Background(), a.db, batch); err != nil {
+			monitoring.AuditEventsDropped.Add(float64(len(batch)))
+			a.l.Errorw("Failed to write audit events", zap.Int("events", len(batch)), zap.Error(err))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case e, ok := <-a.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) == batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+func storeEvents(ctx context.Context, db *sql.DB, events []Event) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO audit_log (occurred_at, actor_id, actor, action, resource, outcome, client_ip, details)
+		VALUES ($1, NULLIF($2, 0), NULLIF($3, ''), $4, NULLIF($5, ''), $6, NULLIF($7, ''), $8)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range events {
+		var details []byte
+		if len(e.Details) > 0 {
+			if details, err = json.Marshal(e.Details); err != nil {
+				return err
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, e.Time, e.ActorID, e.Actor, e.Action, e.Resource, e.Outcome, e.ClientIP, details); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
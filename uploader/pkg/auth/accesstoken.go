@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"video-platform/uploader/pkg/storage"
+)
+
+// AccessTokenPrefix marks personal access tokens so they can be told apart
+// from JWTs and found by secret scanners.
+const AccessTokenPrefix = "vpat_"
+
+// How often the last used timestamp of a token is written at most, unless
+// it is used from a new IP
+const touchInterval = time.Minute
+
+var ErrAccessTokenInvalid = errors.New("access token is invalid, expired or revoked")
+
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, AccessTokenPrefix)
+}
+
+// NewAccessToken returns a personal access token, the hash that is stored
+// in its place and the prefix shown to identify it.
+func NewAccessToken() (token, hash, prefix string, err error) {
+	secret, err := randomID(32)
+	if err != nil {
+		return "", "", "", err
+	}
+	token = AccessTokenPrefix + secret
+	return token, HashToken(token), token[:len(AccessTokenPrefix)+6], nil
+}
+
+type accessTokenEntry struct {
+	token     *storage.AccessToken
+	until     time.Time
+	touchedAt time.Time
+	touchedIP string
+}
+
+// AccessTokens looks up personal access tokens. Like the Revoker, lookups
+// are cached for cacheTTL; revocations made through this instance take
+// effect immediately.
+type AccessTokens struct {
+	db       *sql.DB
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*accessTokenEntry
+}
+
+func NewAccessTokens(db *sql.DB, cacheTTL time.Duration) *AccessTokens {
+	return &AccessTokens{db: db, cacheTTL: cacheTTL, cache: make(map[string]*accessTokenEntry)}
+}
+
+// Lookup returns the token with its owner's roles if it is valid and the
+// owner is active, and records that it was used from clientIP.
+func (at *AccessTokens) Lookup(ctx context.Context, token, clientIP string) (*storage.AccessToken, error) {
+	hash := HashToken(token)
+	now := time.Now()
+
+	at.mu.Lock()
+	entry, ok := at.cache[hash]
+	at.mu.Unlock()
+	if !ok || now.After(entry.until) {
+		t, err := storage.GetAccessToken(ctx, at.db, hash)
+		if err == sql.ErrNoRows {
+			return nil, ErrAccessTokenInvalid
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t.UserRoles, err = storage.GetUserRoles(ctx, at.db, t.UserID); err != nil {
+			return nil, err
+		}
+		entry = &accessTokenEntry{token: t, until: now.Add(at.cacheTTL)}
+		if t.LastUsedAt != nil {
+			entry.touchedAt, entry.touchedIP = *t.LastUsedAt, t.LastUsedIP
+		}
+		at.mu.Lock()
+		at.evictExpired(now)
+		at.cache[hash] = entry
+		at.mu.Unlock()
+	}
+
+	t := entry.token
+	if t.RevokedAt != nil || now.After(t.ExpiresAt) || t.UserStatus != storage.UserActive {
+		return nil, ErrAccessTokenInvalid
+	}
+
+	at.mu.Lock()
+	touch := now.Sub(entry.touchedAt) > touchInterval || entry.touchedIP != clientIP
+	if touch {
+		entry.touchedAt, entry.touchedIP = now, clientIP
+	}
+	at.mu.Unlock()
+	if touch {
+		if err := storage.TouchAccessToken(ctx, at.db, t.ID, clientIP); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Revoke revokes a token of the user.
+func (at *AccessTokens) Revoke(ctx context.Context, userID, tokenID int) error {
+	if err := storage.RevokeAccessToken(ctx, at.db, userID, tokenID); err != nil {
+		return err
+	}
+	at.reset()
+	return nil
+}
+
+// reset drops cached lookups, so revoked tokens are rejected right away.
+func (at *AccessTokens) reset() {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.cache = make(map[string]*accessTokenEntry)
+}
+
+func (at *AccessTokens) evictExpired(now time.Time) {
+	for hash, entry := range at.cache {
+		if now.After(entry.until) {
+			delete(at.cache, hash)
+		}
+	}
+}
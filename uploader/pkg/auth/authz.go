@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Actions passed to the policy
+const (
+	ActionFileUpload         = "file.upload"
+	ActionFileList           = "file.list"
+	ActionFileDownload       = "file.download"
+	ActionFileDelete         = "file.delete"
+	ActionFileRestore        = "file.restore"
+	ActionFilePurge          = "file.purge"
+	ActionFileVersionList    = "file.version.list"
+	ActionFileVersionPromote = "file.version.promote"
+	ActionFileHoldRead       = "file.hold.read"
+	ActionFileHoldUpdate     = "file.hold.update"
+	ActionSessionsRevoke     = "user.sessions.revoke"
+	ActionUserRolesUpdate    = "user.roles.update"
+	ActionUserList           = "user.list"
+	ActionUserCreate         = "user.create"
+	ActionUserStatusUpdate   = "user.status.update"
+	ActionUserDelete         = "user.delete"
+	ActionUserPasswordReset  = "user.password.reset"
+	ActionInviteCreate       = "user.invite.create"
+	ActionUserMFAReset       = "user.mfa.reset"
+	ActionLoginLockRead      = "user.login.lock.read"
+	ActionLoginUnlock        = "user.login.unlock"
+	ActionQuotaRead          = "user.quota.read"
+	ActionQuotaUpdate        = "user.quota.update"
+	ActionUsageReport        = "usage.report.read"
+	ActionLifecycleRead      = "lifecycle.read"
+	ActionPolicyRead         = "policy.read"
+	ActionPolicyUpdate       = "policy.update"
+)
+
+// Subject is the caller. AuthMethod is "session" for JWTs, which are also
+// passed as the token, or "access_token" for personal access tokens.
+type Subject struct {
+	ID         int      `json:"id"`
+	Username   string   `json:"username"`
+	Roles      []string `json:"roles"`
+	AuthMethod string   `json:"auth_method"`
+	Scopes     []string `json:"scopes,omitempty"`
+}
+
+type RequestInfo struct {
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	ContentLength int64  `json:"content_length"`
+	ClientIP      string `json:"client_ip"`
+}
+
+// Resource describes the object an action is performed on. Scope is "own"
+// or "all" for actions on collections such as listing files.
+type Resource struct {
+	Type        string `json:"type"`
+	ID          int    `json:"id,omitempty"`
+	OwnerID     int    `json:"owner_id,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+type AuthzInput struct {
+	Subject  Subject     `json:"subject"`
+	Action   string      `json:"action"`
+	Request  RequestInfo `json:"request"`
+	Resource *Resource   `json:"resource,omitempty"`
+	Token    string      `json:"token,omitempty"`
+}
+
+// Obligations are conditions attached to an allow decision that the handler
+// must enforce.
+type Obligations struct {
+	MaxUploadBytes int64 `json:"max_upload_bytes,omitempty"`
+}
+
+type Decision struct {
+	Allow       bool        `json:"allow"`
+	Reasons     []string    `json:"reasons"`
+	Obligations Obligations `json:"obligations"`
+	// Revision of the policy bundle that made the decision, if known
+	Revision string `json:"revision,omitempty"`
+}
+
+// Authorizer evaluates data.authz.decision for an input. An error means no
+// decision could be made, not that the request was denied.
+type Authorizer interface {
+	Authorize(ctx context.Context, input AuthzInput) (*Decision, error)
+}
+
+// RemoteAuthorizer asks an OPA server for a decision.
+type RemoteAuthorizer struct {
+	url    string
+	client *http.Client
+	l      *zap.SugaredLogger
+}
+
+func NewRemoteAuthorizer(opaURL string, timeout time.Duration, l *zap.SugaredLogger) *RemoteAuthorizer {
+	return &RemoteAuthorizer{
+		url:    opaURL + "/v1/data/authz/decision",
+		client: &http.Client{Timeout: timeout},
+		l:      l,
+	}
+}
+
+func (a *RemoteAuthorizer) Authorize(ctx context.Context, input AuthzInput) (*Decision, error) {
+	inputData, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", a.url, bytes.NewBuffer(inputData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authorization failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Result *Decision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Result == nil {
+		return nil, fmt.Errorf("policy returned no decision")
+	}
+	a.l.Debugw("Authorization decision", zap.String("action", input.Action), zap.Any("decision", result.Result))
+	return result.Result, nil
+}
+
+// NewInput builds the policy input for an authenticated request.
+func NewInput(r *http.Request, action string, resource *Resource) AuthzInput {
+	input := AuthzInput{
+		Action: action,
+		Request: RequestInfo{
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			ContentLength: r.ContentLength,
+			ClientIP:      ClientIP(r),
+		},
+		Resource: resource,
+	}
+	if principal, ok := PrincipalFromContext(r.Context()); ok {
+		input.Subject = Subject{ID: principal.UserID, Username: principal.Username, Roles: principal.Roles, AuthMethod: "session"}
+		if principal.AccessTokenID != 0 {
+			input.Subject.AuthMethod = "access_token"
+			input.Subject.Scopes = principal.Scopes
+		}
+	}
+	if token, ok := tokenFromContext(r.Context()); ok {
+		input.Token = token
+	}
+	return input
+}
+
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Deny writes a 403 with the reasons given by the policy.
+func Deny(w http.ResponseWriter, decision *Decision) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": "Forbidden", "reasons": decision.Reasons})
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+)
+
+type contextKey int
+
+const (
+	claimsKey contextKey = iota
+	principalKey
+	tokenKey
+	decisionKey
+)
+
+func withClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFromContext returns the verified claims of the authenticated caller.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*Claims)
+	return claims, ok
+}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// PrincipalFromContext returns the authenticated caller set by Authenticate.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey).(*Principal)
+	return principal, ok
+}
+
+func withToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+func tokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(tokenKey).(string)
+	return token, ok
+}
+
+func withDecision(ctx context.Context, decision *Decision) context.Context {
+	return context.WithValue(ctx, decisionKey, decision)
+}
+
+// DecisionFromContext returns the route level policy decision, including
+// the obligations the handler has to enforce.
+func DecisionFromContext(ctx context.Context) (*Decision, bool) {
+	decision, ok := ctx.Value(decisionKey).(*Decision)
+	return decision, ok
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/monitoring"
+)
+
+const (
+	FailOpen   = "open"
+	FailClosed = "closed"
+)
+
+// ReasonFailedOpen is reported when a request was allowed only because the
+// policy could not be evaluated.
+const ReasonFailedOpen = "policy unavailable, failing open"
+
+type EnforcerOptions struct {
+	// How long a decision is reused for an identical input, 0 disables caching
+	CacheTTL time.Duration
+	// FailMode applies to actions not listed in FailOpenActions or
+	// FailClosedActions
+	FailMode          string
+	FailOpenActions   []string
+	FailClosedActions []string
+}
+
+type cachedDecision struct {
+	decision *Decision
+	until    time.Time
+}
+
+// Enforcer sits in front of an Authorizer. It caches decisions, decides what
+// happens when the policy cannot be evaluated and records every decision in
+// the audit trail.
+type Enforcer struct {
+	next     Authorizer
+	cacheTTL time.Duration
+	failOpen map[string]bool
+	open     bool
+	audit    *audit.Logger
+	l        *zap.SugaredLogger
+
+	mu    sync.Mutex
+	cache map[string]cachedDecision
+}
+
+func NewEnforcer(next Authorizer, opts EnforcerOptions, auditLog *audit.Logger, l *zap.SugaredLogger) *Enforcer {
+	failOpen := make(map[string]bool)
+	for _, action := range opts.FailOpenActions {
+		failOpen[action] = true
+	}
+	for _, action := range opts.FailClosedActions {
+		failOpen[action] = false
+	}
+	return &Enforcer{
+		next:     next,
+		cacheTTL: opts.CacheTTL,
+		failOpen: failOpen,
+		open:     opts.FailMode == FailOpen,
+		audit:    auditLog,
+		l:        l,
+		cache:    make(map[string]cachedDecision),
+	}
+}
+
+func (e *Enforcer) Authorize(ctx context.Context, input AuthzInput) (*Decision, error) {
+	key, err := cacheKey(input)
+	if err != nil {
+		return nil, err
+	}
+	if decision, ok := e.cached(key); ok {
+		e.record(input, decision, true)
+		return decision, nil
+	}
+
+	decision, err := e.next.Authorize(ctx, input)
+	if err != nil {
+		if !e.failsOpen(input.Action) {
+			monitoring.AuthzDecisions.WithLabelValues(input.Action, "error").Inc()
+			e.audit.Record(e.event(input, audit.OutcomeDeny, map[string]interface{}{"error": err.Error()}))
+			return nil, err
+		}
+		e.l.Warnw("Policy unavailable, failing open", zap.String("action", input.Action), zap.Error(err))
+		decision = &Decision{Allow: true, Reasons: []string{ReasonFailedOpen}}
+		e.record(input, decision, false)
+		return decision, nil
+	}
+
+	e.store(key, decision)
+	e.record(input, decision, false)
+	return decision, nil
+}
+
+// Reset drops all cached decisions, e.g. after the policy or its data
+// changed.
+func (e *Enforcer) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cache = make(map[string]cachedDecision)
+}
+
+func (e *Enforcer) failsOpen(action string) bool {
+	if open, ok := e.failOpen[action]; ok {
+		return open
+	}
+	return e.open
+}
+
+func (e *Enforcer) cached(key string) (*Decision, bool) {
+	if e.cacheTTL <= 0 {
+		return nil, false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	entry, ok := e.cache[key]
+	if !ok || time.Now().After(entry.until) {
+		return nil, false
+	}
+	return entry.decision, true
+}
+
+func (e *Enforcer) store(key string, decision *Decision) {
+	if e.cacheTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k, entry := range e.cache {
+		if now.After(entry.until) {
+			delete(e.cache, k)
+		}
+	}
+	e.cache[key] = cachedDecision{decision: decision, until: now.Add(e.cacheTTL)}
+}
+
+func (e *Enforcer) record(input AuthzInput, decision *Decision, cached bool) {
+	outcome := audit.OutcomeDeny
+	if decision.Allow {
+		outcome = audit.OutcomeAllow
+	}
+	monitoring.AuthzDecisions.WithLabelValues(input.Action, outcome).Inc()
+	e.l.Debugw("Authorization decision", zap.String("action", input.Action), zap.Any("decision", decision), zap.Bool("cached", cached))
+	e.audit.Record(e.event(input, outcome, map[string]interface{}{
+		"reasons":     decision.Reasons,
+		"obligations": decision.Obligations,
+		"revision":    decision.Revision,
+		"cached":      cached,
+		"request":     input.Request,
+	}))
+}
+
+func (e *Enforcer) event(input AuthzInput, outcome string, details map[string]interface{}) audit.Event {
+	return audit.Event{
+		ActorID:  input.Subject.ID,
+		Actor:    input.Subject.Username,
+		Action:   "authz." + input.Action,
+		Resource: resourceName(input.Resource),
+		Outcome:  outcome,
+		ClientIP: input.Request.ClientIP,
+		Details:  details,
+	}
+}
+
+func resourceName(r *Resource) string {
+	switch {
+	case r == nil:
+		return ""
+	case r.ID != 0:
+		return r.Type + "/" + strconv.Itoa(r.ID)
+	case r.Name != "":
+		return r.Type + "/" + r.Name
+	default:
+		return r.Type
+	}
+}
+
+// cacheKey identifies an input. The token is part of it, so a decision is
+// never shared between sessions.
+func cacheKey(input AuthzInput) (string, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.uber.org/zap"
+)
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+func (k *signingKey) public() crypto.PublicKey {
+	return k.private.Public()
+}
+
+// KeySet holds the private keys used to sign tokens, one file per key named
+// <kid>.pem (PKCS#8, RSA or ECDSA P-256). Ed25519 keys are rejected because
+// the policy engine cannot verify EdDSA signatures. Only the active key signs new tokens;
+// the others remain valid for verification, so a key can be rotated by adding
+// a new file, switching the active kid and removing the old file once the
+// tokens it signed have expired. Every replica must see the same directory.
+type KeySet struct {
+	mu     sync.RWMutex
+	dir    string
+	keys   map[string]*signingKey
+	active string
+	// Used while the directory has no keys, kept across reloads so the
+	// tokens it signed stay valid
+	generated *signingKey
+	l         *zap.SugaredLogger
+
+	onChange []func()
+}
+
+func LoadKeySet(dir, activeKid string, l *zap.SugaredLogger) (*KeySet, error) {
+	ks := &KeySet{dir: dir, l: l}
+	if dir == "" {
+		key, err := ks.generateKey()
+		if err != nil {
+			return nil, err
+		}
+		ks.generated = key
+	}
+	if err := ks.Reload(activeKid); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Reload re-reads the key directory and switches the active key. Without
+// keys in the directory the generated key stays in use.
+func (ks *KeySet) Reload(activeKid string) error {
+	keys := make(map[string]*signingKey)
+	if ks.dir != "" {
+		paths, err := filepath.Glob(filepath.Join(ks.dir, "*.pem"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			key, err := readKey(path)
+			if err != nil {
+				return fmt.Errorf("loading signing key %s: %w", path, err)
+			}
+			keys[key.kid] = key
+		}
+	}
+
+	if len(keys) == 0 {
+		if ks.generated == nil {
+			key, err := ks.generateKey()
+			if err != nil {
+				return err
+			}
+			ks.generated = key
+		}
+		keys[ks.generated.kid] = ks.generated
+		activeKid = ks.generated.kid
+	}
+
+	if activeKid == "" && len(keys) == 1 {
+		for kid := range keys {
+			activeKid = kid
+		}
+	}
+	if _, ok := keys[activeKid]; !ok {
+		return fmt.Errorf("active signing key %q not found", activeKid)
+	}
+
+	ks.mu.Lock()
+	if ks.active != "" && ks.active != activeKid {
+		ks.l.Infow("Rotated signing key", zap.String("previous", ks.active), zap.String("active", activeKid))
+	}
+	ks.keys = keys
+	ks.active = activeKid
+	ks.mu.Unlock()
+
+	for _, fn := range ks.onChange {
+		fn()
+	}
+	return nil
+}
+
+// OnChange registers fn to be called after the keys were reloaded.
+func (ks *KeySet) OnChange(fn func()) {
+	ks.onChange = append(ks.onChange, fn)
+}
+
+// generateKey creates an RSA key when no keys are configured. It is persisted
+// to the key directory if there is one, otherwise it only lives in memory and
+// every token becomes invalid on restart.
+func (ks *KeySet) generateKey() (*signingKey, error) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	kid := fmt.Sprintf("generated-%d", time.Now().Unix())
+	if ks.dir == "" {
+		ks.l.Warn("No JWT key directory configured, using an ephemeral signing key")
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, private: private}, nil
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(ks.dir, kid+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("writing generated signing key: %w", err)
+	}
+	ks.l.Warnw("No JWT signing keys found, generated a new one", zap.String("path", path))
+	return &signingKey{kid: kid, method: jwt.SigningMethodRS256, private: private}, nil
+}
+
+func readKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	kid := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, private: private}, nil
+	case *ecdsa.PrivateKey:
+		if private.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s, only P-256 is supported", private.Curve.Params().Name)
+		}
+		return &signingKey{kid: kid, method: jwt.SigningMethodES256, private: private}, nil
+	case ed25519.PrivateKey:
+		return nil, fmt.Errorf("Ed25519 keys are not supported, OPA cannot verify EdDSA tokens")
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+}
+
+func (ks *KeySet) signer() *signingKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[ks.active]
+}
+
+func (ks *KeySet) lookup(kid string) (*signingKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+func (ks *KeySet) all() []*signingKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	keys := make([]*signingKey, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
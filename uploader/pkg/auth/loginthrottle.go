@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"video-platform/uploader/pkg/storage"
+)
+
+// How often expired attempts are pruned at most
+const pruneInterval = time.Minute
+
+type LoginThrottleOptions struct {
+	// Failures of one account, or of one IP, after which it is locked
+	AccountMaxFailures int
+	IPMaxFailures      int
+	// The first lock lasts LockoutBase and every further failure doubles
+	// it, up to LockoutMax
+	LockoutBase time.Duration
+	LockoutMax  time.Duration
+	// Failures are forgotten after this long without one
+	FailureReset time.Duration
+}
+
+// LoginThrottle tracks failed sign-ins per account and per client IP in
+// Postgres, so that locks apply across replicas.
+type LoginThrottle struct {
+	db   *sql.DB
+	opts LoginThrottleOptions
+
+	mu       sync.Mutex
+	prunedAt time.Time
+}
+
+func NewLoginThrottle(db *sql.DB, opts LoginThrottleOptions) *LoginThrottle {
+	return &LoginThrottle{db: db, opts: opts}
+}
+
+// AccountKey identifies an existing account.
+func AccountKey(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+// LoginNameKey identifies a name that matches no account. Unknown names
+// are locked like accounts, so a lock does not reveal whether one exists.
+func LoginNameKey(name string) string {
+	return "login:" + strings.ToLower(name)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Locked returns how long the account or the IP is still locked, or 0.
+func (t *LoginThrottle) Locked(ctx context.Context, accountKey, ip string) (time.Duration, error) {
+	return storage.LoginLockRemaining(ctx, t.db, []string{accountKey, ipKey(ip)})
+}
+
+// Failure records a failed attempt and returns the lock it caused, if any.
+func (t *LoginThrottle) Failure(ctx context.Context, accountKey, ip string) (time.Duration, error) {
+	t.prune(ctx)
+	var locked time.Duration
+	for _, k := range []struct {
+		key         string
+		maxFailures int
+	}{{accountKey, t.opts.AccountMaxFailures}, {ipKey(ip), t.opts.IPMaxFailures}} {
+		failures, err := storage.RecordLoginFailure(ctx, t.db, k.key, t.opts.FailureReset)
+		if err != nil {
+			return 0, err
+		}
+		d := t.lockout(failures, k.maxFailures)
+		if d == 0 {
+			continue
+		}
+		if err := storage.LockLogin(ctx, t.db, k.key, d); err != nil {
+			return 0, err
+		}
+		locked = max(locked, d)
+	}
+	return locked, nil
+}
+
+// Success forgets the failures of the account. Those of the IP are kept,
+// so signing in to one account does not reset guessing at others.
+func (t *LoginThrottle) Success(ctx context.Context, accountKey string) error {
+	if err := storage.ClearLoginFailures(ctx, t.db, accountKey); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// Unlock removes the lock and failures of a key. It returns sql.ErrNoRows
+// if there were none.
+func (t *LoginThrottle) Unlock(ctx context.Context, key string) error {
+	return storage.ClearLoginFailures(ctx, t.db, key)
+}
+
+func (t *LoginThrottle) lockout(failures, maxFailures int) time.Duration {
+	if failures < maxFailures {
+		return 0
+	}
+	d := t.opts.LockoutBase
+	for i := maxFailures; i < failures && d < t.opts.LockoutMax; i++ {
+		d *= 2
+	}
+	return min(d, t.opts.LockoutMax)
+}
+
+func (t *LoginThrottle) prune(ctx context.Context) {
+	t.mu.Lock()
+	due := time.Since(t.prunedAt) > pruneInterval
+	if due {
+		t.prunedAt = time.Now()
+	}
+	t.mu.Unlock()
+	if due {
+		// Stale rows only cost space, so a failure here is not fatal
+		_ = storage.PruneLoginAttempts(ctx, t.db, t.opts.FailureReset)
+	}
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	throttle := NewLoginThrottle(nil, LoginThrottleOptions{LockoutBase: time.Minute, LockoutMax: 15 * time.Minute})
+	tests := []struct {
+		name        string
+		failures    int
+		maxFailures int
+		want        time.Duration
+	}{
+		{name: "no failures", failures: 0, maxFailures: 5, want: 0},
+		{name: "below the limit", failures: 4, maxFailures: 5, want: 0},
+		{name: "at the limit", failures: 5, maxFailures: 5, want: time.Minute},
+		{name: "one more", failures: 6, maxFailures: 5, want: 2 * time.Minute},
+		{name: "doubling", failures: 8, maxFailures: 5, want: 8 * time.Minute},
+		{name: "capped", failures: 9, maxFailures: 5, want: 15 * time.Minute},
+		{name: "far beyond the cap", failures: 1000, maxFailures: 5, want: 15 * time.Minute},
+		{name: "single failure allowed", failures: 1, maxFailures: 1, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := throttle.lockout(tt.failures, tt.maxFailures); got != tt.want {
+				t.Errorf("lockout(%d, %d) = %v, want %v", tt.failures, tt.maxFailures, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLockoutBaseAboveMax(t *testing.T) {
+	throttle := NewLoginThrottle(nil, LoginThrottleOptions{LockoutBase: time.Hour, LockoutMax: time.Minute})
+	if got := throttle.lockout(3, 3); got != time.Minute {
+		t.Errorf("lockout() = %v, want the maximum of %v", got, time.Minute)
+	}
+}
+
+func TestThrottleKeys(t *testing.T) {
+	// Unknown names are keyed case-insensitively like usernames, and never
+	// collide with accounts or IPs
+	if LoginNameKey("Alice") != LoginNameKey("alice") {
+		t.Error("LoginNameKey() depends on case")
+	}
+	keys := map[string]bool{AccountKey(1): true, LoginNameKey("1"): true, ipKey("1"): true}
+	if len(keys) != 3 {
+		t.Errorf("keys of different kinds collide: %v", keys)
+	}
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"video-platform/uploader/pkg/storage"
+)
+
+const (
+	recoveryCodeCount = 10
+	// Wrong codes allowed per login challenge
+	mfaChallengeAttempts = 5
+	sealedPrefix         = "v1:"
+)
+
+var (
+	ErrMFACodeInvalid      = errors.New("verification code is invalid")
+	ErrMFAChallengeInvalid = errors.New("mfa challenge is invalid or expired")
+	ErrMFANotEnrolled      = errors.New("mfa is not enrolled")
+	ErrMFAAlreadyEnabled   = errors.New("mfa is already enabled")
+)
+
+// MFA manages TOTP second factors. Secrets are encrypted with AES-GCM when a
+// key is configured.
+type MFA struct {
+	db            *sql.DB
+	issuer        string
+	requiredRoles map[string]bool
+	challengeTTL  time.Duration
+	aead          cipher.AEAD
+}
+
+func NewMFA(db *sql.DB, issuer string, requiredRoles []string, challengeTTL time.Duration, secretKey string) (*MFA, error) {
+	m := &MFA{db: db, issuer: issuer, requiredRoles: make(map[string]bool), challengeTTL: challengeTTL}
+	for _, role := range requiredRoles {
+		m.requiredRoles[role] = true
+	}
+	if secretKey != "" {
+		key := sha256.Sum256([]byte(secretKey))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		if m.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *MFA) ChallengeTTL() time.Duration {
+	return m.challengeTTL
+}
+
+// Required reports whether any of the roles has to use a second factor.
+func (m *MFA) Required(roles []string) bool {
+	for _, role := range roles {
+		if m.requiredRoles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MFA) Enabled(ctx context.Context, userID int) (bool, error) {
+	enrollment, err := storage.GetMFA(ctx, m.db, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return enrollment.Enabled, nil
+}
+
+// StartEnrollment creates a new secret for the user and returns it with its
+// provisioning URI. It must be confirmed with a code before it is used.
+func (m *MFA) StartEnrollment(ctx context.Context, userID int, account string) (secret, uri string, err error) {
+	secret, err = NewTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := m.seal(secret)
+	if err != nil {
+		return "", "", err
+	}
+	err = storage.StartMFAEnrollment(ctx, m.db, userID, sealed)
+	if err == sql.ErrNoRows {
+		return "", "", ErrMFAAlreadyEnabled
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return secret, TOTPURI(m.issuer, account, secret), nil
+}
+
+// Confirm enables a pending enrollment once the user proves it works and
+// returns their recovery codes.
+func (m *MFA) Confirm(ctx context.Context, userID int, code string) ([]string, error) {
+	enrollment, err := storage.GetMFA(ctx, m.db, userID)
+	if err == sql.ErrNoRows {
+		return nil, ErrMFANotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enrollment.Enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if err := m.checkCode(ctx, userID, enrollment, code); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.EnableMFA(ctx, m.db, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify checks a TOTP code or, failing that, a recovery code of a user
+// with an enabled enrollment.
+func (m *MFA) Verify(ctx context.Context, userID int, code string) error {
+	enrollment, err := storage.GetMFA(ctx, m.db, userID)
+	if err == sql.ErrNoRows || (err == nil && !enrollment.Enabled) {
+		return ErrMFANotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	err = m.checkCode(ctx, userID, enrollment, code)
+	if err != ErrMFACodeInvalid {
+		return err
+	}
+	used, err := storage.UseRecoveryCode(ctx, m.db, userID, HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrMFACodeInvalid
+	}
+	return nil
+}
+
+func (m *MFA) RegenerateRecoveryCodes(ctx context.Context, userID int) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.ReplaceRecoveryCodes(ctx, m.db, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (m *MFA) Disable(ctx context.Context, userID int) error {
+	err := storage.DisableMFA(ctx, m.db, userID)
+	if err == sql.ErrNoRows {
+		return ErrMFANotEnrolled
+	}
+	return err
+}
+
+// NewChallenge returns a short-lived token that stands for a correct
+// password until the second factor is checked.
+func (m *MFA) NewChallenge(ctx context.Context, userID int) (string, error) {
+	token, hash, err := NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	if err := storage.StoreMFAChallenge(ctx, m.db, hash, userID, time.Now().Add(m.challengeTTL)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ChallengeUser returns the user a challenge was issued for.
+func (m *MFA) ChallengeUser(ctx context.Context, token string) (int, error) {
+	userID, err := storage.GetMFAChallenge(ctx, m.db, HashToken(token), mfaChallengeAttempts)
+	if err == sql.ErrNoRows {
+		return 0, ErrMFAChallengeInvalid
+	}
+	return userID, err
+}
+
+// FailChallenge counts a wrong code against the challenge.
+func (m *MFA) FailChallenge(ctx context.Context, token string) error {
+	return storage.FailMFAChallenge(ctx, m.db, HashToken(token))
+}
+
+// CompleteChallenge makes the challenge unusable.
+func (m *MFA) CompleteChallenge(ctx context.Context, token string) error {
+	return storage.DeleteMFAChallenge(ctx, m.db, HashToken(token))
+}
+
+func (m *MFA) checkCode(ctx context.Context, userID int, enrollment *storage.MFA, code string) error {
+	secret, err := m.open(enrollment.Secret)
+	if err != nil {
+		return err
+	}
+	counter, ok := ValidateTOTP(secret, strings.TrimSpace(code), time.Now(), enrollment.LastCounter)
+	if !ok {
+		return ErrMFACodeInvalid
+	}
+	// Another request may have used the same code in the meantime
+	fresh, err := storage.UseMFACounter(ctx, m.db, userID, counter)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrMFACodeInvalid
+	}
+	return nil
+}
+
+func (m *MFA) seal(secret string) (string, error) {
+	if m.aead == nil {
+		return secret, nil
+	}
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := m.aead.Seal(nonce, nonce, []byte(secret), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (m *MFA) open(stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	if m.aead == nil {
+		return "", errors.New("mfa secret is encrypted but MFA_SECRET_KEY is not set")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < m.aead.NonceSize() {
+		return "", errors.New("mfa secret is corrupt")
+	}
+	nonce, ciphertext := sealed[:m.aead.NonceSize()], sealed[m.aead.NonceSize():]
+	secret, err := m.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// newRecoveryCodes returns codes formatted as xxxxx-xxxxx and their hashes.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+		hashes = append(hashes, HashToken(raw))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
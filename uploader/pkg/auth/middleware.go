@@ -1,13 +1,44 @@
 package auth
 
 import (
-	"context"
-	"github.com/dgrijalva/jwt-go"
+	"errors"
 	"go.uber.org/zap"
 	"net/http"
+	"strings"
 )
 
-func Authenticate(next http.Handler, l *zap.SugaredLogger) http.Handler {
+type Authenticator struct {
+	tokens       *TokenService
+	accessTokens *AccessTokens
+	revoker      *Revoker
+	roles        *RolePermissions
+	authorizer   Authorizer
+	after        []func(http.Handler) http.Handler
+	l            *zap.SugaredLogger
+}
+
+func NewAuthenticator(tokens *TokenService, accessTokens *AccessTokens, revoker *Revoker, roles *RolePermissions, authorizer Authorizer, l *zap.SugaredLogger) *Authenticator {
+	return &Authenticator{tokens: tokens, accessTokens: accessTokens, revoker: revoker, roles: roles, authorizer: authorizer, l: l}
+}
+
+// Use adds middleware that runs right after authentication, with the
+// principal set, on every handler wrapped afterwards.
+func (a *Authenticator) Use(mw ...func(http.Handler) http.Handler) {
+	a.after = append(a.after, mw...)
+}
+
+// Protect authenticates the request, requires the caller to hold perm and
+// asks the policy whether action is allowed. Handlers acting on a specific
+// resource authorize it again once the resource is known.
+func (a *Authenticator) Protect(perm Permission, action string, next http.Handler) http.Handler {
+	return a.Authenticate(Require(perm, a.authorize(action, next)))
+}
+
+func (a *Authenticator) Authenticate(next http.Handler) http.Handler {
+	l := a.l
+	for i := len(a.after) - 1; i >= 0; i-- {
+		next = a.after[i](next)
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -16,33 +47,126 @@ func Authenticate(next http.Handler, l *zap.SugaredLogger) http.Handler {
 			return
 		}
 
-		tokenStr := authHeader[len("Bearer "):]
+		tokenStr, ok := strings.CutPrefix(authHeader, "Bearer ")
+		if !ok {
+			l.Info("auth header is not a bearer token")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if IsAccessToken(tokenStr) {
+			a.authenticateAccessToken(w, r, tokenStr, next)
+			return
+		}
 
 		// Parse and validate the token
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtSecret), nil
-		})
-		if err != nil || !token.Valid {
+		claims, err := a.tokens.Parse(tokenStr)
+		if err != nil {
+			l.Infof("rejected token: %v", err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		// Check the token against the OPA policy
-		_, err = checkOPAPolicy(tokenStr, l)
+		// Reject logged out and revoked sessions
+		revoked, err := a.revoker.IsRevoked(r.Context(), claims)
 		if err != nil {
-			l.Errorf("error checking opa policy: %v", err)
+			l.Errorf("error checking token revocation: %v", err)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if revoked {
+			l.Infof("rejected revoked token %s", claims.Id)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), "username", claims.Username)
-		if claims.Username == "admin" {
-			ctx = context.WithValue(ctx, "admin", true)
-		} else {
-			ctx = context.WithValue(ctx, "admin", false)
+		permissions, err := a.roles.Resolve(r.Context(), claims.Roles)
+		if err != nil {
+			l.Errorf("error resolving role permissions: %v", err)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
 		}
-		ctx = context.WithValue(ctx, "id", claims.ID)
+
+		ctx := withClaims(r.Context(), claims)
+		ctx = withToken(ctx, tokenStr)
+		ctx = WithPrincipal(ctx, &Principal{
+			UserID:      claims.ID,
+			Username:    claims.Username,
+			Roles:       claims.Roles,
+			Permissions: permissions,
+		})
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// authenticateAccessToken sets the principal for a personal access token.
+// Its permissions are those of the owner's current roles that are also in
+// the token's scopes.
+func (a *Authenticator) authenticateAccessToken(w http.ResponseWriter, r *http.Request, tokenStr string, next http.Handler) {
+	l := a.l
+	token, err := a.accessTokens.Lookup(r.Context(), tokenStr, ClientIP(r))
+	if errors.Is(err, ErrAccessTokenInvalid) {
+		l.Info("rejected access token")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		l.Errorf("error looking up access token: %v", err)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	granted, err := a.roles.Resolve(r.Context(), token.UserRoles)
+	if err != nil {
+		l.Errorf("error resolving role permissions: %v", err)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	permissions := make(map[Permission]bool)
+	for _, scope := range token.Scopes {
+		if granted[Permission(scope)] {
+			permissions[Permission(scope)] = true
+		}
+	}
+
+	ctx := WithPrincipal(r.Context(), &Principal{
+		UserID:        token.UserID,
+		Username:      token.Username,
+		Roles:         token.UserRoles,
+		Permissions:   permissions,
+		AccessTokenID: token.ID,
+		Scopes:        token.Scopes,
+	})
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// SessionOnly rejects callers using a personal access token, e.g. for
+// managing the account itself. It must be wrapped by Authenticate.
+func SessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principal, ok := PrincipalFromContext(r.Context()); !ok || principal.AccessTokenID != 0 {
+			http.Error(w, "This endpoint requires a signed in session", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Authenticator) authorize(action string, next http.Handler) http.Handler {
+	l := a.l
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Check the request against the OPA policy
+		decision, err := a.authorizer.Authorize(r.Context(), NewInput(r, action, nil))
+		if err != nil {
+			l.Errorf("error checking policy: %v", err)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !decision.Allow {
+			l.Infow("Request denied by policy", zap.String("action", action), zap.Strings("reasons", decision.Reasons))
+			Deny(w, decision)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withDecision(r.Context(), decision)))
+	})
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var ErrPasswordMismatch = errors.New("password does not match")
+
+type PasswordPolicy struct {
+	// MinLength is counted in characters, MaxLength in bytes
+	MinLength int
+	MaxLength int
+	// File of breached passwords, one per line, either in plain text or as
+	// SHA-1 hex digests optionally followed by ":<count>" like the Pwned
+	// Passwords downloads. It is held in memory, so use a curated subset.
+	BreachedList string
+}
+
+// Passwords hashes new passwords with the configured hasher and checks
+// existing ones with whichever algorithm made them, so hashes can be
+// upgraded as users sign in.
+type Passwords struct {
+	hasher    PasswordHasher
+	known     []PasswordHasher
+	policy    PasswordPolicy
+	breached  map[[sha1.Size]byte]struct{}
+	dummyHash func() string
+}
+
+func NewPasswords(hasher PasswordHasher, policy PasswordPolicy) (*Passwords, error) {
+	p := &Passwords{
+		hasher: hasher,
+		// Parameters of existing hashes are read from the hash itself
+		known:  []PasswordHasher{hasher, BcryptHasher{}, Argon2idHasher{}},
+		policy: policy,
+	}
+	// Compared against when there is no such user, so that the answer
+	// takes as long as for a wrong password
+	p.dummyHash = sync.OnceValue(func() string {
+		hash, _ := hasher.Hash("not a real password")
+		return hash
+	})
+	if policy.BreachedList != "" {
+		breached, err := loadBreachedList(policy.BreachedList)
+		if err != nil {
+			return nil, fmt.Errorf("loading breached password list: %w", err)
+		}
+		p.breached = breached
+	}
+	return p, nil
+}
+
+// BreachedCount returns the number of entries in the breached list.
+func (p *Passwords) BreachedCount() int {
+	return len(p.breached)
+}
+
+func (p *Passwords) Hash(password string) (string, error) {
+	return p.hasher.Hash(password)
+}
+
+// Check compares a password with its stored hash. If they match, rehash
+// reports whether the hash should be replaced with a new one.
+func (p *Passwords) Check(hash, password string) (rehash bool, err error) {
+	for _, h := range p.known {
+		if !h.Handles(hash) {
+			continue
+		}
+		ok, err := h.Verify(hash, password)
+		if err != nil || !ok {
+			return false, ErrPasswordMismatch
+		}
+		return !p.hasher.Handles(hash) || p.hasher.Outdated(hash), nil
+	}
+	return false, ErrPasswordMismatch
+}
+
+// CheckNone does the work of Check without a hash to check. It always
+// fails.
+func (p *Passwords) CheckNone(password string) error {
+	p.Check(p.dummyHash(), password)
+	return ErrPasswordMismatch
+}
+
+// Validate returns an error that can be shown to the user if the password
+// does not meet the policy.
+func (p *Passwords) Validate(password string) error {
+	if utf8.RuneCountInString(password) < p.policy.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.policy.MinLength)
+	}
+	if len(password) > p.policy.MaxLength {
+		return fmt.Errorf("password must be at most %d bytes long", p.policy.MaxLength)
+	}
+	if _, ok := p.breached[sha1.Sum([]byte(password))]; ok {
+		return errors.New("password appears in a list of breached passwords, choose another one")
+	}
+	return nil
+}
+
+// NewPassword returns a random password, e.g. for an admin reset.
+func NewPassword() (string, error) {
+	return randomID(18)
+}
+
+func loadBreachedList(path string) (map[[sha1.Size]byte]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	breached := make(map[[sha1.Size]byte]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest, _, _ := strings.Cut(line, ":")
+		var sum [sha1.Size]byte
+		if len(digest) == 2*sha1.Size {
+			if _, err := hex.Decode(sum[:], []byte(digest)); err == nil {
+				breached[sum] = struct{}{}
+				continue
+			}
+		}
+		breached[sha1.Sum([]byte(line))] = struct{}{}
+	}
+	return breached, scanner.Err()
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters, the tests only compare them
+var (
+	testArgon2 = Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1}
+	testBcrypt = BcryptHasher{Cost: bcrypt.MinCost}
+)
+
+func mustHash(t *testing.T, h PasswordHasher, password string) string {
+	t.Helper()
+	hash, err := h.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestOutdated(t *testing.T) {
+	argon2Hash := mustHash(t, testArgon2, "secret")
+	bcryptHash := mustHash(t, testBcrypt, "secret")
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		hash   string
+		want   bool
+	}{
+		{name: "argon2id same parameters", hasher: testArgon2, hash: argon2Hash, want: false},
+		{name: "argon2id more memory", hasher: Argon2idHasher{Memory: 128, Iterations: 1, Parallelism: 1}, hash: argon2Hash, want: true},
+		{name: "argon2id more iterations", hasher: Argon2idHasher{Memory: 64, Iterations: 2, Parallelism: 1}, hash: argon2Hash, want: true},
+		{name: "argon2id more parallelism", hasher: Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 2}, hash: argon2Hash, want: true},
+		{name: "argon2id shorter key", hasher: testArgon2, hash: argon2Hash[:strings.LastIndex(argon2Hash, "$")+1] + "AAAA", want: true},
+		{name: "argon2id malformed", hasher: testArgon2, hash: "$argon2id$v=19$m=64", want: true},
+		{name: "bcrypt same cost", hasher: testBcrypt, hash: bcryptHash, want: false},
+		{name: "bcrypt higher cost", hasher: BcryptHasher{Cost: bcrypt.MinCost + 1}, hash: bcryptHash, want: true},
+		{name: "bcrypt malformed", hasher: testBcrypt, hash: "$2a$", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.Outdated(tt.hash); got != tt.want {
+				t.Errorf("Outdated() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordsCheck(t *testing.T) {
+	argon2Hash := mustHash(t, testArgon2, "secret")
+	oldArgon2Hash := mustHash(t, Argon2idHasher{Memory: 32, Iterations: 1, Parallelism: 1}, "secret")
+	bcryptHash := mustHash(t, testBcrypt, "secret")
+	tests := []struct {
+		name       string
+		hasher     PasswordHasher
+		hash       string
+		password   string
+		wantRehash bool
+		wantErr    error
+	}{
+		{name: "argon2id current", hasher: testArgon2, hash: argon2Hash, password: "secret"},
+		{name: "argon2id old parameters", hasher: testArgon2, hash: oldArgon2Hash, password: "secret", wantRehash: true},
+		{name: "bcrypt to argon2id", hasher: testArgon2, hash: bcryptHash, password: "secret", wantRehash: true},
+		{name: "bcrypt current", hasher: testBcrypt, hash: bcryptHash, password: "secret"},
+		{name: "argon2id to bcrypt", hasher: testBcrypt, hash: argon2Hash, password: "secret", wantRehash: true},
+		{name: "wrong password", hasher: testArgon2, hash: argon2Hash, password: "Secret", wantErr: ErrPasswordMismatch},
+		{name: "wrong old password", hasher: testArgon2, hash: bcryptHash, password: "Secret", wantErr: ErrPasswordMismatch},
+		{name: "unknown algorithm", hasher: testArgon2, hash: "$1$salt$hash", password: "secret", wantErr: ErrPasswordMismatch},
+		{name: "empty hash", hasher: testArgon2, hash: "", password: "", wantErr: ErrPasswordMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPasswords(tt.hasher, PasswordPolicy{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rehash, err := p.Check(tt.hash, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Check() error = %v, want %v", err, tt.wantErr)
+			}
+			if rehash != tt.wantRehash {
+				t.Errorf("Check() rehash = %v, want %v", rehash, tt.wantRehash)
+			}
+		})
+	}
+}
+
+// countingHasher counts the hashes it verifies.
+type countingHasher struct {
+	PasswordHasher
+	verified *int
+}
+
+func (h countingHasher) Verify(hash, password string) (bool, error) {
+	*h.verified++
+	return h.PasswordHasher.Verify(hash, password)
+}
+
+func TestCheckNoneVerifiesLikeCheck(t *testing.T) {
+	// Logins of unknown users must cost as much as wrong passwords, so
+	// they cannot be told apart by timing
+	var verified int
+	hasher := countingHasher{PasswordHasher: testArgon2, verified: &verified}
+	p, err := NewPasswords(hasher, PasswordPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Check(mustHash(t, testArgon2, "secret"), "wrong"); !errors.Is(err, ErrPasswordMismatch) {
+		t.Fatalf("Check() error = %v, want %v", err, ErrPasswordMismatch)
+	}
+	if verified != 1 {
+		t.Fatalf("Check() verified %d hashes, want 1", verified)
+	}
+	verified = 0
+	if err := p.CheckNone("secret"); !errors.Is(err, ErrPasswordMismatch) {
+		t.Fatalf("CheckNone() error = %v, want %v", err, ErrPasswordMismatch)
+	}
+	if verified != 1 {
+		t.Errorf("CheckNone() verified %d hashes, want 1 like Check", verified)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "breached.txt")
+	sum := sha1.Sum([]byte("hunter2hunter2"))
+	content := "# comment\npassword123\n" + strings.ToUpper(hex.EncodeToString(sum[:])) + ":42\n"
+	if err := os.WriteFile(list, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPasswords(testArgon2, PasswordPolicy{MinLength: 8, MaxLength: 16, BreachedList: list})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.BreachedCount(); got != 2 {
+		t.Errorf("BreachedCount() = %d, want 2", got)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{name: "valid", password: "correct horse"},
+		{name: "too short", password: "short", wantErr: true},
+		{name: "multibyte counted in characters", password: "ääääääää"},
+		{name: "multibyte too long in bytes", password: "ääääääääää", wantErr: true},
+		{name: "breached in plain text", password: "password123", wantErr: true},
+		{name: "breached as digest", password: "hunter2hunter2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.Validate(tt.password); (err != nil) != tt.wantErr {
+				t.Errorf("Validate(%q) error = %v, want error %v", tt.password, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"video-platform/uploader/pkg/storage"
+)
+
+type Permission string
+
+const (
+	PermFilesRead      Permission = "files:read"
+	PermFilesWrite     Permission = "files:write"
+	PermFilesReadAny   Permission = "files:read:any"
+	PermFilesDeleteAny Permission = "files:delete:any"
+	PermFilesHold      Permission = "files:hold"
+	PermSessionsManage Permission = "sessions:manage"
+	PermUsersManage    Permission = "users:manage"
+	PermPolicyManage   Permission = "policy:manage"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID      int
+	Username    string
+	Roles       []string
+	Permissions map[Permission]bool
+	// Set when the caller authenticated with a personal access token, whose
+	// scopes limit Permissions
+	AccessTokenID int
+	Scopes        []string
+}
+
+func (p *Principal) Can(perm Permission) bool {
+	return p.Permissions[perm]
+}
+
+// RolePermissions caches the role to permission mapping from Postgres and
+// reloads it once it is older than ttl.
+type RolePermissions struct {
+	db  *sql.DB
+	ttl time.Duration
+
+	mu       sync.Mutex
+	perms    map[string][]string
+	loadedAt time.Time
+}
+
+func NewRolePermissions(db *sql.DB, ttl time.Duration) *RolePermissions {
+	return &RolePermissions{db: db, ttl: ttl}
+}
+
+// Resolve returns the union of the permissions granted by roles.
+func (rp *RolePermissions) Resolve(ctx context.Context, roles []string) (map[Permission]bool, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if rp.perms == nil || time.Since(rp.loadedAt) > rp.ttl {
+		perms, err := storage.GetRolePermissions(ctx, rp.db)
+		if err != nil {
+			return nil, err
+		}
+		rp.perms = perms
+		rp.loadedAt = time.Now()
+	}
+
+	granted := make(map[Permission]bool)
+	for _, role := range roles {
+		for _, perm := range rp.perms[role] {
+			granted[Permission(perm)] = true
+		}
+	}
+	return granted, nil
+}
+
+// Can reports whether the caller of the request holds perm.
+func Can(ctx context.Context, perm Permission) bool {
+	principal, ok := PrincipalFromContext(ctx)
+	return ok && principal.Can(perm)
+}
+
+// Require rejects requests whose caller does not hold perm. It must be
+// wrapped by Authenticate.
+func Require(perm Permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Can(r.Context(), perm) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
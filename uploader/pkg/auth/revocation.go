@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"video-platform/uploader/pkg/storage"
+)
+
+type revocationEntry struct {
+	revoked bool
+	until   time.Time
+}
+
+// Revoker checks access tokens against the denylist in Postgres. Answers are
+// cached per jti for cacheTTL, which bounds how long a token revoked on
+// another replica can still be used; revocations made through this Revoker
+// take effect immediately.
+type Revoker struct {
+	db           *sql.DB
+	accessTokens *AccessTokens
+	cacheTTL     time.Duration
+
+	mu    sync.Mutex
+	cache map[string]revocationEntry
+}
+
+func NewRevoker(db *sql.DB, accessTokens *AccessTokens, cacheTTL time.Duration) *Revoker {
+	return &Revoker{db: db, accessTokens: accessTokens, cacheTTL: cacheTTL, cache: make(map[string]revocationEntry)}
+}
+
+func (rv *Revoker) IsRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	now := time.Now()
+	rv.mu.Lock()
+	entry, ok := rv.cache[claims.Id]
+	rv.mu.Unlock()
+	if ok && now.Before(entry.until) {
+		return entry.revoked, nil
+	}
+
+	ids := []string{claims.Id}
+	if claims.SessionID != "" {
+		ids = append(ids, claims.SessionID)
+	}
+	revoked, err := storage.IsTokenRevoked(ctx, rv.db, ids, claims.ID, time.Unix(claims.IssuedAt, 0))
+	if err != nil {
+		return false, err
+	}
+
+	entry = revocationEntry{revoked: revoked, until: now.Add(rv.cacheTTL)}
+	if revoked {
+		// Revocation is permanent, keep it until the token expires
+		entry.until = time.Unix(claims.ExpiresAt, 0)
+	}
+	rv.mu.Lock()
+	rv.evictExpired(now)
+	rv.cache[claims.Id] = entry
+	rv.mu.Unlock()
+	return revoked, nil
+}
+
+// Revoke denies the token or session id until expiresAt.
+func (rv *Revoker) Revoke(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	if err := storage.StoreRevokedToken(ctx, rv.db, tokenID, expiresAt); err != nil {
+		return err
+	}
+	rv.reset()
+	return nil
+}
+
+// RevokeUser revokes every session and personal access token of the user.
+func (rv *Revoker) RevokeUser(ctx context.Context, userID int) error {
+	if err := storage.RevokeUserSessions(ctx, rv.db, userID); err != nil {
+		return err
+	}
+	rv.reset()
+	rv.accessTokens.reset()
+	return nil
+}
+
+// reset drops cached answers, as a new revocation may cover tokens that were
+// cached as valid under a different jti.
+func (rv *Revoker) reset() {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.cache = make(map[string]revocationEntry)
+}
+
+func (rv *Revoker) evictExpired(now time.Time) {
+	for id, entry := range rv.cache {
+		if now.After(entry.until) {
+			delete(rv.cache, id)
+		}
+	}
+}
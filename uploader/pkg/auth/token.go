@@ -1,34 +1,111 @@
 package auth
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
-const (
-	jwtSecret = "supersecretkey"
-)
-
 type Claims struct {
-	Username string `json:"username"`
-	ID       int    `json:"id"`
+	Username  string   `json:"username"`
+	ID        int      `json:"id"`
+	Roles     []string `json:"roles"`
+	SessionID string   `json:"sid,omitempty"`
 	jwt.StandardClaims
 }
 
-func GenerateJWT(username string, id int) (string, error) {
-	expirationTime := time.Now().Add(1 * time.Hour)
+type TokenService struct {
+	keys       *KeySet
+	issuer     string
+	audience   string
+	ttl        time.Duration
+	refreshTTL time.Duration
+	parser     *jwt.Parser
+}
+
+func NewTokenService(keys *KeySet, issuer, audience string, ttl, refreshTTL time.Duration) *TokenService {
+	return &TokenService{
+		keys:       keys,
+		issuer:     issuer,
+		audience:   audience,
+		ttl:        ttl,
+		refreshTTL: refreshTTL,
+		parser: &jwt.Parser{
+			ValidMethods: []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()},
+		},
+	}
+}
+
+func (t *TokenService) TTL() time.Duration {
+	return t.ttl
+}
+
+func (t *TokenService) RefreshTTL() time.Duration {
+	return t.refreshTTL
+}
+
+// GenerateJWT issues an access token. sessionID ties it to the refresh token
+// family it was issued from, so revoking the session revokes the token too.
+func (t *TokenService) GenerateJWT(username string, id int, roles []string, sessionID string) (string, error) {
+	jti, err := randomID(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
 	claims := &Claims{
-		Username: username,
-		ID:       id,
+		Username:  username,
+		ID:        id,
+		Roles:     roles,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			Id:        jti,
+			Issuer:    t.issuer,
+			Audience:  t.audience,
+			Subject:   fmt.Sprint(id),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(t.ttl).Unix(),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+
+	key := t.keys.signer()
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	tokenString, err := token.SignedString(key.private)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
+
+// Parse verifies the signature with the key named by the token's kid header
+// and checks exp, nbf, iat, iss and aud.
+func (t *TokenService) Parse(tokenStr string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := t.parser.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := t.keys.lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+		}
+		return key.public(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if !claims.VerifyIssuer(t.issuer, true) {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if !claims.VerifyAudience(t.audience, true) {
+		return nil, fmt.Errorf("unexpected audience %q", claims.Audience)
+	}
+	return claims, nil
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 secret of the RFC 6238 test vectors, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+	key, err := totpEncoding.DecodeString(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, uint64(tt.unix/totpPeriod)); got != tt.want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	code := func(counter int64) string {
+		return totpCode(key, uint64(counter))
+	}
+
+	tests := []struct {
+		name        string
+		secret      string
+		code        string
+		lastCounter int64
+		want        int64
+		wantOK      bool
+	}{
+		{name: "current step", secret: rfcSecret, code: code(current), want: current, wantOK: true},
+		{name: "previous step", secret: rfcSecret, code: code(current - 1), want: current - 1, wantOK: true},
+		{name: "next step", secret: rfcSecret, code: code(current + 1), want: current + 1, wantOK: true},
+		{name: "two steps behind", secret: rfcSecret, code: code(current - 2)},
+		{name: "two steps ahead", secret: rfcSecret, code: code(current + 2)},
+		{name: "lowercase secret", secret: strings.ToLower(rfcSecret), code: code(current), want: current, wantOK: true},
+		{name: "replayed", secret: rfcSecret, code: code(current), lastCounter: current},
+		{name: "older than the last used", secret: rfcSecret, code: code(current - 1), lastCounter: current - 1},
+		{name: "newer than the last used", secret: rfcSecret, code: code(current + 1), lastCounter: current, want: current + 1, wantOK: true},
+		{name: "wrong code", secret: rfcSecret, code: "000000"},
+		{name: "too short", secret: rfcSecret, code: code(current)[:5]},
+		{name: "too long", secret: rfcSecret, code: code(current) + "0"},
+		{name: "invalid secret", secret: "not base32!", code: code(current)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ValidateTOTP(tt.secret, tt.code, now, tt.lastCounter)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("ValidateTOTP() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q is not formatted as xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q is repeated", code)
+		}
+		seen[code] = true
+		// Codes are checked by the hash of what the user types
+		if got := HashToken(normalizeRecoveryCode(code)); got != hashes[i] {
+			t.Errorf("hash of code %q does not match the stored hash", code)
+		}
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{code: "abcde-fghij", want: "abcdefghij"},
+		{code: "ABCDE-FGHIJ", want: "abcdefghij"},
+		{code: "  abcde fghij\n", want: "abcdefghij"},
+		{code: "abcdefghij", want: "abcdefghij"},
+		{code: "ab-cde-fg hij", want: "abcdefghij"},
+	}
+	for _, tt := range tests {
+		if got := normalizeRecoveryCode(tt.code); got != tt.want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
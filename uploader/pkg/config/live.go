@@ -0,0 +1,43 @@
+package config
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Live holds the settings that can be changed by editing the config file
+// while the server is running. Everything else requires a restart.
+type Live struct {
+	Level      zap.AtomicLevel
+	retention  atomic.Int64
+	rateLimits atomic.Pointer[RateLimits]
+}
+
+func NewLive(level zap.AtomicLevel, c *ServerConfig) *Live {
+	lv := &Live{Level: level}
+	lv.Apply(c)
+	return lv
+}
+
+// Apply copies the hot-reloadable settings from a validated config.
+func (lv *Live) Apply(c *ServerConfig) {
+	if level, err := zapcore.ParseLevel(c.LogLevel); err == nil {
+		lv.Level.SetLevel(level)
+	}
+	lv.retention.Store(int64(c.TrashRetention))
+	if rl, err := c.RateLimits(); err == nil {
+		lv.rateLimits.Store(rl)
+	}
+}
+
+func (lv *Live) RateLimits() *RateLimits {
+	return lv.rateLimits.Load()
+}
+
+// TrashRetention is how long deleted files can be restored.
+func (lv *Live) TrashRetention() time.Duration {
+	return time.Duration(lv.retention.Load())
+}
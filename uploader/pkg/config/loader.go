@@ -0,0 +1,147 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const redacted = "******"
+
+// Validator is implemented by config structs that check their own fields
+// once all layers have been merged.
+type Validator interface {
+	Validate() error
+}
+
+// Loader builds a typed config struct from, in increasing precedence, the
+// `default` struct tags, a properties file, environment variables and
+// command line flags. Keys are taken from the `mapstructure` tags, e.g.
+// MINIO_HOST is read from the MINIO_HOST env var or the --minio-host flag.
+type Loader struct {
+	v *viper.Viper
+	l *zap.SugaredLogger
+}
+
+func NewLoader(name string, cfg interface{}, args []string, l *zap.SugaredLogger) (*Loader, error) {
+	v := viper.New()
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	configFile := flags.String("config", "", "path to the config file")
+
+	for _, field := range fields(reflect.TypeOf(cfg)) {
+		key := field.Tag.Get("mapstructure")
+		if def, ok := field.Tag.Lookup("default"); ok {
+			v.SetDefault(key, def)
+		}
+		if err := v.BindEnv(key); err != nil {
+			return nil, err
+		}
+		flagName := strings.ReplaceAll(strings.ToLower(key), "_", "-")
+		flags.String(flagName, "", fmt.Sprintf("overrides %s", key))
+		if err := v.BindPFlag(key, flags.Lookup(flagName)); err != nil {
+			return nil, err
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		v.SetConfigFile(*configFile)
+	} else {
+		v.SetConfigName(name)
+		v.SetConfigType("props")
+		v.AddConfigPath(".")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		l.Info("Did not find config file... Configuring from envs")
+	}
+
+	return &Loader{v: v, l: l}, nil
+}
+
+// Load merges all layers into a new T and validates it.
+func Load[T any](ld *Loader) (*T, error) {
+	cfg := new(T)
+	if err := ld.v.Unmarshal(cfg); err != nil {
+		return nil, fmt.Errorf("decoding config: %w", err)
+	}
+	if validator, ok := any(cfg).(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid config: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// Watch reloads the config file on every change and passes the result to
+// apply. Invalid changes are logged and ignored, so the running config stays
+// in place. It is up to apply to pick the settings that are safe to change.
+func Watch[T any](ld *Loader, apply func(*T)) {
+	if ld.v.ConfigFileUsed() == "" {
+		return
+	}
+	ld.v.OnConfigChange(func(e fsnotify.Event) {
+		cfg, err := Load[T](ld)
+		if err != nil {
+			ld.l.Errorw("Ignoring config change", zap.String("file", e.Name), zap.Error(err))
+			return
+		}
+		ld.l.Infow("Config file changed, reloading", zap.String("file", e.Name))
+		apply(cfg)
+	})
+	ld.v.WatchConfig()
+}
+
+// Redacted returns the effective config keyed by option name, with fields
+// tagged `secret:"true"` masked so it can be logged.
+func Redacted(cfg interface{}) map[string]interface{} {
+	val := reflect.Indirect(reflect.ValueOf(cfg))
+	out := make(map[string]interface{})
+	for _, field := range fields(val.Type()) {
+		value := val.FieldByIndex(field.Index)
+		if field.Tag.Get("secret") == "true" && !value.IsZero() {
+			out[field.Tag.Get("mapstructure")] = redacted
+			continue
+		}
+		out[field.Tag.Get("mapstructure")] = fmt.Sprint(value.Interface())
+	}
+	return out
+}
+
+func fields(t reflect.Type) []reflect.StructField {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var out []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("mapstructure") != "" {
+			out = append(out, field)
+		}
+	}
+	return out
+}
+
+// Problems collects validation errors so all of them are reported at once.
+type Problems []error
+
+func (p *Problems) Require(ok bool, format string, args ...interface{}) {
+	if !ok {
+		*p = append(*p, fmt.Errorf(format, args...))
+	}
+}
+
+func (p Problems) Err() error {
+	return errors.Join(p...)
+}
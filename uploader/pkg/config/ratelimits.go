@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Limits of one user or client IP. Zero means unlimited.
+type Limits struct {
+	RequestsPerSecond float64
+	RequestBurst      int
+	BytesPerSecond    int64
+	ByteBurst         int64
+	// Uploads one user may run at the same time
+	ConcurrentUploads int
+}
+
+// RateLimits are the request admission settings. Users get the most
+// generous limits of their roles, or User if none of them has its own.
+type RateLimits struct {
+	User  Limits
+	IP    Limits
+	Roles map[string]Limits
+	// Uploads running at the same time across all users
+	MaxConcurrentUploads int
+}
+
+func (rl *RateLimits) ForRoles(roles []string) Limits {
+	var limits Limits
+	found := false
+	for _, role := range roles {
+		roleLimits, ok := rl.Roles[role]
+		if !ok {
+			continue
+		}
+		if !found {
+			limits, found = roleLimits, true
+			continue
+		}
+		limits.RequestsPerSecond = moreGenerous(limits.RequestsPerSecond, roleLimits.RequestsPerSecond)
+		limits.RequestBurst = moreGenerous(limits.RequestBurst, roleLimits.RequestBurst)
+		limits.BytesPerSecond = moreGenerous(limits.BytesPerSecond, roleLimits.BytesPerSecond)
+		limits.ByteBurst = moreGenerous(limits.ByteBurst, roleLimits.ByteBurst)
+		limits.ConcurrentUploads = moreGenerous(limits.ConcurrentUploads, roleLimits.ConcurrentUploads)
+	}
+	if !found {
+		return rl.User
+	}
+	return limits
+}
+
+func moreGenerous[T int | int64 | float64](a, b T) T {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+func (c *ServerConfig) RateLimits() (*RateLimits, error) {
+	rl := &RateLimits{
+		User: Limits{
+			RequestsPerSecond: c.RateLimitRequestsPerSecond,
+			RequestBurst:      c.RateLimitRequestBurst,
+			BytesPerSecond:    c.RateLimitBytesPerSecond,
+			ByteBurst:         c.RateLimitByteBurst,
+			ConcurrentUploads: c.UploadMaxConcurrentPerUser,
+		},
+		IP: Limits{
+			RequestsPerSecond: c.RateLimitIPRequestsPerSecond,
+			RequestBurst:      c.RateLimitIPRequestBurst,
+			BytesPerSecond:    c.RateLimitIPBytesPerSecond,
+			ByteBurst:         c.RateLimitByteBurst,
+		},
+		Roles:                make(map[string]Limits),
+		MaxConcurrentUploads: c.UploadMaxConcurrent,
+	}
+
+	// Entries look like admin.requests_per_second=100; unset settings of a
+	// role are those of every user
+	for _, entry := range c.RateLimitRoles {
+		setting, value, ok := strings.Cut(entry, "=")
+		role, name, ok2 := strings.Cut(strings.TrimSpace(setting), ".")
+		if !ok || !ok2 || role == "" {
+			return nil, fmt.Errorf("invalid role limit %q, expected role.setting=value", entry)
+		}
+		limits, ok := rl.Roles[role]
+		if !ok {
+			limits = rl.User
+		}
+		value = strings.TrimSpace(value)
+		var err error
+		switch name {
+		case "requests_per_second":
+			limits.RequestsPerSecond, err = strconv.ParseFloat(value, 64)
+		case "request_burst":
+			limits.RequestBurst, err = strconv.Atoi(value)
+		case "bytes_per_second":
+			limits.BytesPerSecond, err = strconv.ParseInt(value, 10, 64)
+		case "byte_burst":
+			limits.ByteBurst, err = strconv.ParseInt(value, 10, 64)
+		case "concurrent_uploads":
+			limits.ConcurrentUploads, err = strconv.Atoi(value)
+		default:
+			return nil, fmt.Errorf("unknown role limit setting %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid role limit %q: %w", entry, err)
+		}
+		rl.Roles[role] = limits
+	}
+	return rl, nil
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/storage"
+)
+
+// CreateAccessToken issues a personal access token for the caller. Scopes
+// are limited to permissions the caller holds; the token is only returned
+// in this response.
+func CreateAccessToken(db *sql.DB, defaultTTL, maxTTL time.Duration, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Name      string     `json:"name"`
+			Scopes    []string   `json:"scopes"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		scopes := uniqueStrings(req.Scopes)
+		if req.Name == "" || len(req.Name) > 255 {
+			http.Error(w, "Name must be between 1 and 255 characters long", http.StatusBadRequest)
+			return
+		}
+		if len(scopes) == 0 {
+			http.Error(w, "At least one scope is required", http.StatusBadRequest)
+			return
+		}
+		for _, scope := range scopes {
+			if !principal.Can(auth.Permission(scope)) {
+				http.Error(w, fmt.Sprintf("You do not hold the %s permission", scope), http.StatusBadRequest)
+				return
+			}
+		}
+
+		now := time.Now()
+		expiresAt := now.Add(defaultTTL)
+		if req.ExpiresAt != nil {
+			expiresAt = *req.ExpiresAt
+		}
+		if !expiresAt.After(now) || expiresAt.Sub(now) > maxTTL {
+			http.Error(w, fmt.Sprintf("Expiry must be in the future and at most %s away", maxTTL), http.StatusBadRequest)
+			return
+		}
+
+		token, hash, prefix, err := auth.NewAccessToken()
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		accessToken := &storage.AccessToken{
+			UserID:    principal.UserID,
+			Name:      req.Name,
+			Prefix:    prefix,
+			Scopes:    scopes,
+			ExpiresAt: expiresAt,
+		}
+		if err := storage.CreateAccessToken(r.Context(), db, accessToken, hash); err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Created access token", zap.Int("user_id", principal.UserID), zap.Int("token_id", accessToken.ID), zap.Strings("scopes", scopes))
+		auditLog.Record(auditEvent(r, "access_token.create", "access_token/"+strconv.Itoa(accessToken.ID), audit.OutcomeSuccess,
+			map[string]interface{}{"name": req.Name, "scopes": scopes, "expires_at": expiresAt}))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			*storage.AccessToken
+			Token string `json:"token"`
+		}{accessToken, token})
+	}
+}
+
+func ListAccessTokens(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		tokens, err := storage.ListAccessTokens(r.Context(), db, principal.UserID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+func RevokeAccessToken(accessTokens *auth.AccessTokens, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		tokenID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid token id", http.StatusBadRequest)
+			return
+		}
+
+		err = accessTokens.Revoke(r.Context(), principal.UserID, tokenID)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Revoked access token", zap.Int("user_id", principal.UserID), zap.Int("token_id", tokenID))
+		auditLog.Record(auditEvent(r, "access_token.revoke", "access_token/"+strconv.Itoa(tokenID), audit.OutcomeSuccess, nil))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
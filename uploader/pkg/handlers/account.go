@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/config"
+	"video-platform/uploader/pkg/storage"
+)
+
+// Register creates an account for the caller. Depending on
+// REGISTRATION_MODE it requires an invite code or leaves the account
+// pending until an admin enables it.
+func Register(db *sql.DB, cfg *config.ServerConfig, passwords *auth.Passwords, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.RegistrationMode == "closed" {
+			http.Error(w, "Registration is closed", http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			Username   string `json:"username"`
+			Email      string `json:"email"`
+			Password   string `json:"password"`
+			InviteCode string `json:"invite_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if req.Email == "" {
+			http.Error(w, "Email is required", http.StatusBadRequest)
+			return
+		}
+		if err := validateAccount(passwords, req.Username, req.Email, req.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user := &storage.NewUser{
+			Username: req.Username,
+			Email:    req.Email,
+			Status:   storage.UserActive,
+			Roles:    []string{cfg.RegistrationRole},
+		}
+		switch cfg.RegistrationMode {
+		case "invite":
+			if req.InviteCode == "" {
+				http.Error(w, "An invite code is required", http.StatusForbidden)
+				return
+			}
+			user.InviteHash = auth.HashToken(req.InviteCode)
+		case "approval":
+			user.Status = storage.UserPending
+		}
+
+		hash, err := passwords.Hash(req.Password)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		user.PasswordHash = hash
+
+		userID, err := storage.CreateUser(r.Context(), db, user)
+		switch {
+		case errors.Is(err, storage.ErrUserExists):
+			http.Error(w, "Username or email is already taken", http.StatusConflict)
+			return
+		case errors.Is(err, storage.ErrInviteInvalid):
+			http.Error(w, "Invalid invite code", http.StatusForbidden)
+			return
+		case err != nil:
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("User registered", zap.Int("user_id", userID), zap.String("username", user.Username), zap.String("status", user.Status))
+		e := auditEvent(r, "user.register", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess,
+			map[string]interface{}{"status": user.Status, "invited": user.InviteHash != ""})
+		e.ActorID, e.Actor = userID, user.Username
+		auditLog.Record(e)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": userID, "username": user.Username, "status": user.Status})
+	}
+}
+
+// ChangePassword replaces the caller's password after checking the current
+// one. All sessions are revoked and a new one is returned.
+func ChangePassword(db *sql.DB, tokens *auth.TokenService, revoker *auth.Revoker, passwords *auth.Passwords, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if err := passwords.Validate(req.NewPassword); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		storedHash, err := storage.GetPasswordHash(r.Context(), db, principal.UserID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if _, err := passwords.Check(storedHash, req.CurrentPassword); err != nil {
+			auditLog.Record(auditEvent(r, "user.password.change", "user/"+strconv.Itoa(principal.UserID), audit.OutcomeFailure, nil))
+			http.Error(w, "Current password is incorrect", http.StatusForbidden)
+			return
+		}
+
+		hash, err := passwords.Hash(req.NewPassword)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if err := storage.SetPassword(r.Context(), db, principal.UserID, hash); err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if err := revoker.RevokeUser(r.Context(), principal.UserID); err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		session, err := startSession(r.Context(), db, tokens, principal.Username, principal.UserID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Error generating token", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("User changed password", zap.Int("user_id", principal.UserID))
+		auditLog.Record(auditEvent(r, "user.password.change", "user/"+strconv.Itoa(principal.UserID), audit.OutcomeSuccess, nil))
+		json.NewEncoder(w).Encode(session)
+	}
+}
+
+// validateAccount checks the fields of a new account. Usernames cannot
+// contain '@' so they never collide with an email used to sign in.
+func validateAccount(passwords *auth.Passwords, username, email, password string) error {
+	if len(username) < 3 || len(username) > 64 {
+		return errors.New("username must be between 3 and 64 characters long")
+	}
+	for _, c := range username {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return errors.New("username may only contain letters, digits, '.', '_' and '-'")
+		}
+	}
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email || len(email) > 255 {
+			return errors.New("email is not a valid address")
+		}
+	}
+	return passwords.Validate(password)
+}
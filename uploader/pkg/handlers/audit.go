@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net/http"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+)
+
+// auditEvent describes an action of the authenticated caller of r.
+func auditEvent(r *http.Request, action, resource, outcome string, details map[string]interface{}) audit.Event {
+	e := audit.Event{
+		Action:   action,
+		Resource: resource,
+		Outcome:  outcome,
+		ClientIP: auth.ClientIP(r),
+		Details:  details,
+	}
+	if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+		e.ActorID = principal.UserID
+		e.Actor = principal.Username
+	}
+	return e
+}
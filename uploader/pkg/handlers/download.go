@@ -1,42 +1,52 @@
 package handlers
 
 import (
-	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/minio/minio-go/v7"
 	"go.uber.org/zap"
-	"io"
 	"net/http"
+	"strconv"
+	"time"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/metering"
+	"video-platform/uploader/pkg/process"
+	"video-platform/uploader/pkg/storage"
+	"video-platform/uploader/pkg/tiering"
 )
 
-func DownloadFile(db *sql.DB, minioClient *minio.Client, bucketName string, l *zap.SugaredLogger) http.HandlerFunc {
+// DownloadFile sends the file named by the id query parameter, or the ranges
+// of it the client asks for. If an etag is given too, the file is only sent
+// while its current version has that etag. The bytes sent are metered to
+// the caller. Archived files are rehydrated first: the response is 202 with
+// a Retry-After of retryAfter until the file is hot again.
+func DownloadFile(db *sql.DB, minioClient *minio.Client, bucketName string, authorizer auth.Authorizer, meter *metering.Meter,
+	tiers *tiering.Tiering, retryAfter time.Duration, l *zap.SugaredLogger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, ok := r.Context().Value("id").(int)
+		principal, ok := auth.PrincipalFromContext(r.Context())
 		if !ok {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		userID := principal.UserID
 
-		etag := r.URL.Query().Get("etag")
-		if etag == "" {
-			http.Error(w, "Missing etag", http.StatusBadRequest)
+		// The etag identifies the content, which files with the same bytes
+		// share, so files are looked up by id. An etag only makes sure the
+		// client gets the content it expects.
+		fileID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "Invalid file id", http.StatusBadRequest)
 			return
 		}
-
+		f, err := storage.GetFile(r.Context(), db, fileID)
 		// Verify that the file belongs to the user
-		var filename, contentType string
-		var err error
-		isAdmin, _ := r.Context().Value("admin").(bool)
-
-		if isAdmin {
-			err = db.QueryRow("SELECT filename, content_type FROM files WHERE etag=$1", etag).Scan(&filename, &contentType)
-		} else {
-			err = db.QueryRow("SELECT filename, content_type FROM files WHERE etag=$1 AND user_id=$2", etag, userID).Scan(&filename, &contentType)
+		if err == nil && (f.Status != storage.FileActive || f.UserID != userID && !principal.Can(auth.PermFilesReadAny)) {
+			err = sql.ErrNoRows
 		}
-
 		if err != nil {
-			if err == sql.ErrNoRows {
+			if errors.Is(err, sql.ErrNoRows) {
 				http.Error(w, "File not found", http.StatusNotFound)
 			} else {
 				l.Error(err)
@@ -44,30 +54,114 @@ func DownloadFile(db *sql.DB, minioClient *minio.Client, bucketName string, l *z
 			}
 			return
 		}
-
-		// Get the file from MinIO
-		archived := r.URL.Query().Get("archived")
-		if archived == "true" {
-			l.Info("Changing bucket name to backup")
-			bucketName = "backup"
-		} else {
-			bucketName = "videos"
+		if etag := r.URL.Query().Get("etag"); etag != "" && etag != f.ETag {
+			http.Error(w, "File has changed", http.StatusPreconditionFailed)
+			return
 		}
-		object, err := minioClient.GetObject(context.Background(), bucketName, filename, minio.GetObjectOptions{})
+
+		decision, err := authorizer.Authorize(r.Context(), auth.NewInput(r, auth.ActionFileDownload, &auth.Resource{
+			Type:        "file",
+			ID:          f.ID,
+			OwnerID:     f.UserID,
+			Name:        f.Filename,
+			Size:        f.Filesize,
+			ContentType: f.ContentType,
+		}))
 		if err != nil {
-			l.Error(err)
-			http.Error(w, "Error retrieving file", http.StatusInternalServerError)
+			l.Errorf("error checking policy: %v", err)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !decision.Allow {
+			auth.Deny(w, decision)
 			return
 		}
-		defer object.Close()
 
-		// Set the content type and other headers, then write the file to the response
-		w.Header().Set("Content-Type", contentType)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-		if _, err := io.Copy(w, object); err != nil {
-			l.Error(err)
-			http.Error(w, "Error writing file to response", http.StatusInternalServerError)
+		if f.Tier != storage.TierHot {
+			rehydrateFile(w, r, db, tiers, f.ID, userID, retryAfter, l)
 			return
 		}
+
+		serveObject(w, r, minioClient, bucketName, f.ObjectKey, f.Filename, f.ContentType, f.Checksum, meter, userID, l)
 	}
 }
+
+// serveObject sends the object stored under key as the file, or the ranges
+// of it the client asks for, and meters the bytes sent to the user. The
+// SHA-256 checksum of the file is sent as Repr-Digest, which covers the
+// whole file for range requests too.
+func serveObject(w http.ResponseWriter, r *http.Request, minioClient *minio.Client, bucketName, key, filename, contentType, checksum string,
+	meter *metering.Meter, userID int, l *zap.SugaredLogger) {
+	// Get the file from MinIO
+	object, err := minioClient.GetObject(r.Context(), bucketName, key, minio.GetObjectOptions{})
+	if err != nil {
+		l.Error(err)
+		http.Error(w, "Error retrieving file", http.StatusInternalServerError)
+		return
+	}
+	defer object.Close()
+	info, err := object.Stat()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		l.Error(err)
+		http.Error(w, "Error retrieving file", http.StatusInternalServerError)
+		return
+	}
+
+	// Set the content type and other headers, then write the file or the
+	// requested ranges to the response
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.Header().Set("ETag", fmt.Sprintf("%q", info.ETag))
+	if digest := process.ReprDigest(checksum); digest != "" {
+		w.Header().Set("Repr-Digest", digest)
+	}
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, filename, info.LastModified, object)
+	if cw.n > 0 {
+		meter.Download(userID, cw.n)
+	}
+}
+
+// rehydrateFile asks for an archived file to be rehydrated and tells the
+// client to come back later.
+func rehydrateFile(w http.ResponseWriter, r *http.Request, db *sql.DB, tiers *tiering.Tiering, fileID, userID int, retryAfter time.Duration, l *zap.SugaredLogger) {
+	f, err := storage.GetFile(r.Context(), db, fileID)
+	if err == nil {
+		err = tiers.Rehydrate(r.Context(), f, userID)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		// Restored or deleted meanwhile
+		http.Error(w, "File changed, try again", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		l.Error(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      f.ID,
+		"tier":    f.Tier,
+		"message": "The file is archived and being restored, you will be notified when it is ready",
+	})
+}
+
+// countingWriter counts the bytes of the response body.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
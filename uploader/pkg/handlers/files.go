@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/storage"
+	"video-platform/uploader/pkg/trash"
+)
+
+// DeleteFile moves a file to the trash, from where it can be restored until
+// the trash retention has passed. With permanent=true it is purged right
+// away, together with its backup.
+func DeleteFile(db *sql.DB, bin *trash.Trash, authorizer auth.Authorizer, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permanent := r.URL.Query().Get("permanent") == "true"
+		action := auth.ActionFileDelete
+		if permanent {
+			action = auth.ActionFilePurge
+		}
+		f, ok := authorizeFileChange(w, r, db, authorizer, action, l)
+		if !ok {
+			return
+		}
+		principal, _ := auth.PrincipalFromContext(r.Context())
+		resource := "file/" + strconv.Itoa(f.ID)
+
+		if f.Status == storage.FileActive {
+			err := bin.Delete(r.Context(), f, principal.UserID)
+			switch {
+			case errors.Is(err, trash.ErrHeld):
+				http.Error(w, "File is under a legal hold or retention", http.StatusConflict)
+				return
+			case errors.Is(err, sql.ErrNoRows):
+				// Trashed or held meanwhile
+				http.Error(w, "File changed, try again", http.StatusConflict)
+				return
+			case err != nil:
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			l.Infow("Moved file to trash", zap.Int("file_id", f.ID), zap.String("filename", f.Filename))
+			auditLog.Record(auditEvent(r, auth.ActionFileDelete, resource, audit.OutcomeSuccess,
+				map[string]interface{}{"filename": f.Filename, "owner_id": f.UserID}))
+		} else if !permanent {
+			http.Error(w, "File is already in the trash", http.StatusConflict)
+			return
+		}
+
+		if permanent {
+			err := bin.Purge(r.Context(), f)
+			if errors.Is(err, trash.ErrHeld) {
+				http.Error(w, "File is under a legal hold or retention", http.StatusConflict)
+				return
+			}
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "File not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			l.Infow("Purged file", zap.Int("file_id", f.ID), zap.String("filename", f.Filename))
+			auditLog.Record(auditEvent(r, auth.ActionFilePurge, resource, audit.OutcomeSuccess,
+				map[string]interface{}{"filename": f.Filename, "owner_id": f.UserID}))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":            f.ID,
+			"status":        f.Status,
+			"deleted_at":    f.DeletedAt,
+			"restore_until": bin.RestoreUntil(*f.DeletedAt),
+		})
+	}
+}
+
+// RestoreFile takes a file out of the trash.
+func RestoreFile(db *sql.DB, bin *trash.Trash, authorizer auth.Authorizer, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := authorizeFileChange(w, r, db, authorizer, auth.ActionFileRestore, l)
+		if !ok {
+			return
+		}
+
+		err := bin.Restore(r.Context(), f)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "File is not in the trash", http.StatusConflict)
+			return
+		case errors.Is(err, trash.ErrRestoreExpired):
+			http.Error(w, "File was deleted too long ago to be restored", http.StatusGone)
+			return
+		case errors.Is(err, storage.ErrFileExists):
+			http.Error(w, "A file with the same name exists, delete it before restoring", http.StatusConflict)
+			return
+		case err != nil:
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Restored file", zap.Int("file_id", f.ID), zap.String("filename", f.Filename))
+		auditLog.Record(auditEvent(r, auth.ActionFileRestore, "file/"+strconv.Itoa(f.ID), audit.OutcomeSuccess,
+			map[string]interface{}{"filename": f.Filename, "owner_id": f.UserID}))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f)
+	}
+}
+
+// authorizeFileChange looks up the file in the path and checks that the
+// caller may perform the action on it. Files of other users are reported
+// as not found unless the caller may change any file.
+func authorizeFileChange(w http.ResponseWriter, r *http.Request, db *sql.DB, authorizer auth.Authorizer, action string, l *zap.SugaredLogger) (*storage.File, bool) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid file id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	f, err := storage.GetFile(r.Context(), db, id)
+	if err == nil && f.UserID != principal.UserID && !principal.Can(auth.PermFilesDeleteAny) {
+		err = sql.ErrNoRows
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		l.Error(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	decision, err := authorizer.Authorize(r.Context(), auth.NewInput(r, action, &auth.Resource{
+		Type:        "file",
+		ID:          f.ID,
+		OwnerID:     f.UserID,
+		Name:        f.Filename,
+		Size:        f.Filesize,
+		ContentType: f.ContentType,
+	}))
+	if err != nil {
+		l.Errorf("error checking policy: %v", err)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if !decision.Allow {
+		auth.Deny(w, decision)
+		return nil, false
+	}
+	return f, true
+}
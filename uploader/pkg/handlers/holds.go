@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/holds"
+	"video-platform/uploader/pkg/storage"
+)
+
+// ListHeldFiles lists the files under a legal hold or retention.
+func ListHeldFiles(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		files, err := storage.ListHeldFiles(r.Context(), db)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(files)
+	}
+}
+
+// SetLegalHold places a legal hold on a file, which keeps it until the hold
+// is released. A reason is required.
+func SetLegalHold(db *sql.DB, h *holds.Holds, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if req.Reason == "" {
+			http.Error(w, "Reason is required", http.StatusBadRequest)
+			return
+		}
+		changeHold(w, r, db, "file.legal_hold.set", func(f *storage.File, by int) (map[string]interface{}, error) {
+			details := map[string]interface{}{"filename": f.Filename, "owner_id": f.UserID, "reason": req.Reason}
+			return details, h.SetLegalHold(r.Context(), f, true, req.Reason, by)
+		}, auditLog, l)
+	}
+}
+
+// ReleaseLegalHold releases the legal hold of a file.
+func ReleaseLegalHold(db *sql.DB, h *holds.Holds, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changeHold(w, r, db, "file.legal_hold.release", func(f *storage.File, by int) (map[string]interface{}, error) {
+			details := map[string]interface{}{"filename": f.Filename, "owner_id": f.UserID, "previous_reason": f.LegalHoldReason}
+			return details, h.SetLegalHold(r.Context(), f, false, "", by)
+		}, auditLog, l)
+	}
+}
+
+// SetRetention keeps a file until retain_until, which must be in the
+// future.
+func SetRetention(db *sql.DB, h *holds.Holds, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			RetainUntil time.Time `json:"retain_until"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if !req.RetainUntil.After(time.Now()) {
+			http.Error(w, "retain_until must be in the future", http.StatusBadRequest)
+			return
+		}
+		changeHold(w, r, db, "file.retention.set", func(f *storage.File, by int) (map[string]interface{}, error) {
+			details := map[string]interface{}{"filename": f.Filename, "owner_id": f.UserID, "retain_until": req.RetainUntil, "previous": f.RetainUntil}
+			return details, h.SetRetainUntil(r.Context(), f, &req.RetainUntil, by)
+		}, auditLog, l)
+	}
+}
+
+// RemoveRetention removes the retention of a file.
+func RemoveRetention(db *sql.DB, h *holds.Holds, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changeHold(w, r, db, "file.retention.remove", func(f *storage.File, by int) (map[string]interface{}, error) {
+			details := map[string]interface{}{"filename": f.Filename, "owner_id": f.UserID, "previous": f.RetainUntil}
+			return details, h.SetRetainUntil(r.Context(), f, nil, by)
+		}, auditLog, l)
+	}
+}
+
+// changeHold applies change to the file in the path, audits it as the
+// action with the details change returns and responds with the file.
+func changeHold(w http.ResponseWriter, r *http.Request, db *sql.DB, action string,
+	change func(f *storage.File, updatedBy int) (map[string]interface{}, error), auditLog *audit.Logger, l *zap.SugaredLogger) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid file id", http.StatusBadRequest)
+		return
+	}
+	f, err := storage.GetFile(r.Context(), db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		l.Error(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	var updatedBy int
+	if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+		updatedBy = principal.UserID
+	}
+	resource := "file/" + strconv.Itoa(f.ID)
+	details, err := change(f, updatedBy)
+	switch {
+	case errors.Is(err, holds.ErrRetentionLocked):
+		auditLog.Record(auditEvent(r, action, resource, audit.OutcomeFailure, details))
+		http.Error(w, "Retention is locked in compliance mode and can only be extended", http.StatusConflict)
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	case err != nil:
+		l.Error(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	l.Infow("Changed file hold", zap.String("action", action), zap.Int("file_id", f.ID), zap.String("filename", f.Filename))
+	auditLog.Record(auditEvent(r, action, resource, audit.OutcomeSuccess, details))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
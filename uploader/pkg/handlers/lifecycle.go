@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/lifecycle"
+)
+
+// Default window of the lifecycle report
+const defaultReportWindow = 30 * 24 * time.Hour
+
+// LifecycleReport lists the copies that lifecycle policies would remove
+// within the window given as a duration in within, 30 days by default,
+// without removing anything.
+func LifecycleReport(engine *lifecycle.Engine, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		within := defaultReportWindow
+		if s := r.URL.Query().Get("within"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				http.Error(w, "Invalid within, expected a duration such as 720h", http.StatusBadRequest)
+				return
+			}
+			within = d
+		}
+
+		report, err := engine.Report(r.Context(), within)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"until":    time.Now().Add(within),
+			"expiring": report,
+		})
+	}
+}
@@ -7,69 +7,83 @@ import (
 	"time"
 
 	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/storage"
+	"video-platform/uploader/pkg/trash"
 )
 
-func GetUserFiles(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+// GetUserFiles lists the active files of the caller, or of everyone for
+// callers who may read any file, or the trashed ones with trash=true.
+func GetUserFiles(db *sql.DB, bin *trash.Trash, authorizer auth.Authorizer, l *zap.SugaredLogger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, ok := r.Context().Value("id").(int)
+		principal, ok := auth.PrincipalFromContext(r.Context())
 		if !ok {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		userID := principal.UserID
 
-		isAdmin, _ := r.Context().Value("admin").(bool)
-		var rows *sql.Rows
-		var err error
-		if isAdmin {
-			rows, err = db.Query("SELECT filename, filesize, content_type, etag, file_url, checksum, upload_timestamp FROM files")
-			if err != nil {
-				l.Error(err)
-				http.Error(w, "Server error", http.StatusInternalServerError)
-				return
-			}
-		} else {
-			rows, err = db.Query("SELECT filename, filesize, content_type, etag, file_url, checksum, upload_timestamp FROM files WHERE user_id=$1", userID)
-			if err != nil {
-				l.Error(err)
-				http.Error(w, "Server error", http.StatusInternalServerError)
-				return
-			}
+		readAny := principal.Can(auth.PermFilesReadAny)
+		scope := "own"
+		if readAny {
+			scope = "all"
+		}
+		decision, err := authorizer.Authorize(r.Context(), auth.NewInput(r, auth.ActionFileList, &auth.Resource{
+			Type:    "file",
+			OwnerID: userID,
+			Scope:   scope,
+		}))
+		if err != nil {
+			l.Errorf("error checking policy: %v", err)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !decision.Allow {
+			auth.Deny(w, decision)
+			return
 		}
-		defer rows.Close()
-
-		var files []map[string]interface{}
-		for rows.Next() {
-			var file map[string]interface{}
-			var filename, contentType, etag, fileURL, checksum string
-			var uploaded_timestamp time.Time
-
-			var filesize int64
-			if err := rows.Scan(&filename, &filesize, &contentType, &etag, &fileURL, &checksum, &uploaded_timestamp); err != nil {
-				l.Error(err)
-				http.Error(w, "Server error", http.StatusInternalServerError)
-				return
-			}
 
-			deleted := time.Now().After(uploaded_timestamp.Add(2 * time.Minute))
-			l.Infof("Time now is %s", time.Now())
-			l.Infof("File %s is marked as %t due to %s uploaded_tiemstamp", filename, deleted, uploaded_timestamp.String())
-			file = map[string]interface{}{
-				"filename":     filename,
-				"filesize":     filesize,
-				"content_type": contentType,
-				"etag":         etag,
-				"file_url":     fileURL,
-				"checksum":     checksum,
-				"deleted":      deleted,
-			}
-			files = append(files, file)
+		// The trash is listed with trash=true
+		status := storage.FileActive
+		if r.URL.Query().Get("trash") == "true" {
+			status = storage.FileTrashed
 		}
-		if err := rows.Err(); err != nil {
+		ownerID := userID
+		if readAny {
+			ownerID = 0
+		}
+		stored, err := storage.ListFiles(r.Context(), db, ownerID, status)
+		if err != nil {
 			l.Error(err)
 			http.Error(w, "Server error", http.StatusInternalServerError)
 			return
 		}
 
+		var files []map[string]interface{}
+		for _, f := range stored {
+			file := map[string]interface{}{
+				"id":               f.ID,
+				"filename":         f.Filename,
+				"version":          f.Version,
+				"filesize":         f.Filesize,
+				"content_type":     f.ContentType,
+				"etag":             f.ETag,
+				"file_url":         f.FileURL,
+				"checksum":         f.Checksum,
+				"upload_timestamp": f.UploadedAt,
+				"status":           f.Status,
+				"tier":             f.Tier,
+				"deleted":          f.Status != storage.FileActive,
+				"held":             f.Hold.Active(time.Now()),
+			}
+			if f.DeletedAt != nil {
+				file["deleted_at"] = f.DeletedAt
+				file["restore_until"] = bin.RestoreUntil(*f.DeletedAt)
+			}
+			files = append(files, file)
+		}
+
 		json.NewEncoder(w).Encode(files)
 	}
 }
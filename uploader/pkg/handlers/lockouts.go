@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/storage"
+)
+
+// ListLoginLocks returns the accounts, unknown names and IPs that are
+// currently locked after failed sign-ins.
+func ListLoginLocks(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		locks, err := storage.ListLoginLocks(r.Context(), db)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(locks)
+	}
+}
+
+// UnlockUser lets a locked out user sign in again right away.
+func UnlockUser(throttle *auth.LoginThrottle, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+		unlock(w, r, throttle, auth.AccountKey(userID), auditLog, l)
+	}
+}
+
+// UnlockLogin removes the lock of any key listed by ListLoginLocks, e.g.
+// ip:203.0.113.7.
+func UnlockLogin(throttle *auth.LoginThrottle, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		unlock(w, r, throttle, r.PathValue("key"), auditLog, l)
+	}
+}
+
+func unlock(w http.ResponseWriter, r *http.Request, throttle *auth.LoginThrottle, key string, auditLog *audit.Logger, l *zap.SugaredLogger) {
+	err := throttle.Unlock(r.Context(), key)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "No failed sign-ins recorded", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		l.Error(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	l.Infow("Unlocked sign-in", zap.String("key", key))
+	auditLog.Record(auditEvent(r, "user.login.unlock", key, audit.OutcomeSuccess, nil))
+	w.WriteHeader(http.StatusNoContent)
+}
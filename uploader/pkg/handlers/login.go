@@ -1,17 +1,36 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"math"
 	"net/http"
+	"strconv"
 
 	"go.uber.org/zap"
-	"golang.org/x/crypto/bcrypt"
 
+	"video-platform/uploader/pkg/audit"
 	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/monitoring"
+	"video-platform/uploader/pkg/storage"
 )
 
-func Login(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+// mfaChallengeResponse is returned by Login instead of a session when a
+// second factor is needed. A user who must but has not yet enrolled gets a
+// new secret to confirm along with the challenge.
+type mfaChallengeResponse struct {
+	MFARequired           bool   `json:"mfa_required"`
+	MFAEnrollmentRequired bool   `json:"mfa_enrollment_required,omitempty"`
+	MFAToken              string `json:"mfa_token"`
+	ExpiresIn             int    `json:"expires_in"`
+	Secret                string `json:"secret,omitempty"`
+	OTPAuthURI            string `json:"otpauth_uri,omitempty"`
+}
+
+// Login checks the credentials and starts a session, or returns an MFA
+// challenge. Failed attempts lock the account and the client IP for a while.
+func Login(db *sql.DB, tokens *auth.TokenService, passwords *auth.Passwords, mfa *auth.MFA, throttle *auth.LoginThrottle, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var creds auth.Credentials
 		err := json.NewDecoder(r.Body).Decode(&creds)
@@ -19,35 +38,168 @@ func Login(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
 			http.Error(w, "Invalid request payload", http.StatusBadRequest)
 			return
 		}
+		ip := auth.ClientIP(r)
 
-		// Query the user from the database
-		var storedPassword string
-		var userID int
-		err = db.QueryRow("SELECT id, password FROM app_users WHERE username=$1", creds.Username).Scan(&userID, &storedPassword)
+		// Query the user from the database, by username or email
+		user, err := storage.GetLoginUser(r.Context(), db, creds.Username)
+		if err != nil && err != sql.ErrNoRows {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		attempt := loginAttempt{throttle: throttle, auditLog: auditLog, l: l, action: "user.login", key: auth.LoginNameKey(creds.Username), login: creds.Username}
+		if user != nil {
+			attempt.key, attempt.userID, attempt.login = auth.AccountKey(user.ID), user.ID, user.Username
+		}
+
+		if !attempt.checkLocked(w, r) {
+			return
+		}
+
+		// Unknown users cost a password comparison too, so they cannot be
+		// told apart by timing
+		if user == nil {
+			passwords.CheckNone(creds.Password)
+			l.Infow("Login for unknown user", zap.String("username", creds.Username), zap.String("ip", ip))
+			attempt.fail(w, r, "unknown_user", "Invalid credentials")
+			return
+		}
+		// Compare the stored hashed password with the provided password
+		rehash, err := passwords.Check(user.PasswordHash, creds.Password)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				l.Error(err)
-				http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-			} else {
-				l.Error(err)
-				http.Error(w, "Server error", http.StatusInternalServerError)
+			attempt.fail(w, r, "bad_password", "Invalid credentials")
+			return
+		}
+		// The password is known only now, so this is when a hash made with
+		// an old algorithm or parameters can be replaced
+		if rehash {
+			if err := upgradePasswordHash(r.Context(), db, passwords, user, creds.Password); err != nil {
+				l.Errorw("Failed to rehash password", zap.Int("user_id", user.ID), zap.Error(err))
 			}
+		}
+		if err := throttle.Success(r.Context(), attempt.key); err != nil {
+			l.Error(err)
+		}
+
+		if !checkLoginStatus(w, user.Status) {
 			return
 		}
 
-		// Compare the stored hashed password with the provided password
-		err = bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(creds.Password))
+		enabled, err := mfa.Enabled(r.Context(), user.ID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		roles, err := storage.GetUserRoles(r.Context(), db, user.ID)
 		if err != nil {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if enabled || mfa.Required(roles) {
+			resp := mfaChallengeResponse{MFARequired: true, ExpiresIn: int(mfa.ChallengeTTL().Seconds())}
+			if !enabled {
+				resp.MFAEnrollmentRequired = true
+				if resp.Secret, resp.OTPAuthURI, err = mfa.StartEnrollment(r.Context(), user.ID, user.Username); err != nil {
+					l.Error(err)
+					http.Error(w, "Server error", http.StatusInternalServerError)
+					return
+				}
+			}
+			if resp.MFAToken, err = mfa.NewChallenge(r.Context(), user.ID); err != nil {
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(resp)
 			return
 		}
 
-		token, err := auth.GenerateJWT(creds.Username, userID)
+		session, err := startSession(r.Context(), db, tokens, user.Username, user.ID)
 		if err != nil {
+			l.Error(err)
 			http.Error(w, "Error generating token", http.StatusInternalServerError)
 			return
 		}
 
-		json.NewEncoder(w).Encode(map[string]string{"token": token})
+		attempt.record(r, audit.OutcomeSuccess, nil)
+		json.NewEncoder(w).Encode(session)
+	}
+}
+
+// loginAttempt is a sign-in for one account, or for a name that matches
+// none, that is throttled and audited.
+type loginAttempt struct {
+	throttle *auth.LoginThrottle
+	auditLog *audit.Logger
+	l        *zap.SugaredLogger
+	action   string
+	key      string
+	userID   int
+	login    string
+}
+
+// checkLocked answers with 429 if the account or client IP is locked.
+func (a *loginAttempt) checkLocked(w http.ResponseWriter, r *http.Request) bool {
+	locked, err := a.throttle.Locked(r.Context(), a.key, auth.ClientIP(r))
+	if err != nil {
+		a.l.Error(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return false
+	}
+	if locked == 0 {
+		return true
+	}
+	monitoring.LoginFailures.WithLabelValues("locked").Inc()
+	a.record(r, audit.OutcomeFailure, map[string]interface{}{"reason": "locked"})
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.Seconds()))))
+	http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+	return false
+}
+
+// fail counts a failed attempt and answers with 401.
+func (a *loginAttempt) fail(w http.ResponseWriter, r *http.Request, reason, message string) {
+	monitoring.LoginFailures.WithLabelValues(reason).Inc()
+	details := map[string]interface{}{"reason": reason}
+	locked, err := a.throttle.Failure(r.Context(), a.key, auth.ClientIP(r))
+	if err != nil {
+		a.l.Error(err)
+	}
+	if locked > 0 {
+		a.l.Warnw("Locked sign-in after failed attempts", zap.String("key", a.key), zap.String("ip", auth.ClientIP(r)), zap.Duration("duration", locked))
+		details["locked_for"] = locked.String()
+	}
+	a.record(r, audit.OutcomeFailure, details)
+	http.Error(w, message, http.StatusUnauthorized)
+}
+
+func (a *loginAttempt) record(r *http.Request, outcome string, details map[string]interface{}) {
+	e := auditEvent(r, a.action, "", outcome, details)
+	e.ActorID, e.Actor = a.userID, a.login
+	if a.userID != 0 {
+		e.Resource = "user/" + strconv.Itoa(a.userID)
+	}
+	a.auditLog.Record(e)
+}
+
+func upgradePasswordHash(ctx context.Context, db *sql.DB, passwords *auth.Passwords, user *storage.LoginUser, password string) error {
+	hash, err := passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	return storage.UpgradePasswordHash(ctx, db, user.ID, user.PasswordHash, hash)
+}
+
+// checkLoginStatus rejects accounts that may not sign in.
+func checkLoginStatus(w http.ResponseWriter, status string) bool {
+	switch status {
+	case storage.UserPending:
+		http.Error(w, "Account is awaiting approval", http.StatusForbidden)
+		return false
+	case storage.UserDisabled:
+		http.Error(w, "Account is disabled", http.StatusForbidden)
+		return false
 	}
+	return true
 }
@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/storage"
+)
+
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// LoginMFA completes a login that returned an MFA challenge. The code may
+// be a TOTP code or a recovery code; if the login required enrollment, the
+// code confirms it and the new recovery codes are returned with the session.
+func LoginMFA(db *sql.DB, tokens *auth.TokenService, mfa *auth.MFA, throttle *auth.LoginThrottle, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		userID, err := mfa.ChallengeUser(r.Context(), req.MFAToken)
+		if errors.Is(err, auth.ErrMFAChallengeInvalid) {
+			http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		user, err := storage.GetLoginUserByID(r.Context(), db, userID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if !checkLoginStatus(w, user.Status) {
+			return
+		}
+		// Wrong codes count against the account like wrong passwords, so
+		// codes cannot be guessed by starting new challenges
+		attempt := loginAttempt{throttle: throttle, auditLog: auditLog, l: l, action: "user.login.mfa",
+			key: auth.AccountKey(userID), userID: userID, login: user.Username}
+		if !attempt.checkLocked(w, r) {
+			return
+		}
+
+		enabled, err := mfa.Enabled(r.Context(), userID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		var recoveryCodes []string
+		if enabled {
+			err = mfa.Verify(r.Context(), userID, req.Code)
+		} else {
+			recoveryCodes, err = mfa.Confirm(r.Context(), userID, req.Code)
+		}
+		switch {
+		case errors.Is(err, auth.ErrMFACodeInvalid):
+			if err := mfa.FailChallenge(r.Context(), req.MFAToken); err != nil {
+				l.Error(err)
+			}
+			attempt.fail(w, r, "bad_mfa_code", "Invalid verification code")
+			return
+		case errors.Is(err, auth.ErrMFANotEnrolled), errors.Is(err, auth.ErrMFAAlreadyEnabled):
+			// The enrollment changed since the challenge was issued
+			http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+			return
+		case err != nil:
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if err := mfa.CompleteChallenge(r.Context(), req.MFAToken); err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if err := throttle.Success(r.Context(), attempt.key); err != nil {
+			l.Error(err)
+		}
+
+		session, err := startSession(r.Context(), db, tokens, user.Username, user.ID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Error generating token", http.StatusInternalServerError)
+			return
+		}
+
+		attempt.record(r, audit.OutcomeSuccess, map[string]interface{}{"enrolled": !enabled})
+		json.NewEncoder(w).Encode(struct {
+			*tokenResponse
+			RecoveryCodes []string `json:"recovery_codes,omitempty"`
+		}{session, recoveryCodes})
+	}
+}
+
+// EnrollMFA starts TOTP enrollment for the caller. The secret is returned
+// as is and as an otpauth:// URI to render as a QR code; it is not used
+// until ConfirmMFA.
+func EnrollMFA(mfa *auth.MFA, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		secret, uri, err := mfa.StartEnrollment(r.Context(), principal.UserID, principal.Username)
+		if errors.Is(err, auth.ErrMFAAlreadyEnabled) {
+			http.Error(w, "MFA is already enabled", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"secret": secret, "otpauth_uri": uri})
+	}
+}
+
+// ConfirmMFA enables the caller's pending enrollment with a code from the
+// authenticator and returns the recovery codes once.
+func ConfirmMFA(mfa *auth.MFA, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req mfaCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		codes, err := mfa.Confirm(r.Context(), principal.UserID, req.Code)
+		switch {
+		case errors.Is(err, auth.ErrMFANotEnrolled):
+			http.Error(w, "Start enrollment first", http.StatusConflict)
+			return
+		case errors.Is(err, auth.ErrMFAAlreadyEnabled):
+			http.Error(w, "MFA is already enabled", http.StatusConflict)
+			return
+		case errors.Is(err, auth.ErrMFACodeInvalid):
+			http.Error(w, "Invalid verification code", http.StatusBadRequest)
+			return
+		case err != nil:
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Enabled MFA", zap.Int("user_id", principal.UserID))
+		auditLog.Record(auditEvent(r, "user.mfa.enable", "user/"+strconv.Itoa(principal.UserID), audit.OutcomeSuccess, nil))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+	}
+}
+
+// DisableMFA removes the caller's second factor after checking a current
+// code. Users whose roles require MFA cannot remove it.
+func DisableMFA(mfa *auth.MFA, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req mfaCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if mfa.Required(principal.Roles) {
+			http.Error(w, "MFA is required for your role", http.StatusForbidden)
+			return
+		}
+
+		if !verifyMFA(w, r, mfa, principal.UserID, req.Code, "user.mfa.disable", auditLog, l) {
+			return
+		}
+		if err := mfa.Disable(r.Context(), principal.UserID); err != nil && !errors.Is(err, auth.ErrMFANotEnrolled) {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Disabled MFA", zap.Int("user_id", principal.UserID))
+		auditLog.Record(auditEvent(r, "user.mfa.disable", "user/"+strconv.Itoa(principal.UserID), audit.OutcomeSuccess, nil))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes after
+// checking a current code.
+func RegenerateRecoveryCodes(mfa *auth.MFA, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req mfaCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if !verifyMFA(w, r, mfa, principal.UserID, req.Code, "user.mfa.recovery_codes", auditLog, l) {
+			return
+		}
+		codes, err := mfa.RegenerateRecoveryCodes(r.Context(), principal.UserID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		auditLog.Record(auditEvent(r, "user.mfa.recovery_codes", "user/"+strconv.Itoa(principal.UserID), audit.OutcomeSuccess, nil))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+	}
+}
+
+// ResetUserMFA removes the second factor of a user who lost it. If their
+// role requires MFA they enroll again on the next login.
+func ResetUserMFA(mfa *auth.MFA, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		err = mfa.Disable(r.Context(), userID)
+		if errors.Is(err, auth.ErrMFANotEnrolled) {
+			http.Error(w, "User has no MFA enrollment", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Reset user MFA", zap.Int("user_id", userID))
+		auditLog.Record(auditEvent(r, "user.mfa.reset", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess, nil))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verifyMFA checks a code of the caller and writes the error response if it
+// is not accepted.
+func verifyMFA(w http.ResponseWriter, r *http.Request, mfa *auth.MFA, userID int, code, action string, auditLog *audit.Logger, l *zap.SugaredLogger) bool {
+	err := mfa.Verify(r.Context(), userID, code)
+	switch {
+	case errors.Is(err, auth.ErrMFANotEnrolled):
+		http.Error(w, "MFA is not enabled", http.StatusConflict)
+		return false
+	case errors.Is(err, auth.ErrMFACodeInvalid):
+		auditLog.Record(auditEvent(r, action, "user/"+strconv.Itoa(userID), audit.OutcomeFailure, nil))
+		http.Error(w, "Invalid verification code", http.StatusForbidden)
+		return false
+	case err != nil:
+		l.Error(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
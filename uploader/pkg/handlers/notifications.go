@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/storage"
+)
+
+// Notifications returned at most
+const notificationsLimit = 100
+
+// ListNotifications returns the latest notifications of the caller, only
+// the unread ones with unread=true.
+func ListNotifications(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		unread := r.URL.Query().Get("unread") == "true"
+		notifications, err := storage.ListNotifications(r.Context(), db, principal.UserID, unread, notificationsLimit)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notifications)
+	}
+}
+
+// MarkNotificationsRead marks the notifications of the caller up to the id
+// in up_to as read, or all of them without a body.
+func MarkNotificationsRead(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			UpTo int `json:"up_to"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request payload", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := storage.MarkNotificationsRead(r.Context(), db, principal.UserID, req.UpTo); err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,404 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/config"
+	"video-platform/uploader/pkg/oidc"
+	"video-platform/uploader/pkg/storage"
+)
+
+// The state of an authorization request is also kept in this cookie, so
+// that a callback is only accepted in the browser that started it
+const oidcStateCookie = "oidc_state"
+
+// OIDCLogin sends the user to the identity provider to sign in.
+func OIDCLogin(db *sql.DB, provider *oidc.Provider, cfg *config.ServerConfig, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authURL, err := startOIDC(w, r, db, provider, cfg, 0)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Single sign-on is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// LinkOIDCIdentity starts linking an identity at the provider to the
+// caller's account. It has to be called from the browser that follows the
+// returned URL, since the callback checks the state cookie.
+func LinkOIDCIdentity(db *sql.DB, provider *oidc.Provider, cfg *config.ServerConfig, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		authURL, err := startOIDC(w, r, db, provider, cfg, principal.UserID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Single sign-on is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"authorization_url": authURL})
+	}
+}
+
+func startOIDC(w http.ResponseWriter, r *http.Request, db *sql.DB, provider *oidc.Provider, cfg *config.ServerConfig, linkUserID int) (string, error) {
+	var values [3]string
+	for i := range values {
+		v, err := oidc.NewVerifier()
+		if err != nil {
+			return "", err
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		return "", err
+	}
+	s := &storage.OIDCLoginState{Nonce: nonce, CodeVerifier: verifier, LinkUserID: linkUserID}
+	if err := storage.StoreOIDCLoginState(r.Context(), db, auth.HashToken(state), s, time.Now().Add(cfg.OIDCStateTTL)); err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(cfg.OIDCStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.OIDCRedirectURL, "https://"),
+		// The callback is a top-level navigation from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+	return authURL, nil
+}
+
+// OIDCCallback finishes an authorization request. Signing in finds the
+// user linked to the identity, links one with the same verified email if
+// allowed, or provisions a new one; then it starts a platform session.
+// The provider is trusted to have checked any second factor of linked
+// identities, so accounts that use one are never linked by email.
+func OIDCCallback(db *sql.DB, tokens *auth.TokenService, provider *oidc.Provider, mapping *oidc.ClaimMapping, mfa *auth.MFA, cfg *config.ServerConfig, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1})
+		if errCode := query.Get("error"); errCode != "" {
+			l.Infow("Identity provider returned an error", zap.String("error", errCode), zap.String("description", query.Get("error_description")))
+			http.Error(w, "Sign-in was not completed at the identity provider", http.StatusUnauthorized)
+			return
+		}
+
+		state := query.Get("state")
+		cookie, err := r.Cookie(oidcStateCookie)
+		if state == "" || err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+			http.Error(w, "Invalid sign-in state", http.StatusBadRequest)
+			return
+		}
+		s, err := storage.TakeOIDCLoginState(r.Context(), db, auth.HashToken(state))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Sign-in has expired, start again", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		claims, err := provider.Exchange(r.Context(), query.Get("code"), s.CodeVerifier, s.Nonce)
+		if err != nil {
+			l.Warnw("OIDC code exchange failed", zap.Error(err))
+			http.Error(w, "Sign-in at the identity provider failed", http.StatusUnauthorized)
+			return
+		}
+		identity := mapping.Identity(provider.Issuer(), claims)
+		stored := &storage.Identity{Issuer: identity.Issuer, Subject: identity.Subject, Email: identity.Email}
+
+		if s.LinkUserID != 0 {
+			err := storage.LinkIdentity(r.Context(), db, s.LinkUserID, stored)
+			if errors.Is(err, storage.ErrIdentityLinked) {
+				http.Error(w, "This identity is already linked to an account", http.StatusConflict)
+				return
+			}
+			if err != nil {
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			l.Infow("Linked identity", zap.Int("user_id", s.LinkUserID), zap.String("issuer", identity.Issuer))
+			e := auditEvent(r, "user.identity.link", "user/"+strconv.Itoa(s.LinkUserID), audit.OutcomeSuccess,
+				map[string]interface{}{"issuer": identity.Issuer, "subject": identity.Subject})
+			e.ActorID = s.LinkUserID
+			auditLog.Record(e)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"issuer": identity.Issuer, "subject": identity.Subject})
+			return
+		}
+
+		user, status, err := oidcUser(r, db, identity, stored, mfa, cfg, l)
+		if err != nil {
+			if status == http.StatusInternalServerError {
+				l.Error(err)
+			}
+			e := auditEvent(r, "user.login.oidc", "", audit.OutcomeFailure,
+				map[string]interface{}{"issuer": identity.Issuer, "subject": identity.Subject, "reason": err.Error()})
+			auditLog.Record(e)
+			http.Error(w, oidcErrorMessage(status, err), status)
+			return
+		}
+		if !checkLoginStatus(w, user.Status) {
+			return
+		}
+
+		if err := storage.TouchIdentity(r.Context(), db, identity.Issuer, identity.Subject, identity.Email); err != nil {
+			l.Error(err)
+		}
+		session, err := startSession(r.Context(), db, tokens, user.Username, user.ID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Error generating token", http.StatusInternalServerError)
+			return
+		}
+
+		e := auditEvent(r, "user.login.oidc", "user/"+strconv.Itoa(user.ID), audit.OutcomeSuccess,
+			map[string]interface{}{"issuer": identity.Issuer, "subject": identity.Subject, "roles": identity.Roles})
+		e.ActorID, e.Actor = user.ID, user.Username
+		auditLog.Record(e)
+
+		// A browser app gets the tokens in the fragment, which is not sent
+		// to its server
+		if cfg.OIDCPostLoginURL != "" {
+			fragment := url.Values{
+				"token":         {session.Token},
+				"refresh_token": {session.RefreshToken},
+				"expires_in":    {strconv.Itoa(session.ExpiresIn)},
+			}
+			http.Redirect(w, r, cfg.OIDCPostLoginURL+"#"+fragment.Encode(), http.StatusFound)
+			return
+		}
+		json.NewEncoder(w).Encode(session)
+	}
+}
+
+var (
+	errNoAccount = errors.New("no account is linked to this identity")
+	errNoRole    = errors.New("identity is in no group with access")
+	errEmailUsed = errors.New("email belongs to an existing account")
+	errEmailMFA  = errors.New("email belongs to an account with a second factor")
+)
+
+// oidcUser returns the platform user for the identity, linking or creating
+// one as configured. On error it also returns the status to answer with.
+func oidcUser(r *http.Request, db *sql.DB, identity *oidc.Identity, stored *storage.Identity, mfa *auth.MFA, cfg *config.ServerConfig, l *zap.SugaredLogger) (*storage.LoginUser, int, error) {
+	ctx := r.Context()
+	userID, err := storage.GetIdentityUser(ctx, db, identity.Issuer, identity.Subject)
+	if err == nil {
+		// Roles follow the provider's groups on every sign-in
+		if cfg.OIDCSyncRoles && len(identity.Roles) > 0 {
+			if err := storage.SetUserRoles(ctx, db, userID, identity.Roles); err != nil {
+				return nil, http.StatusInternalServerError, fmt.Errorf("syncing roles: %w", err)
+			}
+		}
+		user, err := storage.GetLoginUserByID(ctx, db, userID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return user, 0, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	var match *storage.LoginUser
+	var matchMFA bool
+	if linkByEmail(cfg, identity) {
+		match, err = storage.GetLoginUserByEmail(ctx, db, identity.Email)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, http.StatusInternalServerError, err
+		}
+		if match != nil {
+			if matchMFA, err = usesMFA(r, db, mfa, match.ID); err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+		}
+	}
+	link, status, err := newIdentityAction(cfg, identity, match != nil, matchMFA)
+	if err != nil {
+		return nil, status, err
+	}
+	if !link {
+		return provisionOIDCUser(r, db, identity, stored, l)
+	}
+	if err := storage.LinkIdentity(ctx, db, match.ID, stored); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	l.Infow("Linked identity by email", zap.Int("user_id", match.ID), zap.String("issuer", identity.Issuer))
+	return match, 0, nil
+}
+
+// linkByEmail reports whether an identity that is not linked yet may be
+// linked to the account with its email.
+func linkByEmail(cfg *config.ServerConfig, identity *oidc.Identity) bool {
+	return cfg.OIDCLinkByEmail && identity.EmailVerified && identity.Email != ""
+}
+
+// newIdentityAction decides what signing in with an identity that is not
+// linked yet does: link it to the account with its email, if there is one
+// and linkByEmail allows it, or provision an account. Accounts with a
+// second factor are not linked, signing in with the identity would skip it.
+func newIdentityAction(cfg *config.ServerConfig, identity *oidc.Identity, emailMatch, matchMFA bool) (bool, int, error) {
+	switch {
+	case emailMatch && matchMFA:
+		return false, http.StatusConflict, errEmailMFA
+	case emailMatch:
+		return true, 0, nil
+	case !cfg.OIDCAutoProvision:
+		return false, http.StatusForbidden, errNoAccount
+	case len(identity.Roles) == 0:
+		return false, http.StatusForbidden, errNoRole
+	}
+	return false, 0, nil
+}
+
+// usesMFA reports whether the user signs in with a second factor, or has
+// to once enrolled.
+func usesMFA(r *http.Request, db *sql.DB, mfa *auth.MFA, userID int) (bool, error) {
+	enabled, err := mfa.Enabled(r.Context(), userID)
+	if err != nil || enabled {
+		return enabled, err
+	}
+	roles, err := storage.GetUserRoles(r.Context(), db, userID)
+	if err != nil {
+		return false, err
+	}
+	return mfa.Required(roles), nil
+}
+
+// provisionOIDCUser creates an account for the identity, once
+// newIdentityAction allowed it.
+func provisionOIDCUser(r *http.Request, db *sql.DB, identity *oidc.Identity, stored *storage.Identity, l *zap.SugaredLogger) (*storage.LoginUser, int, error) {
+	// The username the provider suggests may be taken by a local account
+	user := &storage.NewUser{
+		Email:    identity.Email,
+		Status:   storage.UserActive,
+		Roles:    identity.Roles,
+		Identity: stored,
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		user.Username = identity.Username
+		if attempt > 1 {
+			user.Username += "-" + strconv.Itoa(attempt)
+		}
+		userID, err := storage.CreateUser(r.Context(), db, user)
+		if errors.Is(err, storage.ErrUserExists) {
+			continue
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		l.Infow("Provisioned user from identity provider", zap.Int("user_id", userID), zap.String("username", user.Username), zap.Strings("roles", user.Roles))
+		return &storage.LoginUser{ID: userID, Username: user.Username, Status: user.Status}, 0, nil
+	}
+	if identity.Email != "" {
+		return nil, http.StatusConflict, errEmailUsed
+	}
+	return nil, http.StatusConflict, storage.ErrUserExists
+}
+
+func oidcErrorMessage(status int, err error) string {
+	switch {
+	case status == http.StatusInternalServerError:
+		return "Server error"
+	case errors.Is(err, errEmailUsed), errors.Is(err, errEmailMFA):
+		return "An account with this email already exists, sign in and link your identity"
+	}
+	return err.Error()
+}
+
+// ListIdentities returns the provider identities linked to the caller.
+func ListIdentities(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		identities, err := storage.ListIdentities(r.Context(), db, principal.UserID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(identities)
+	}
+}
+
+// UnlinkIdentity removes a linked identity of the caller. The last one
+// cannot be removed from an account without a password.
+func UnlinkIdentity(db *sql.DB, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		identityID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid identity id", http.StatusBadRequest)
+			return
+		}
+
+		identities, err := storage.ListIdentities(r.Context(), db, principal.UserID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		passwordHash, err := storage.GetPasswordHash(r.Context(), db, principal.UserID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if len(identities) == 1 && identities[0].ID == identityID && passwordHash == "" {
+			http.Error(w, "Cannot unlink the only way to sign in to this account", http.StatusConflict)
+			return
+		}
+
+		err = storage.UnlinkIdentity(r.Context(), db, principal.UserID, identityID)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Identity not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Unlinked identity", zap.Int("user_id", principal.UserID), zap.Int("identity_id", identityID))
+		auditLog.Record(auditEvent(r, "user.identity.unlink", "user/"+strconv.Itoa(principal.UserID), audit.OutcomeSuccess,
+			map[string]interface{}{"identity_id": identityID}))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/config"
+	"video-platform/uploader/pkg/oidc"
+)
+
+func TestOIDCCallbackState(t *testing.T) {
+	// The state is checked before anything else is used
+	callback := OIDCCallback(nil, nil, nil, nil, nil, &config.ServerConfig{}, nil, zap.NewNop().Sugar())
+	tests := []struct {
+		name   string
+		query  string
+		cookie string
+		want   int
+	}{
+		{name: "provider error", query: "error=access_denied&state=s1", cookie: "s1", want: http.StatusUnauthorized},
+		{name: "no state", query: "code=c", cookie: "s1", want: http.StatusBadRequest},
+		{name: "no cookie", query: "code=c&state=s1", want: http.StatusBadRequest},
+		{name: "state mismatch", query: "code=c&state=s1", cookie: "s2", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+tt.query, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			callback(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewIdentityAction(t *testing.T) {
+	withRoles := &oidc.Identity{Email: "ada@example.com", EmailVerified: true, Roles: []string{"student"}}
+	noRoles := &oidc.Identity{Email: "ada@example.com", EmailVerified: true}
+	tests := []struct {
+		name       string
+		cfg        config.ServerConfig
+		identity   *oidc.Identity
+		emailMatch bool
+		matchMFA   bool
+		wantLink   bool
+		wantStatus int
+		wantErr    error
+	}{
+		{name: "link by email", cfg: config.ServerConfig{OIDCLinkByEmail: true}, identity: withRoles, emailMatch: true, wantLink: true},
+		{name: "account with second factor", cfg: config.ServerConfig{OIDCLinkByEmail: true, OIDCAutoProvision: true}, identity: withRoles,
+			emailMatch: true, matchMFA: true, wantStatus: http.StatusConflict, wantErr: errEmailMFA},
+		{name: "provision", cfg: config.ServerConfig{OIDCAutoProvision: true}, identity: withRoles},
+		{name: "provisioning disabled", identity: withRoles, wantStatus: http.StatusForbidden, wantErr: errNoAccount},
+		{name: "no role", cfg: config.ServerConfig{OIDCAutoProvision: true}, identity: noRoles, wantStatus: http.StatusForbidden, wantErr: errNoRole},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link, status, err := newIdentityAction(&tt.cfg, tt.identity, tt.emailMatch, tt.matchMFA)
+			if link != tt.wantLink || status != tt.wantStatus || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("newIdentityAction() = %v, %d, %v, want %v, %d, %v", link, status, err, tt.wantLink, tt.wantStatus, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLinkByEmail(t *testing.T) {
+	enabled := &config.ServerConfig{OIDCLinkByEmail: true}
+	tests := []struct {
+		name     string
+		cfg      *config.ServerConfig
+		identity *oidc.Identity
+		want     bool
+	}{
+		{name: "verified email", cfg: enabled, identity: &oidc.Identity{Email: "ada@example.com", EmailVerified: true}, want: true},
+		{name: "unverified email", cfg: enabled, identity: &oidc.Identity{Email: "ada@example.com"}},
+		{name: "no email", cfg: enabled, identity: &oidc.Identity{EmailVerified: true}},
+		{name: "disabled", cfg: &config.ServerConfig{}, identity: &oidc.Identity{Email: "ada@example.com", EmailVerified: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := linkByEmail(tt.cfg, tt.identity); got != tt.want {
+				t.Fatalf("linkByEmail() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/policy"
+	"video-platform/uploader/pkg/storage"
+)
+
+func ListDenylist(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := storage.ListDenylist(r.Context(), db)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
+
+// AddDenylistEntry denies a user or client IP one action, or all of them
+// with "*", until the optional expiry.
+func AddDenylistEntry(db *sql.DB, sync *policy.DataSync, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Type      string     `json:"type"`
+			Subject   string     `json:"subject"`
+			Action    string     `json:"action"`
+			Reason    string     `json:"reason"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if req.Action == "" {
+			req.Action = "*"
+		}
+		switch {
+		case req.Type != "user" && req.Type != "ip":
+			http.Error(w, "Type must be user or ip", http.StatusBadRequest)
+			return
+		case req.Subject == "" || req.Reason == "":
+			http.Error(w, "Subject and reason are required", http.StatusBadRequest)
+			return
+		case req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()):
+			http.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+			return
+		}
+
+		entry := &storage.DenylistEntry{
+			SubjectType: req.Type,
+			Subject:     req.Subject,
+			Action:      req.Action,
+			Reason:      req.Reason,
+			ExpiresAt:   req.ExpiresAt,
+		}
+		if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+			entry.CreatedBy = principal.UserID
+		}
+		if err := storage.AddDenylistEntry(r.Context(), db, entry); err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		publish(r.Context(), sync, l)
+
+		l.Infow("Added denylist entry", zap.Int("id", entry.ID), zap.String("type", entry.SubjectType),
+			zap.String("subject", entry.Subject), zap.String("action", entry.Action))
+		auditLog.Record(auditEvent(r, "policy.denylist.add", "denylist/"+strconv.Itoa(entry.ID), audit.OutcomeSuccess,
+			map[string]interface{}{"type": entry.SubjectType, "subject": entry.Subject, "action": entry.Action, "reason": entry.Reason}))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(entry)
+	}
+}
+
+func DeleteDenylistEntry(db *sql.DB, sync *policy.DataSync, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid denylist entry id", http.StatusBadRequest)
+			return
+		}
+
+		err = storage.DeleteDenylistEntry(r.Context(), db, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Denylist entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		publish(r.Context(), sync, l)
+
+		l.Infow("Removed denylist entry", zap.Int("id", id))
+		auditLog.Record(auditEvent(r, "policy.denylist.remove", "denylist/"+strconv.Itoa(id), audit.OutcomeSuccess, nil))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ListSuspensions(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		suspensions, err := storage.ListSuspensions(r.Context(), db)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(suspensions)
+	}
+}
+
+// SuspendUser denies the user every action until the optional end of the
+// suspension. Their sessions stay valid, so lifting it takes effect at once.
+func SuspendUser(db *sql.DB, sync *policy.DataSync, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Reason string     `json:"reason"`
+			Until  *time.Time `json:"until"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if req.Reason == "" {
+			http.Error(w, "Reason is required", http.StatusBadRequest)
+			return
+		}
+		if req.Until != nil && req.Until.Before(time.Now()) {
+			http.Error(w, "End of the suspension must be in the future", http.StatusBadRequest)
+			return
+		}
+
+		suspension := &storage.Suspension{UserID: userID, Reason: req.Reason, SuspendedUntil: req.Until}
+		if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+			suspension.SuspendedBy = principal.UserID
+		}
+		err = storage.SetSuspension(r.Context(), db, suspension)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		publish(r.Context(), sync, l)
+
+		l.Infow("Suspended user", zap.Int("user_id", userID), zap.String("reason", req.Reason))
+		auditLog.Record(auditEvent(r, "user.suspend", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess,
+			map[string]interface{}{"reason": req.Reason, "until": req.Until}))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(suspension)
+	}
+}
+
+func UnsuspendUser(db *sql.DB, sync *policy.DataSync, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		err = storage.DeleteSuspension(r.Context(), db, userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User is not suspended", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		publish(r.Context(), sync, l)
+
+		l.Infow("Lifted user suspension", zap.Int("user_id", userID))
+		auditLog.Record(auditEvent(r, "user.unsuspend", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess, nil))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// SetUploadLimit replaces the role based upload size limit of the user.
+func SetUploadLimit(db *sql.DB, sync *policy.DataSync, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			MaxUploadBytes int64 `json:"max_upload_bytes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if req.MaxUploadBytes <= 0 {
+			http.Error(w, "max_upload_bytes must be positive", http.StatusBadRequest)
+			return
+		}
+
+		var updatedBy int
+		if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+			updatedBy = principal.UserID
+		}
+		err = storage.SetUploadLimit(r.Context(), db, userID, req.MaxUploadBytes, updatedBy)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		publish(r.Context(), sync, l)
+
+		l.Infow("Set user upload limit", zap.Int("user_id", userID), zap.Int64("max_upload_bytes", req.MaxUploadBytes))
+		auditLog.Record(auditEvent(r, "user.upload_limit.set", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess,
+			map[string]interface{}{"max_upload_bytes": req.MaxUploadBytes}))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": userID, "max_upload_bytes": req.MaxUploadBytes})
+	}
+}
+
+func DeleteUploadLimit(db *sql.DB, sync *policy.DataSync, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		err = storage.DeleteUploadLimit(r.Context(), db, userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User has no upload limit", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		publish(r.Context(), sync, l)
+
+		l.Infow("Removed user upload limit", zap.Int("user_id", userID))
+		auditLog.Record(auditEvent(r, "user.upload_limit.remove", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess, nil))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// publish pushes the changed data to the policy. The change is already
+// stored, so a failure only delays it until the next periodic sync.
+func publish(ctx context.Context, sync *policy.DataSync, l *zap.SugaredLogger) {
+	if err := sync.Publish(ctx); err != nil {
+		l.Errorw("Failed to publish policy data, it will be retried", zap.Error(err))
+	}
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/storage"
+)
+
+type usageReport struct {
+	storage.Usage
+	Quota *storage.Quota `json:"quota"`
+	// null when not limited
+	RemainingBytes *int64 `json:"remaining_bytes"`
+	RemainingFiles *int64 `json:"remaining_files"`
+}
+
+func getUsageReport(ctx context.Context, db *sql.DB, userID int) (*usageReport, error) {
+	quota, err := storage.GetQuota(ctx, db, userID)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := storage.GetUsage(ctx, db, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &usageReport{
+		Usage:          usage,
+		Quota:          quota,
+		RemainingBytes: quota.RemainingBytes(usage),
+		RemainingFiles: quota.RemainingFiles(usage),
+	}, nil
+}
+
+// GetMyUsage returns how much the caller stores and their quota.
+func GetMyUsage(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		writeUsageReport(w, r, db, principal.UserID, l)
+	}
+}
+
+func GetUserUsage(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+		writeUsageReport(w, r, db, userID, l)
+	}
+}
+
+func writeUsageReport(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int, l *zap.SugaredLogger) {
+	report, err := getUsageReport(r.Context(), db, userID)
+	if err != nil {
+		l.Error(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// quotaExceeded answers an upload that does not fit the quota of the
+// caller. Files above the single file limit are too large, others do not
+// fit into the remaining storage.
+func quotaExceeded(w http.ResponseWriter, err error) bool {
+	var quotaErr *storage.QuotaError
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+	status := http.StatusInsufficientStorage
+	if quotaErr.Limit == "max_file_bytes" {
+		status = http.StatusRequestEntityTooLarge
+	}
+	http.Error(w, fmt.Sprintf("Storage quota exceeded (%s is %d)", quotaErr.Limit, quotaErr.Max), status)
+	return true
+}
+
+// decodeQuota reads a quota from the request body. Omitted or null limits
+// are unlimited.
+func decodeQuota(w http.ResponseWriter, r *http.Request) (*storage.Quota, bool) {
+	var quota storage.Quota
+	if err := json.NewDecoder(r.Body).Decode(&quota); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return nil, false
+	}
+	quota.Source = ""
+	if err := quota.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &quota, true
+}
+
+func quotaDetails(quota *storage.Quota) map[string]interface{} {
+	return map[string]interface{}{
+		"max_bytes":      quota.MaxBytes,
+		"max_files":      quota.MaxFiles,
+		"max_file_bytes": quota.MaxFileBytes,
+	}
+}
+
+// SetUserQuota replaces the role quotas of the user. Uploads already
+// stored are kept even if they exceed it.
+func SetUserQuota(db *sql.DB, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+		quota, ok := decodeQuota(w, r)
+		if !ok {
+			return
+		}
+
+		var updatedBy int
+		if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+			updatedBy = principal.UserID
+		}
+		err = storage.SetUserQuota(r.Context(), db, userID, quota, updatedBy)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Set user quota", zap.Int("user_id", userID))
+		auditLog.Record(auditEvent(r, "user.quota.set", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess, quotaDetails(quota)))
+		writeUsageReport(w, r, db, userID, l)
+	}
+}
+
+func DeleteUserQuota(db *sql.DB, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		err = storage.DeleteUserQuota(r.Context(), db, userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User has no quota override", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Removed user quota", zap.Int("user_id", userID))
+		auditLog.Record(auditEvent(r, "user.quota.remove", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess, nil))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ListRoleQuotas(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		quotas, err := storage.ListRoleQuotas(r.Context(), db)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(quotas)
+	}
+}
+
+// SetRoleQuota sets the quota of a role. Members with several roles get
+// the most generous limits among them.
+func SetRoleQuota(db *sql.DB, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role := r.PathValue("role")
+		quota, ok := decodeQuota(w, r)
+		if !ok {
+			return
+		}
+
+		var updatedBy int
+		if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+			updatedBy = principal.UserID
+		}
+		err := storage.SetRoleQuota(r.Context(), db, role, quota, updatedBy)
+		if errors.Is(err, storage.ErrUnknownRole) {
+			http.Error(w, "Role not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Set role quota", zap.String("role", role))
+		auditLog.Record(auditEvent(r, "role.quota.set", "role/"+role, audit.OutcomeSuccess, quotaDetails(quota)))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(quota)
+	}
+}
+
+// DeleteRoleQuota removes the quota of a role, so it no longer limits its
+// members.
+func DeleteRoleQuota(db *sql.DB, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role := r.PathValue("role")
+		err := storage.DeleteRoleQuota(r.Context(), db, role)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Role has no quota", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Removed role quota", zap.String("role", role))
+		auditLog.Record(auditEvent(r, "role.quota.remove", "role/"+role, audit.OutcomeSuccess, nil))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
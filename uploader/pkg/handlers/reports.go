@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/storage"
+)
+
+// Longest range of a usage report
+const maxReportDays = 366
+
+// UsageReport returns what users transferred between the days from and to
+// (YYYY-MM-DD, both included, the last 30 days by default), summed per user
+// or per user and day with group=day. It is CSV with format=csv or an
+// Accept of text/csv, JSON otherwise.
+func UsageReport(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		to := time.Now().UTC().Truncate(24 * time.Hour)
+		if s := q.Get("to"); s != "" {
+			t, err := time.Parse(time.DateOnly, s)
+			if err != nil {
+				http.Error(w, "Invalid to, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			to = t
+		}
+		from := to.AddDate(0, 0, -29)
+		if s := q.Get("from"); s != "" {
+			t, err := time.Parse(time.DateOnly, s)
+			if err != nil {
+				http.Error(w, "Invalid from, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			from = t
+		}
+		if from.After(to) || to.Sub(from) >= maxReportDays*24*time.Hour {
+			http.Error(w, "from must not be after to, nor more than a year before it", http.StatusBadRequest)
+			return
+		}
+		var userID int
+		if s := q.Get("user_id"); s != "" {
+			id, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, "Invalid user id", http.StatusBadRequest)
+				return
+			}
+			userID = id
+		}
+		asCSV := q.Get("format") == "csv" || (q.Get("format") == "" && strings.Contains(r.Header.Get("Accept"), "text/csv"))
+
+		var header []string
+		var records [][]string
+		var report interface{}
+		switch q.Get("group") {
+		case "", "user":
+			rows, err := storage.UsageReport(r.Context(), db, from, to, userID)
+			if err != nil {
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			report = rows
+			header = []string{"user_id", "username", "ingress_bytes", "egress_bytes", "backup_bytes", "uploads", "downloads", "stored_bytes", "stored_files"}
+			for _, u := range rows {
+				records = append(records, []string{strconv.Itoa(u.UserID), u.Username, itoa(u.IngressBytes), itoa(u.EgressBytes),
+					itoa(u.BackupBytes), itoa(u.Uploads), itoa(u.Downloads), itoa(u.StoredBytes), itoa(u.StoredFiles)})
+			}
+		case "day":
+			rows, err := storage.DailyUsageReport(r.Context(), db, from, to, userID)
+			if err != nil {
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			report = rows
+			header = []string{"day", "user_id", "username", "ingress_bytes", "egress_bytes", "backup_bytes", "uploads", "downloads"}
+			for _, u := range rows {
+				records = append(records, []string{u.Day.Format(time.DateOnly), strconv.Itoa(u.UserID), u.Username, itoa(u.IngressBytes),
+					itoa(u.EgressBytes), itoa(u.BackupBytes), itoa(u.Uploads), itoa(u.Downloads)})
+			}
+		default:
+			http.Error(w, "group must be user or day", http.StatusBadRequest)
+			return
+		}
+
+		if asCSV {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", "attachment; filename=\"usage-"+from.Format(time.DateOnly)+"-"+to.Format(time.DateOnly)+".csv\"")
+			cw := csv.NewWriter(w)
+			cw.Write(header)
+			cw.WriteAll(records)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"from":  from.Format(time.DateOnly),
+			"to":    to.Format(time.DateOnly),
+			"usage": report,
+		})
+	}
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
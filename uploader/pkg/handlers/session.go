@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/storage"
+)
+
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// startSession begins a new refresh token family for the user and returns
+// the first token pair.
+func startSession(ctx context.Context, db *sql.DB, tokens *auth.TokenService, username string, userID int) (*tokenResponse, error) {
+	sessionID, err := auth.NewSessionID()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, refreshHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	err = storage.StoreRefreshToken(ctx, db, userID, sessionID, refreshHash, time.Now().Add(tokens.RefreshTTL()))
+	if err != nil {
+		return nil, err
+	}
+	roles, err := storage.GetUserRoles(ctx, db, userID)
+	if err != nil {
+		return nil, err
+	}
+	token, err := tokens.GenerateJWT(username, userID, roles, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenResponse{Token: token, RefreshToken: refreshToken, ExpiresIn: int(tokens.TTL().Seconds())}, nil
+}
+
+func RefreshToken(db *sql.DB, tokens *auth.TokenService, revoker *auth.Revoker, mfa *auth.MFA, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		refreshToken, refreshHash, err := auth.NewOpaqueToken()
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		session, err := storage.RotateRefreshToken(r.Context(), db, auth.HashToken(req.RefreshToken), refreshHash, time.Now().Add(tokens.RefreshTTL()))
+		switch {
+		case errors.Is(err, storage.ErrRefreshTokenReused):
+			// Someone replayed a rotated token, so the whole family is
+			// compromised. Its access tokens are revoked along with it.
+			l.Warnw("Refresh token reuse detected, revoking session", zap.Int("user_id", session.UserID))
+			if err := revoker.Revoke(r.Context(), session.FamilyID, time.Now().Add(tokens.TTL())); err != nil {
+				l.Error(err)
+			}
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		case errors.Is(err, storage.ErrRefreshTokenInvalid):
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		case err != nil:
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		// Roles are read again so that role changes apply on the next refresh
+		roles, err := storage.GetUserRoles(r.Context(), db, session.UserID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		// A session started before the user got a role that requires MFA
+		// ends here, so they enroll on the next login
+		if mfa.Required(roles) {
+			enabled, err := mfa.Enabled(r.Context(), session.UserID)
+			if err != nil {
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			if !enabled {
+				http.Error(w, "MFA enrollment required, sign in again", http.StatusUnauthorized)
+				return
+			}
+		}
+		token, err := tokens.GenerateJWT(session.Username, session.UserID, roles, session.FamilyID)
+		if err != nil {
+			http.Error(w, "Error generating token", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(tokenResponse{Token: token, RefreshToken: refreshToken, ExpiresIn: int(tokens.TTL().Seconds())})
+	}
+}
+
+func Logout(db *sql.DB, tokens *auth.TokenService, revoker *auth.Revoker, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := auth.ClaimsFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err := revoker.Revoke(r.Context(), claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if claims.SessionID != "" {
+			if err := storage.RevokeSessionFamily(r.Context(), db, claims.SessionID); err != nil {
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			if err := revoker.Revoke(r.Context(), claims.SessionID, time.Now().Add(tokens.TTL())); err != nil {
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		l.Infow("User logged out", zap.String("username", claims.Username))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RevokeUserSessions lets an admin sign a user out everywhere, which also
+// revokes their personal access tokens.
+func RevokeUserSessions(revoker *auth.Revoker, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		if err := revoker.RevokeUser(r.Context(), userID); err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "User not found", http.StatusNotFound)
+			} else {
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		l.Infow("Revoked all sessions", zap.Int("user_id", userID))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
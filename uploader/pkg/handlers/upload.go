@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/minio/minio-go/v7"
 	"go.opentelemetry.io/otel"
@@ -9,21 +11,41 @@ import (
 	"go.uber.org/zap"
 	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"video-platform/uploader/pkg/auth"
 	"video-platform/uploader/pkg/config"
+	"video-platform/uploader/pkg/holds"
+	"video-platform/uploader/pkg/metering"
 	"video-platform/uploader/pkg/monitoring"
 	"video-platform/uploader/pkg/process"
 	"video-platform/uploader/pkg/queue"
 	"video-platform/uploader/pkg/storage"
 )
 
+// Limits of the tags lifecycle policies can match, see parseTags
+const (
+	maxTags      = 16
+	maxTagLength = 64
+)
+
+// Allowance for multipart framing and other form fields when the quota is
+// checked against Content-Length
+const multipartOverhead = 64 << 10
+
 func UploadFileHandler(config *config.ServerConfig, db *sql.DB, minioClient *minio.Client,
-	l *zap.SugaredLogger) http.HandlerFunc {
+	publisher *queue.Publisher, authorizer auth.Authorizer, fileHolds *holds.Holds, meter *metering.Meter, l *zap.SugaredLogger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, span := otel.Tracer("uploader").Start(r.Context(), "HandleUpload")
 		defer span.End()
 
-		username := r.Context().Value("username").(string)
-		userID := r.Context().Value("id").(int)
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		username, userID := principal.Username, principal.UserID
 
 		span.SetAttributes(
 			attribute.String("username", username),
@@ -36,13 +58,90 @@ func UploadFileHandler(config *config.ServerConfig, db *sql.DB, minioClient *min
 			return
 		}
 
-		// Parse the multipart form
-		r.ParseMultipartForm(10 << 20) // Limit upload size
+		// The policy may lower the size limit for this caller
+		maxUploadBytes := config.MaxUploadBytes
+		if decision, ok := auth.DecisionFromContext(r.Context()); ok {
+			if limit := decision.Obligations.MaxUploadBytes; limit > 0 && limit < maxUploadBytes {
+				maxUploadBytes = limit
+			}
+		}
+
+		// Check the quota before accepting the body, with the exact file size
+		// if the client declared it in Upload-Length. Whether the upload is a
+		// new file or a new version is only known from its name.
+		quota, err := storage.GetQuota(ctx, db, userID)
+		if err != nil {
+			l.Errorw("Could not get quota", zap.Int("user_id", userID), zap.Error(err))
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		usage, err := storage.GetUsage(ctx, db, userID)
+		if err != nil {
+			l.Errorw("Could not get usage", zap.Int("user_id", userID), zap.Error(err))
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if quotaExceeded(w, quota.CheckVersion(usage, declaredUploadSize(r))) {
+			l.Infow("Upload exceeds quota", zap.Int("user_id", userID))
+			return
+		}
+		quotaLimit := int64(-1)
+		if remaining := quota.RemainingBytes(usage); remaining != nil {
+			quotaLimit = *remaining
+		}
+		if quota.MaxFileBytes != nil && (quotaLimit < 0 || *quota.MaxFileBytes < quotaLimit) {
+			quotaLimit = *quota.MaxFileBytes
+		}
+		limitedByQuota := quotaLimit >= 0 && quotaLimit+multipartOverhead < maxUploadBytes
+		if limitedByQuota {
+			maxUploadBytes = quotaLimit + multipartOverhead
+		}
+
+		// Parse the multipart form, rejecting bodies above the limit. The
+		// Content-Digest of the request covers the whole body as sent.
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+		var content *process.Hasher
+		if r.Header.Get("Content-Digest") != "" {
+			content = process.NewHasher()
+			r.Body = teeBody{Reader: io.TeeReader(r.Body, content), Closer: r.Body}
+		}
+		err = r.ParseMultipartForm(10 << 20)
+		if err == nil && content != nil {
+			// The multipart reader may stop before the end of the body
+			_, err = io.Copy(io.Discard, r.Body)
+		}
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				l.Infow("Upload exceeds size limit", zap.Int64("limit", maxBytesErr.Limit), zap.Bool("quota", limitedByQuota))
+				if limitedByQuota {
+					http.Error(w, "Storage quota exceeded", http.StatusInsufficientStorage)
+					return
+				}
+				http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			l.Errorw("Could not parse the multipart form", zap.Error(err))
+			http.Error(w, "Error parsing file", http.StatusBadRequest)
+			return
+		}
+
+		if content != nil {
+			if err := process.VerifyContentDigest(r.Header, content.Checksums()); err != nil {
+				rejectDigest(w, err, l)
+				return
+			}
+		}
+
+		tags, ok := parseTags(r.FormValue("tags"))
+		if !ok {
+			http.Error(w, fmt.Sprintf("At most %d tags of up to %d characters are allowed", maxTags, maxTagLength), http.StatusBadRequest)
+			return
+		}
 
 		file, handler, err := r.FormFile(config.VideoFormFilename)
 		if err != nil {
-			l.Errorw("Could not parse the multipart file",
-				zap.String("filename", handler.Filename), zap.Error(err))
+			l.Errorw("Could not parse the multipart file", zap.Error(err))
 			http.Error(w, "Error parsing file", http.StatusBadRequest)
 			return
 		}
@@ -52,45 +151,220 @@ func UploadFileHandler(config *config.ServerConfig, db *sql.DB, minioClient *min
 		fileSize := handler.Size
 		contentType := handler.Header.Get("Content-Type")
 
+		// Authorize the upload now that the file itself is known
+		decision, err := authorizer.Authorize(ctx, auth.NewInput(r, auth.ActionFileUpload, &auth.Resource{
+			Type:        "file",
+			OwnerID:     userID,
+			Name:        handler.Filename,
+			Size:        fileSize,
+			ContentType: contentType,
+		}))
+		if err != nil {
+			l.Errorw("Could not check upload policy", zap.String("filename", handler.Filename), zap.Error(err))
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !decision.Allow {
+			l.Infow("Upload denied by policy", zap.String("filename", handler.Filename), zap.Strings("reasons", decision.Reasons))
+			auth.Deny(w, decision)
+			return
+		}
+		if limit := decision.Obligations.MaxUploadBytes; limit > 0 && fileSize > limit {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// Uploading a file with the name of a stored one adds a version
+		existingID, err := storage.ActiveFileID(ctx, db, userID, handler.Filename)
+		if err != nil {
+			l.Errorw("Could not look up file", zap.String("filename", handler.Filename), zap.Error(err))
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		check := quota.Check
+		if existingID != 0 {
+			check = quota.CheckVersion
+		}
+		if quotaExceeded(w, check(usage, fileSize)) {
+			l.Infow("Upload exceeds quota", zap.Int("user_id", userID), zap.Int64("filesize", fileSize))
+			return
+		}
+
 		// Create a new reader to compute the checksum and upload the file
 		file.Seek(0, io.SeekStart)
-		_, sha256Checksum, err := process.ComputeChecksum(ctx, file)
+		checksums, err := process.ComputeChecksum(ctx, file)
 		if err != nil {
 			l.Errorw("Could not compute checksum", zap.String("filename", handler.Filename), zap.Error(err))
 			http.Error(w, "Error computing checksum", http.StatusInternalServerError)
 			return
 		}
+		sha256Checksum := checksums.SHA256
 
-		// Upload the file to MinIO
-		file.Seek(0, io.SeekStart)
-		l.Infow("Uploading file", zap.String("bucketname", config.MinioBucket),
-			zap.String("filename", handler.Filename))
-		info, err := minioClient.PutObject(ctx, config.MinioBucket, handler.Filename, file, fileSize, minio.PutObjectOptions{ContentType: contentType})
-		if err != nil {
-			l.Errorw("Could not upload file", zap.String("bucketname", config.MinioBucket),
-				zap.String("filename", handler.Filename), zap.Error(err))
+		// Repr-Digest and Content-MD5 describe the file itself
+		if err := process.VerifyReprDigest(r.Header, checksums); err != nil {
+			rejectDigest(w, err, l)
+			return
+		}
+
+		// Content is stored once under a key derived from its checksum, so
+		// uploading stored content only adds metadata
+		objectKey := storage.BlobKey(sha256Checksum)
+		stored, err := minioClient.StatObject(ctx, config.MinioBucket, objectKey, minio.StatObjectOptions{})
+		deduplicated := err == nil
+		if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			l.Errorw("Could not check for stored content", zap.String("bucketname", config.MinioBucket),
+				zap.String("object_key", objectKey), zap.Error(err))
 			http.Error(w, "Error uploading file", http.StatusInternalServerError)
 			return
 		}
+		etag := stored.ETag
+		if !deduplicated {
+			// Upload the file to MinIO
+			l.Infow("Uploading file", zap.String("bucketname", config.MinioBucket),
+				zap.String("filename", handler.Filename), zap.String("object_key", objectKey))
+			etag, err = putObject(ctx, minioClient, config.MinioBucket, objectKey, file, fileSize, contentType)
+			if err != nil {
+				l.Errorw("Could not upload file", zap.String("bucketname", config.MinioBucket),
+					zap.String("filename", handler.Filename), zap.Error(err))
+				http.Error(w, "Error uploading file", http.StatusInternalServerError)
+				return
+			}
+		} else {
+			l.Infow("Content already stored, adding metadata only", zap.String("filename", handler.Filename),
+				zap.String("object_key", objectKey))
+			monitoring.DeduplicatedUploads.Inc()
+		}
 
 		// Increment the Prometheus counter
 		monitoring.FileUploadCount.Inc()
 
-		// Get the file URL and ETag
-		fileURL := fmt.Sprintf("http://%s/%s/%s", config.MinioHost, config.MinioBucket, handler.Filename)
-		etag := info.ETag
+		// Get the file URL
+		fileURL := fmt.Sprintf("http://%s/%s/%s", config.MinioHost, config.MinioBucket, objectKey)
 
 		// Store metadata in PostgreSQL
-		err = storage.StoreFileMetadata(ctx, db, handler.Filename, fileSize, contentType, etag, fileURL, sha256Checksum, userID)
+		// The quota is checked again with the uploads that finished meanwhile.
+		// The object is stored again if it was removed since it was found.
+		version, err := storage.StoreFileMetadata(ctx, db, handler.Filename, objectKey, fileSize, contentType, etag, fileURL, sha256Checksum, userID, tags,
+			func() error {
+				return ensureObject(ctx, minioClient, config.MinioBucket, objectKey, file, fileSize, contentType)
+			})
+		var quotaErr *storage.QuotaError
+		if errors.As(err, &quotaErr) {
+			l.Infow("Upload exceeds quota at commit", zap.Int("user_id", userID), zap.String("filename", handler.Filename))
+			if !deduplicated {
+				removeUnreferenced(ctx, db, minioClient, config.MinioBucket, objectKey, l)
+			}
+			quotaExceeded(w, err)
+			return
+		}
 		if err != nil {
 			l.Errorw("Could not store file metadata", zap.String("filename", handler.Filename), zap.Error(err))
+			if !deduplicated {
+				removeUnreferenced(ctx, db, minioClient, config.MinioBucket, objectKey, l)
+			}
 			http.Error(w, "Error storing file metadata", http.StatusInternalServerError)
 			return
 		}
 
+		// The object is held if it is a new version of a held file, or was
+		// stored again for held files with the same content
+		if err := fileHolds.ApplyToObject(ctx, objectKey); err != nil {
+			l.Errorw("Could not apply holds to upload", zap.String("object_key", objectKey), zap.Error(err))
+		}
+
+		meter.Upload(userID, fileSize)
+
 		l.Infow("Successfully uploaded file", zap.String("bucketname", config.MinioBucket),
-			zap.String("filename", handler.Filename), zap.String("username", username))
-		fmt.Fprintf(w, "Successfully uploaded %s\n", handler.Filename)
-		queue.PublishMessage(ctx, config.MinioBucket, handler.Filename)
+			zap.String("filename", handler.Filename), zap.Int("version", version), zap.String("username", username))
+		if version > 1 {
+			fmt.Fprintf(w, "Successfully uploaded %s as version %d\n", handler.Filename, version)
+		} else {
+			fmt.Fprintf(w, "Successfully uploaded %s\n", handler.Filename)
+		}
+		publisher.PublishMessage(ctx, config.MinioBucket, objectKey)
+	}
+}
+
+// teeBody is a request body that is also copied elsewhere as it is read.
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// rejectDigest answers an upload whose digest headers are invalid or do not
+// match what was received.
+func rejectDigest(w http.ResponseWriter, err error, l *zap.SugaredLogger) {
+	l.Infow("Upload digest rejected", zap.Error(err))
+	w.Header().Set("Want-Content-Digest", process.WantDigest)
+	w.Header().Set("Want-Repr-Digest", process.WantDigest)
+	if errors.Is(err, process.ErrDigestMismatch) {
+		http.Error(w, "Digest does not match the uploaded content", http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Invalid digest header", http.StatusBadRequest)
+}
+
+// putObject stores the whole file under the key and returns its ETag.
+func putObject(ctx context.Context, minioClient *minio.Client, bucket, key string, file io.ReadSeeker, size int64, contentType string) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	info, err := minioClient.PutObject(ctx, bucket, key, file, size, minio.PutObjectOptions{ContentType: contentType})
+	return info.ETag, err
+}
+
+// ensureObject stores the file under the key if it is not stored.
+func ensureObject(ctx context.Context, minioClient *minio.Client, bucket, key string, file io.ReadSeeker, size int64, contentType string) error {
+	_, err := minioClient.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		_, err = putObject(ctx, minioClient, bucket, key, file, size, contentType)
+	}
+	return err
+}
+
+// removeUnreferenced removes an object stored for an upload that was not
+// recorded, unless an upload of the same content recorded it meanwhile.
+func removeUnreferenced(ctx context.Context, db *sql.DB, minioClient *minio.Client, bucket, key string, l *zap.SugaredLogger) {
+	if err := storage.DropBlob(ctx, db, key, removeObjects(ctx, minioClient, []string{bucket})); err != nil {
+		l.Errorw("Could not remove rejected upload", zap.String("object_key", key), zap.Error(err))
+	}
+}
+
+// removeObjects returns a function that removes an object from the buckets,
+// for storage.DropBlob.
+func removeObjects(ctx context.Context, minioClient *minio.Client, buckets []string) func(key string) error {
+	return func(key string) error {
+		for _, bucket := range buckets {
+			if err := minioClient.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// declaredUploadSize returns the file size from Upload-Length, or estimates
+// it from Content-Length, or 0 if neither is known.
+func declaredUploadSize(r *http.Request) int64 {
+	if size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64); err == nil && size >= 0 {
+		return size
+	}
+	return max(0, r.ContentLength-multipartOverhead)
+}
+
+// parseTags splits a comma separated list of tags, lowercased and without
+// duplicates. It reports false if there are too many or too long ones.
+func parseTags(s string) ([]string, bool) {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || slices.Contains(tags, tag) {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, false
+		}
+		tags = append(tags, tag)
 	}
+	return tags, len(tags) <= maxTags
 }
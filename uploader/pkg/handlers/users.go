@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/storage"
+)
+
+// SetUserRoles replaces the roles of a user. They are embedded in the next
+// access token the user receives.
+func SetUserRoles(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Roles []string `json:"roles"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		roles := uniqueStrings(req.Roles)
+
+		err = storage.SetUserRoles(r.Context(), db, userID, roles)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		case errors.Is(err, storage.ErrUnknownRole):
+			http.Error(w, "Unknown role", http.StatusBadRequest)
+			return
+		case err != nil:
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Updated user roles", zap.Int("user_id", userID), zap.Strings("roles", roles))
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": userID, "roles": roles})
+	}
+}
+
+func ListUsers(db *sql.DB, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, err := storage.ListUsers(r.Context(), db)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+	}
+}
+
+// CreateUser creates an active account with the given roles, bypassing the
+// registration mode.
+func CreateUser(db *sql.DB, passwords *auth.Passwords, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Username string   `json:"username"`
+			Email    string   `json:"email"`
+			Password string   `json:"password"`
+			Roles    []string `json:"roles"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if err := validateAccount(passwords, req.Username, req.Email, req.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		roles := uniqueStrings(req.Roles)
+
+		hash, err := passwords.Hash(req.Password)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		userID, err := storage.CreateUser(r.Context(), db, &storage.NewUser{
+			Username:     req.Username,
+			Email:        req.Email,
+			PasswordHash: hash,
+			Status:       storage.UserActive,
+			Roles:        roles,
+		})
+		switch {
+		case errors.Is(err, storage.ErrUserExists):
+			http.Error(w, "Username or email is already taken", http.StatusConflict)
+			return
+		case errors.Is(err, storage.ErrUnknownRole):
+			http.Error(w, "Unknown role", http.StatusBadRequest)
+			return
+		case err != nil:
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Created user", zap.Int("user_id", userID), zap.String("username", req.Username), zap.Strings("roles", roles))
+		auditLog.Record(auditEvent(r, "user.create", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess,
+			map[string]interface{}{"username": req.Username, "roles": roles}))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": userID, "username": req.Username, "roles": roles})
+	}
+}
+
+// SetUserStatus enables or disables an account. Disabling also signs the
+// user out everywhere; enabling is how pending registrations are approved.
+func SetUserStatus(db *sql.DB, revoker *auth.Revoker, status string, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+		if principal, ok := auth.PrincipalFromContext(r.Context()); ok && principal.UserID == userID && status != storage.UserActive {
+			http.Error(w, "You cannot disable your own account", http.StatusConflict)
+			return
+		}
+
+		err = storage.SetUserStatus(r.Context(), db, userID, status)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if status == storage.UserDisabled {
+			if err := revoker.RevokeUser(r.Context(), userID); err != nil {
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		l.Infow("Changed user status", zap.Int("user_id", userID), zap.String("status", status))
+		auditLog.Record(auditEvent(r, "user.status.update", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess,
+			map[string]interface{}{"status": status}))
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": userID, "status": status})
+	}
+}
+
+// DeleteUser removes a user. What happens to their files is chosen with
+// ?files=purge, which deletes the objects from both buckets, or
+// ?files=transfer&to=<user id>, which hands them to another user. Users
+// that own files cannot be deleted without one of the two.
+func DeleteUser(db *sql.DB, minioClient *minio.Client, buckets []string, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+		if principal, ok := auth.PrincipalFromContext(r.Context()); ok && principal.UserID == userID {
+			http.Error(w, "You cannot delete your own account", http.StatusConflict)
+			return
+		}
+
+		mode := r.URL.Query().Get("files")
+		var transferTo int
+		switch mode {
+		case "", "purge":
+		case "transfer":
+			transferTo, err = strconv.Atoi(r.URL.Query().Get("to"))
+			if err != nil || transferTo == userID {
+				http.Error(w, "Invalid transfer target", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "files must be purge or transfer", http.StatusBadRequest)
+			return
+		}
+
+		files, err := storage.ListUserFiles(r.Context(), db, userID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if len(files) > 0 && mode == "" {
+			http.Error(w, "User owns files, choose ?files=purge or ?files=transfer&to=<id>", http.StatusConflict)
+			return
+		}
+
+		affected, keys, err := storage.DeleteUser(r.Context(), db, userID, transferTo)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ErrFilesHeld) {
+			http.Error(w, "User owns files under a legal hold or retention, transfer them instead", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		// The rows are gone, so failures leave orphaned objects behind.
+		// Content other users uploaded too is not among the keys.
+		for _, key := range keys {
+			if err := storage.DropBlob(r.Context(), db, key, removeObjects(r.Context(), minioClient, buckets)); err != nil {
+				l.Errorw("Failed to remove object", zap.String("object_key", key), zap.Error(err))
+			}
+		}
+
+		l.Infow("Deleted user", zap.Int("user_id", userID), zap.String("files", mode), zap.Int64("affected_files", affected))
+		auditLog.Record(auditEvent(r, "user.delete", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess,
+			map[string]interface{}{"files": mode, "transfer_to": transferTo, "affected_files": affected}))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ResetPassword sets a new password for a user and signs them out. Without
+// a password in the body a random one is generated and returned once.
+func ResetPassword(db *sql.DB, revoker *auth.Revoker, passwords *auth.Passwords, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Password string `json:"password"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request payload", http.StatusBadRequest)
+				return
+			}
+		}
+		generated := req.Password == ""
+		if generated {
+			if req.Password, err = auth.NewPassword(); err != nil {
+				l.Error(err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+		} else if err := passwords.Validate(req.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hash, err := passwords.Hash(req.Password)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		err = storage.SetPassword(r.Context(), db, userID, hash)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if err := revoker.RevokeUser(r.Context(), userID); err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Reset user password", zap.Int("user_id", userID))
+		auditLog.Record(auditEvent(r, "user.password.reset", "user/"+strconv.Itoa(userID), audit.OutcomeSuccess,
+			map[string]interface{}{"generated": generated}))
+		resp := map[string]interface{}{"id": userID}
+		if generated {
+			resp["password"] = req.Password
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// CreateInvite issues a single-use registration code for a role, optionally
+// bound to an email address. Only its hash is stored.
+func CreateInvite(db *sql.DB, defaultRole string, ttl time.Duration, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Email string `json:"email"`
+			Role  string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = defaultRole
+		}
+
+		code, codeHash, err := auth.NewOpaqueToken()
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		var createdBy int
+		if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+			createdBy = principal.UserID
+		}
+		expiresAt := time.Now().Add(ttl)
+		id, err := storage.CreateInvite(r.Context(), db, codeHash, req.Email, req.Role, createdBy, expiresAt)
+		if errors.Is(err, storage.ErrUnknownRole) {
+			http.Error(w, "Unknown role", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Created invite", zap.Int("id", id), zap.String("role", req.Role))
+		auditLog.Record(auditEvent(r, "user.invite.create", "invite/"+strconv.Itoa(id), audit.OutcomeSuccess,
+			map[string]interface{}{"email": req.Email, "role": req.Role}))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "code": code, "role": req.Role, "expires_at": expiresAt})
+	}
+}
+
+func uniqueStrings(in []string) []string {
+	seen := make(map[string]bool, len(in))
+	out := []string{}
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/audit"
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/holds"
+	"video-platform/uploader/pkg/metering"
+	"video-platform/uploader/pkg/storage"
+	"video-platform/uploader/pkg/tiering"
+)
+
+// ListVersions returns the versions of a file, newest first.
+func ListVersions(db *sql.DB, authorizer auth.Authorizer, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := authorizeFileRead(w, r, db, authorizer, auth.ActionFileVersionList, l)
+		if !ok {
+			return
+		}
+		versions, err := storage.ListVersions(r.Context(), db, f.ID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+	}
+}
+
+// DownloadVersion sends a version of an active file, or the ranges of it
+// the client asks for. The current version is rehydrated like in
+// DownloadFile if it is archived, older ones have to be promoted first.
+func DownloadVersion(db *sql.DB, minioClient *minio.Client, bucketName string, authorizer auth.Authorizer, meter *metering.Meter,
+	tiers *tiering.Tiering, retryAfter time.Duration, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		f, v, ok := lookupVersion(w, r, db, l)
+		if !ok {
+			return
+		}
+		if f.Status != storage.FileActive {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		decision, err := authorizer.Authorize(r.Context(), auth.NewInput(r, auth.ActionFileDownload, &auth.Resource{
+			Type:        "file",
+			ID:          f.ID,
+			OwnerID:     f.UserID,
+			Name:        f.Filename,
+			Size:        v.Filesize,
+			ContentType: v.ContentType,
+		}))
+		if err != nil {
+			l.Errorf("error checking policy: %v", err)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !decision.Allow {
+			auth.Deny(w, decision)
+			return
+		}
+
+		if v.Current && f.Tier != storage.TierHot {
+			rehydrateFile(w, r, db, tiers, f.ID, principal.UserID, retryAfter, l)
+			return
+		}
+		if v.Archived {
+			http.Error(w, "Version is archived, promote it to restore it", http.StatusConflict)
+			return
+		}
+		serveObject(w, r, minioClient, bucketName, v.ObjectKey, f.Filename, v.ContentType, v.Checksum, meter, principal.UserID, l)
+	}
+}
+
+// PromoteVersion makes an older version of a file its current one. Archived
+// versions are rehydrated on the next download.
+func PromoteVersion(db *sql.DB, authorizer auth.Authorizer, fileHolds *holds.Holds, auditLog *audit.Logger, l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := authorizeFileChange(w, r, db, authorizer, auth.ActionFileVersionPromote, l)
+		if !ok {
+			return
+		}
+		version, err := strconv.Atoi(r.PathValue("version"))
+		if err != nil {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case f.Status != storage.FileActive:
+			http.Error(w, "File is in the trash", http.StatusConflict)
+			return
+		case f.Tier == storage.TierRehydrating:
+			http.Error(w, "File is being restored from the archive, try again later", http.StatusConflict)
+			return
+		}
+		v, err := storage.GetVersion(r.Context(), db, f.ID, version)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Version not found", http.StatusNotFound)
+				return
+			}
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		details := map[string]interface{}{"filename": f.Filename, "owner_id": f.UserID, "version": version, "previous": f.Version}
+		err = storage.PromoteVersion(r.Context(), db, f.ID, version)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Trashed, rehydrating or the version expired meanwhile
+			http.Error(w, "File changed, try again", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if err := fileHolds.ApplyToObject(r.Context(), v.ObjectKey); err != nil {
+			l.Errorw("Could not apply holds to promoted version", zap.String("object_key", v.ObjectKey), zap.Error(err))
+		}
+		promoted, err := storage.GetFile(r.Context(), db, f.ID)
+		if err != nil {
+			l.Error(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		l.Infow("Promoted file version", zap.Int("file_id", f.ID), zap.Int("version", version), zap.Int("previous", f.Version))
+		auditLog.Record(auditEvent(r, auth.ActionFileVersionPromote, "file/"+strconv.Itoa(f.ID), audit.OutcomeSuccess, details))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(promoted)
+	}
+}
+
+// authorizeFileRead looks up the file in the path and checks that the
+// caller may perform the action on it. Files of other users are reported
+// as not found unless the caller may read any file.
+func authorizeFileRead(w http.ResponseWriter, r *http.Request, db *sql.DB, authorizer auth.Authorizer, action string, l *zap.SugaredLogger) (*storage.File, bool) {
+	f, ok := lookupReadableFile(w, r, db, l)
+	if !ok {
+		return nil, false
+	}
+	decision, err := authorizer.Authorize(r.Context(), auth.NewInput(r, action, &auth.Resource{
+		Type:        "file",
+		ID:          f.ID,
+		OwnerID:     f.UserID,
+		Name:        f.Filename,
+		Size:        f.Filesize,
+		ContentType: f.ContentType,
+	}))
+	if err != nil {
+		l.Errorf("error checking policy: %v", err)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if !decision.Allow {
+		auth.Deny(w, decision)
+		return nil, false
+	}
+	return f, true
+}
+
+// lookupReadableFile returns the file in the path if the caller owns it or
+// may read any file.
+func lookupReadableFile(w http.ResponseWriter, r *http.Request, db *sql.DB, l *zap.SugaredLogger) (*storage.File, bool) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid file id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	f, err := storage.GetFile(r.Context(), db, id)
+	if err == nil && f.UserID != principal.UserID && !principal.Can(auth.PermFilesReadAny) {
+		err = sql.ErrNoRows
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		l.Error(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return f, true
+}
+
+// lookupVersion returns the readable file in the path and its version.
+func lookupVersion(w http.ResponseWriter, r *http.Request, db *sql.DB, l *zap.SugaredLogger) (*storage.File, *storage.FileVersion, bool) {
+	f, ok := lookupReadableFile(w, r, db, l)
+	if !ok {
+		return nil, nil, false
+	}
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	v, err := storage.GetVersion(r.Context(), db, f.ID, version)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if err != nil {
+		l.Error(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return f, v, true
+}
@@ -0,0 +1,55 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/nats-io/nats.go"
+)
+
+func PostgresCheck(db *sql.DB) Check {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+func BucketCheck(minioClient *minio.Client, bucket string) Check {
+	return func(ctx context.Context) error {
+		exists, err := minioClient.BucketExists(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("bucket %q does not exist", bucket)
+		}
+		return nil
+	}
+}
+
+func StreamCheck(js nats.JetStreamContext, stream string) Check {
+	return func(ctx context.Context) error {
+		_, err := js.StreamInfo(stream, nats.Context(ctx))
+		return err
+	}
+}
+
+func HTTPCheck(url string) Check {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,117 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Check reports whether a single dependency is usable.
+type Check func(ctx context.Context) error
+
+type Result struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status       string            `json:"status"`
+	Dependencies map[string]Result `json:"dependencies"`
+}
+
+// Checker runs the registered dependency checks concurrently. A failing
+// dependency only marks the service as not ready; it never stops the process.
+type Checker struct {
+	mu           sync.RWMutex
+	checks       map[string]Check
+	timeout      time.Duration
+	shuttingDown atomic.Bool
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		checks:  make(map[string]Check),
+		timeout: timeout,
+	}
+}
+
+func (c *Checker) Register(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// SetShuttingDown makes readiness fail so that load balancers stop routing
+// new work while in-flight requests are drained.
+func (c *Checker) SetShuttingDown() {
+	c.shuttingDown.Store(true)
+}
+
+func (c *Checker) Run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	report := Report{Status: StatusUp, Dependencies: make(map[string]Result, len(c.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range c.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			start := time.Now()
+			err := check(ctx)
+			result := Result{Status: StatusUp, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				result.Status = StatusDown
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Dependencies[name] = result
+			if err != nil {
+				report.Status = StatusDown
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return report
+}
+
+// LivenessHandler only reports that the process is able to serve requests.
+func LivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": StatusUp})
+	}
+}
+
+func (c *Checker) ReadinessHandler(l *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := c.Run(r.Context())
+		if c.shuttingDown.Load() {
+			report.Status = "shutting_down"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != StatusUp {
+			l.Warnw("Service not ready", zap.Any("report", report))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
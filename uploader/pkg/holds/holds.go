@@ -0,0 +1,206 @@
+package holds
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/queue"
+	"video-platform/uploader/pkg/storage"
+)
+
+// ErrRetentionLocked is returned when shortening or removing a retention
+// that buckets locked in compliance mode enforce.
+var ErrRetentionLocked = errors.New("retention cannot be shortened in compliance mode")
+
+// Holds places legal holds and retention on files. They are recorded in
+// files, which the delete paths check, and applied to the objects in
+// buckets created with object locking, so they also bind direct bucket
+// access.
+type Holds struct {
+	db      *sql.DB
+	minio   *minio.Client
+	buckets []string
+	mode    minio.RetentionMode
+	l       *zap.SugaredLogger
+
+	// Buckets with object locking enabled, see DetectLocking
+	locked []string
+}
+
+// New returns Holds for objects in the buckets, retained in the mode
+// (GOVERNANCE or COMPLIANCE) on locked buckets.
+func New(db *sql.DB, minioClient *minio.Client, buckets []string, mode string, l *zap.SugaredLogger) *Holds {
+	return &Holds{db: db, minio: minioClient, buckets: buckets, mode: minio.RetentionMode(mode), l: l}
+}
+
+// DetectLocking finds out which buckets have object locking enabled. Only
+// buckets created with it can have it.
+func (h *Holds) DetectLocking(ctx context.Context) error {
+	h.locked = nil
+	for _, bucket := range h.buckets {
+		enabled, _, _, _, err := h.minio.GetObjectLockConfig(ctx, bucket)
+		if minio.ToErrorResponse(err).Code == "ObjectLockConfigurationNotFoundError" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if enabled == "Enabled" {
+			h.locked = append(h.locked, bucket)
+		}
+	}
+	h.l.Infow("Detected object locking", zap.Strings("locked_buckets", h.locked))
+	return nil
+}
+
+// SetLegalHold places a legal hold with the reason on the file, or releases
+// it.
+func (h *Holds) SetLegalHold(ctx context.Context, f *storage.File, hold bool, reason string, updatedBy int) error {
+	status := minio.LegalHoldDisabled
+	if hold {
+		status = minio.LegalHoldEnabled
+	}
+	err := h.forEachObject(ctx, f, func(bucket string, o storage.FileObject) error {
+		if !hold && o.Others.LegalHold {
+			// Still held for another file with the same content
+			return nil
+		}
+		return h.minio.PutObjectLegalHold(ctx, bucket, o.Key, minio.PutObjectLegalHoldOptions{Status: &status})
+	})
+	if err != nil {
+		return err
+	}
+	if !hold {
+		reason = ""
+	}
+	if err := storage.SetLegalHold(ctx, h.db, f.ID, hold, reason, updatedBy); err != nil {
+		return err
+	}
+	f.LegalHold, f.LegalHoldReason = hold, reason
+	return nil
+}
+
+// SetRetainUntil keeps the file until the time, or removes its retention
+// if until is nil. In compliance mode retention on locked buckets can only
+// be extended.
+func (h *Holds) SetRetainUntil(ctx context.Context, f *storage.File, until *time.Time, updatedBy int) error {
+	shortened := f.RetainUntil != nil && f.RetainUntil.After(time.Now()) && (until == nil || until.Before(*f.RetainUntil))
+	if shortened && len(h.locked) > 0 && h.mode == minio.Compliance {
+		return ErrRetentionLocked
+	}
+	err := h.forEachObject(ctx, f, func(bucket string, o storage.FileObject) error {
+		// Objects other files use are retained as long as any of them needs
+		opts := minio.PutObjectRetentionOptions{GovernanceBypass: h.mode == minio.Governance}
+		if objectUntil := later(until, o.Others.RetainUntil); objectUntil != nil {
+			opts.Mode, opts.RetainUntilDate = &h.mode, objectUntil
+		}
+		return h.minio.PutObjectRetention(ctx, bucket, o.Key, opts)
+	})
+	if err != nil {
+		return err
+	}
+	if err := storage.SetRetainUntil(ctx, h.db, f.ID, until, updatedBy); err != nil {
+		return err
+	}
+	f.RetainUntil = until
+	return nil
+}
+
+// ApplyToObject places the holds of the files that use the object on it in
+// the locked buckets. Holds are applied to the objects there are when they
+// are placed, so objects stored later, like new versions of a held file
+// and their backups, need this.
+func (h *Holds) ApplyToObject(ctx context.Context, key string) error {
+	if len(h.locked) == 0 {
+		return nil
+	}
+	hold, err := storage.ObjectHold(ctx, h.db, key)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, bucket := range h.locked {
+		if hold.LegalHold {
+			status := minio.LegalHoldEnabled
+			err := h.minio.PutObjectLegalHold(ctx, bucket, key, minio.PutObjectLegalHoldOptions{Status: &status})
+			if err := ignoreMissing(err); err != nil {
+				return err
+			}
+		}
+		if hold.RetainUntil != nil && hold.RetainUntil.After(now) {
+			err := h.minio.PutObjectRetention(ctx, bucket, key, minio.PutObjectRetentionOptions{
+				GovernanceBypass: h.mode == minio.Governance,
+				Mode:             &h.mode,
+				RetainUntilDate:  hold.RetainUntil,
+			})
+			if err := ignoreMissing(err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// HandleBackup applies the holds to a new backup, which is stored after
+// the upload it belongs to.
+func (h *Holds) HandleBackup(msg *nats.Msg) {
+	var backup queue.BackupMessage
+	if err := json.Unmarshal(msg.Data, &backup); err != nil {
+		h.l.Errorw("Failed to unmarshal backup message", zap.Error(err))
+		msg.Term()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.ApplyToObject(ctx, backup.Filename); err != nil {
+		h.l.Errorw("Failed to apply holds to backup", zap.String("object_key", backup.Filename), zap.Error(err))
+		msg.Nak()
+		return
+	}
+	msg.Ack()
+}
+
+// forEachObject calls fn for the objects of all versions of the file in the
+// locked buckets, as a hold covers every version.
+func (h *Holds) forEachObject(ctx context.Context, f *storage.File, fn func(bucket string, o storage.FileObject) error) error {
+	if len(h.locked) == 0 {
+		return nil
+	}
+	objects, err := storage.ListFileObjects(ctx, h.db, f.ID)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range h.locked {
+		for _, o := range objects {
+			if err := ignoreMissing(fn(bucket, o)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// later returns the later of two retention times, nil meaning none.
+func later(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.After(*a)) {
+		return b
+	}
+	return a
+}
+
+// ignoreMissing ignores errors for objects that are gone, e.g. copies
+// removed by lifecycle policies.
+func ignoreMissing(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil
+	}
+	return err
+}
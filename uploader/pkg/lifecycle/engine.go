@@ -0,0 +1,405 @@
+package lifecycle
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/monitoring"
+	"video-platform/uploader/pkg/storage"
+	"video-platform/uploader/pkg/trash"
+)
+
+// Key of the advisory lock held by the replica that runs the job
+const leaderLockKey int64 = 0x6c696665
+
+// File versions loaded per query
+const batchSize = 500
+
+type bucketCopy struct {
+	copy   string
+	bucket string
+}
+
+// Expiry is a copy of a file version that expires within the report
+// window.
+type Expiry struct {
+	FileID    int       `json:"file_id"`
+	Filename  string    `json:"filename"`
+	Version   int       `json:"version"`
+	UserID    int       `json:"user_id"`
+	Bucket    string    `json:"bucket"`
+	Policy    string    `json:"policy"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// A legal hold or retention keeps the copy past its expiry
+	Held bool `json:"held"`
+	// No copy of the version is left, so it is removed, with the whole file
+	// if it is the current version
+	Purge bool `json:"purge"`
+}
+
+// Engine applies lifecycle policies to the primary and backup copies of
+// each version of active files. It records the policy and expiry of each
+// copy in file_versions and removes copies once they expire. Older
+// versions with no copy left are removed, files whose current version has
+// none are purged. Only the replica holding a Postgres advisory lock runs
+// it.
+type Engine struct {
+	db     *sql.DB
+	minio  *minio.Client
+	copies []bucketCopy
+	bin    *trash.Trash
+	path   string
+	dryRun bool
+	// Primary copies restored from the backup are kept at least this long
+	rehydratedTTL time.Duration
+	l             *zap.SugaredLogger
+
+	mu       sync.Mutex
+	policies Policies
+
+	// Holds the advisory lock while this replica is the leader
+	leader *sql.Conn
+}
+
+// NewEngine loads the policies from path. An empty path means no policies,
+// so nothing expires. With dryRun the job only logs what it would remove.
+// Rehydrated primary copies expire no sooner than rehydratedTTL after
+// their restore.
+func NewEngine(db *sql.DB, minioClient *minio.Client, primaryBucket, backupBucket string, bin *trash.Trash, path string, dryRun bool,
+	rehydratedTTL time.Duration, l *zap.SugaredLogger) (*Engine, error) {
+	e := &Engine{
+		db:    db,
+		minio: minioClient,
+		copies: []bucketCopy{
+			{storage.CopyPrimary, primaryBucket},
+			{storage.CopyBackup, backupBucket},
+		},
+		bin:           bin,
+		path:          path,
+		dryRun:        dryRun,
+		rehydratedTTL: rehydratedTTL,
+		l:             l,
+	}
+	if path != "" {
+		policies, err := LoadPolicies(path, e.buckets())
+		if err != nil {
+			return nil, err
+		}
+		e.policies = policies
+	}
+	return e, nil
+}
+
+func (e *Engine) buckets() []string {
+	buckets := make([]string, len(e.copies))
+	for i, c := range e.copies {
+		buckets[i] = c.bucket
+	}
+	return buckets
+}
+
+// currentPolicies reloads the policy file, so edits apply from the next run.
+// If it became invalid the previous policies are kept.
+func (e *Engine) currentPolicies() Policies {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.path == "" {
+		return nil
+	}
+	policies, err := LoadPolicies(e.path, e.buckets())
+	if err != nil {
+		e.l.Errorw("Failed to reload lifecycle policies, keeping the previous ones", zap.String("path", e.path), zap.Error(err))
+		return e.policies
+	}
+	e.policies = policies
+	return policies
+}
+
+// want returns the policy and expiry the copy should have.
+func (e *Engine) want(policies Policies, c bucketCopy, f *storage.LifecycleFile) storage.CopyState {
+	var state storage.CopyState
+	if p := policies.For(c.bucket, f); p != nil {
+		state.Policy = p.Name
+		if !p.Keep {
+			expiresAt := f.UploadedAt.Add(p.ExpireAfter)
+			if c.copy == storage.CopyPrimary && f.RehydratedAt != nil {
+				expiresAt = latest(expiresAt, f.RehydratedAt.Add(e.rehydratedTTL))
+			}
+			state.ExpiresAt = &expiresAt
+		}
+	}
+	return state
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Run applies the policies every interval while this replica is the
+// leader, until ctx is done.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	defer e.resign()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if e.lead(ctx) {
+				e.apply(ctx)
+			}
+		}
+	}
+}
+
+// lead reports whether this replica is the leader, trying to become it if
+// not.
+func (e *Engine) lead(ctx context.Context) bool {
+	if e.leader != nil {
+		err := e.leader.PingContext(ctx)
+		if err == nil {
+			return true
+		}
+		e.l.Warnw("Lost lifecycle leadership", zap.Error(err))
+		e.resign()
+	}
+
+	conn, err := e.db.Conn(ctx)
+	if err != nil {
+		e.l.Errorw("Failed to get a connection for lifecycle leadership", zap.Error(err))
+		return false
+	}
+	locked, err := storage.TryAdvisoryLock(ctx, conn, leaderLockKey)
+	if err != nil || !locked {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			e.l.Errorw("Failed to take lifecycle lock", zap.Error(err))
+		}
+		conn.Close()
+		return false
+	}
+	e.leader = conn
+	monitoring.LifecycleLeader.Set(1)
+	e.l.Infow("Running lifecycle job on this replica", zap.Bool("dry_run", e.dryRun))
+	return true
+}
+
+// resign drops the connection holding the lock, which ends the session and
+// releases the lock.
+func (e *Engine) resign() {
+	if e.leader == nil {
+		return
+	}
+	e.leader.Raw(func(interface{}) error { return driver.ErrBadConn })
+	e.leader.Close()
+	e.leader = nil
+	monitoring.LifecycleLeader.Set(0)
+}
+
+// forEachFile calls fn for all versions of active files, in batches.
+func (e *Engine) forEachFile(ctx context.Context, fn func(f *storage.LifecycleFile)) error {
+	var after int
+	for {
+		files, err := storage.ListLifecycleFiles(ctx, e.db, after, batchSize)
+		if err != nil {
+			return err
+		}
+		for i := range files {
+			fn(&files[i])
+		}
+		if len(files) < batchSize {
+			return nil
+		}
+		after = files[len(files)-1].VersionID
+	}
+}
+
+func (e *Engine) apply(ctx context.Context) {
+	policies := e.currentPolicies()
+	now := time.Now()
+	err := e.forEachFile(ctx, func(f *storage.LifecycleFile) {
+		if ctx.Err() == nil {
+			e.applyFile(ctx, policies, f, now)
+		}
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		e.l.Errorw("Failed to list files for lifecycle", zap.Error(err))
+	}
+}
+
+func (e *Engine) applyFile(ctx context.Context, policies Policies, f *storage.LifecycleFile, now time.Time) {
+	gone := true
+	for _, c := range e.copies {
+		state := f.Copies[c.copy]
+		if state.DeletedAt != nil {
+			continue
+		}
+		next := e.want(policies, c, f)
+		if !e.dryRun && (next.Policy != state.Policy || !equalTime(next.ExpiresAt, state.ExpiresAt)) {
+			if err := storage.SetCopyLifecycle(ctx, e.db, f.VersionID, c.copy, next.Policy, next.ExpiresAt); err != nil {
+				e.l.Errorw("Failed to record lifecycle state", zap.Int("file_id", f.ID), zap.Error(err))
+				return
+			}
+		}
+		if next.ExpiresAt == nil || next.ExpiresAt.After(now) {
+			gone = false
+			continue
+		}
+		if f.Hold.Active(now) {
+			// Removed once the hold is released or the retention passed
+			gone = false
+			continue
+		}
+		if e.dryRun {
+			e.l.Infow("Would remove expired copy", zap.Int("file_id", f.ID), zap.Int("version", f.Version), zap.String("bucket", c.bucket),
+				zap.String("filename", f.Filename), zap.String("policy", next.Policy))
+			continue
+		}
+		if err := e.removeCopy(ctx, f, c); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				e.l.Errorw("Failed to remove expired copy", zap.Int("file_id", f.ID), zap.String("bucket", c.bucket), zap.Error(err))
+			}
+			return
+		}
+		e.l.Infow("Removed expired copy", zap.Int("file_id", f.ID), zap.Int("version", f.Version), zap.String("bucket", c.bucket),
+			zap.String("filename", f.Filename), zap.String("policy", next.Policy))
+	}
+	if !gone {
+		return
+	}
+	if !f.Current {
+		if e.dryRun {
+			e.l.Infow("Would remove version", zap.Int("file_id", f.ID), zap.Int("version", f.Version), zap.String("filename", f.Filename))
+			return
+		}
+		e.removeVersion(ctx, f)
+		return
+	}
+	if e.dryRun {
+		e.l.Infow("Would purge file", zap.Int("file_id", f.ID), zap.String("filename", f.Filename))
+		return
+	}
+	e.purge(ctx, f)
+}
+
+// removeCopy records a copy as removed and removes its object, unless other
+// versions of the same content still have their copy. A hold placed
+// meanwhile keeps it, and if the object cannot be removed the copy is kept
+// for the next run.
+func (e *Engine) removeCopy(ctx context.Context, f *storage.LifecycleFile, c bucketCopy) error {
+	err := storage.MarkCopyDeleted(ctx, e.db, f.VersionID, c.copy, func(key string) error {
+		return e.minio.RemoveObject(ctx, c.bucket, key, minio.RemoveObjectOptions{})
+	})
+	if err != nil {
+		return err
+	}
+	monitoring.LifecycleDeletions.WithLabelValues(c.bucket).Inc()
+	return nil
+}
+
+// removeVersion removes an older version whose copies are all gone, and
+// what is left of its object if no other version uses it, e.g. copies kept
+// for versions purged since.
+func (e *Engine) removeVersion(ctx context.Context, f *storage.LifecycleFile) {
+	keys, err := storage.DeleteVersion(ctx, e.db, f.VersionID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			e.l.Errorw("Failed to remove expired version", zap.Int("file_id", f.ID), zap.Int("version", f.Version), zap.Error(err))
+		}
+		return
+	}
+	for _, key := range keys {
+		err := storage.DropBlob(ctx, e.db, key, func(key string) error { return e.removeObject(ctx, key) })
+		if err != nil {
+			e.l.Errorw("Failed to remove expired object", zap.String("object_key", key), zap.Error(err))
+		}
+	}
+	e.l.Infow("Removed expired version", zap.Int("file_id", f.ID), zap.Int("version", f.Version), zap.String("filename", f.Filename))
+}
+
+// removeObject removes what is left of an object from every bucket.
+func (e *Engine) removeObject(ctx context.Context, key string) error {
+	for _, c := range e.copies {
+		if err := e.minio.RemoveObject(ctx, c.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purge removes a file whose current version has no copy left, with its
+// older versions, like purging it from the trash.
+func (e *Engine) purge(ctx context.Context, f *storage.LifecycleFile) {
+	if _, err := storage.TrashFile(ctx, e.db, f.ID, 0); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			e.l.Errorw("Failed to purge expired file", zap.Int("file_id", f.ID), zap.Error(err))
+		}
+		return
+	}
+	file := &storage.File{ID: f.ID, Filename: f.Filename, UserID: f.UserID, Status: storage.FileTrashed}
+	if err := e.bin.Purge(ctx, file); err != nil {
+		e.l.Errorw("Failed to purge expired file", zap.Int("file_id", f.ID), zap.Error(err))
+		return
+	}
+	e.l.Infow("Purged expired file", zap.Int("file_id", f.ID), zap.String("filename", f.Filename))
+}
+
+// Report returns the copies that expire within the window under the
+// current policies, soonest first, without changing anything. Copies
+// already due are included.
+func (e *Engine) Report(ctx context.Context, within time.Duration) ([]Expiry, error) {
+	policies := e.currentPolicies()
+	until := time.Now().Add(within)
+	report := []Expiry{}
+	err := e.forEachFile(ctx, func(f *storage.LifecycleFile) {
+		var expiring []Expiry
+		gone := true
+		for _, c := range e.copies {
+			if f.Copies[c.copy].DeletedAt != nil {
+				continue
+			}
+			next := e.want(policies, c, f)
+			if next.ExpiresAt == nil || next.ExpiresAt.After(until) {
+				gone = false
+				continue
+			}
+			expiring = append(expiring, Expiry{
+				FileID:    f.ID,
+				Filename:  f.Filename,
+				Version:   f.Version,
+				UserID:    f.UserID,
+				Bucket:    c.bucket,
+				Policy:    next.Policy,
+				ExpiresAt: *next.ExpiresAt,
+				Held:      f.Hold.Active(*next.ExpiresAt),
+			})
+		}
+		for i := range expiring {
+			expiring[i].Purge = gone && !expiring[i].Held
+		}
+		report = append(report, expiring...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(report, func(a, b Expiry) int { return a.ExpiresAt.Compare(b.ExpiresAt) })
+	return report, nil
+}
+
+func equalTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
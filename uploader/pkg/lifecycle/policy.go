@@ -0,0 +1,103 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"video-platform/uploader/pkg/storage"
+)
+
+// Policy decides when the copy of a file in a bucket expires. It matches
+// files whose owner has any of Roles, whose owner is one of Users and that
+// have any of Tags; empty lists match everything. Copies matched by a
+// policy with Keep never expire.
+type Policy struct {
+	Name        string        `mapstructure:"name"`
+	Bucket      string        `mapstructure:"bucket"`
+	Roles       []string      `mapstructure:"roles"`
+	Users       []int         `mapstructure:"users"`
+	Tags        []string      `mapstructure:"tags"`
+	ExpireAfter time.Duration `mapstructure:"expire_after"`
+	Keep        bool          `mapstructure:"keep"`
+}
+
+// Policies are evaluated in order, the first matching one per bucket wins.
+type Policies []Policy
+
+// LoadPolicies reads policies from a YAML or JSON file and checks that
+// they only refer to the given buckets.
+func LoadPolicies(path string, buckets []string) (Policies, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var file struct {
+		Policies Policies `mapstructure:"policies"`
+	}
+	if err := v.Unmarshal(&file); err != nil {
+		return nil, fmt.Errorf("decoding lifecycle policies: %w", err)
+	}
+
+	names := make(map[string]bool)
+	var errs []error
+	for i, p := range file.Policies {
+		switch {
+		case p.Name == "":
+			errs = append(errs, fmt.Errorf("policy %d has no name", i+1))
+		case names[p.Name]:
+			errs = append(errs, fmt.Errorf("policy %q is defined twice", p.Name))
+		case !slices.Contains(buckets, p.Bucket):
+			errs = append(errs, fmt.Errorf("policy %q: bucket must be one of %v", p.Name, buckets))
+		case !p.Keep && p.ExpireAfter <= 0:
+			errs = append(errs, fmt.Errorf("policy %q needs a positive expire_after or keep", p.Name))
+		}
+		names[p.Name] = true
+		for j, tag := range p.Tags {
+			// Tags are stored lowercased, see handlers.parseTags
+			file.Policies[i].Tags[j] = strings.ToLower(tag)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return file.Policies, nil
+}
+
+func (p *Policy) matches(f *storage.LifecycleFile) bool {
+	if len(p.Users) > 0 && !slices.Contains(p.Users, f.UserID) {
+		return false
+	}
+	if len(p.Roles) > 0 && !containsAny(p.Roles, f.Roles) {
+		return false
+	}
+	if len(p.Tags) > 0 && !containsAny(p.Tags, f.Tags) {
+		return false
+	}
+	return true
+}
+
+// For returns the first policy for the bucket that matches the file, or
+// nil.
+func (ps Policies) For(bucket string, f *storage.LifecycleFile) *Policy {
+	for i := range ps {
+		if ps[i].Bucket == bucket && ps[i].matches(f) {
+			return &ps[i]
+		}
+	}
+	return nil
+}
+
+func containsAny(want, have []string) bool {
+	for _, h := range have {
+		if slices.Contains(want, h) {
+			return true
+		}
+	}
+	return false
+}
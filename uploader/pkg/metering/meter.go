@@ -0,0 +1,183 @@
+package metering
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/monitoring"
+	"video-platform/uploader/pkg/queue"
+	"video-platform/uploader/pkg/storage"
+)
+
+// Kinds of usage whose top consumers are exported as gauges
+var kinds = []string{"ingress", "egress", "backup", "stored"}
+
+type key struct {
+	userID int
+	day    string
+}
+
+// Meter adds up transferred bytes per user and day in memory and writes
+// them to usage_daily in batches, so metering a download costs no query.
+// Counts still pending when the process dies are lost.
+type Meter struct {
+	db *sql.DB
+	l  *zap.SugaredLogger
+
+	mu      sync.Mutex
+	pending map[key]*storage.DailyUsage
+}
+
+func NewMeter(db *sql.DB, l *zap.SugaredLogger) *Meter {
+	return &Meter{db: db, l: l, pending: make(map[key]*storage.DailyUsage)}
+}
+
+func (m *Meter) add(delta storage.DailyUsage) {
+	if delta.UserID == 0 {
+		return
+	}
+	delta.Day = time.Now().UTC().Truncate(24 * time.Hour)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.merge(delta)
+}
+
+// merge adds delta to the pending counts. mu must be held.
+func (m *Meter) merge(delta storage.DailyUsage) {
+	k := key{delta.UserID, delta.Day.Format(time.DateOnly)}
+	u, ok := m.pending[k]
+	if !ok {
+		m.pending[k] = &delta
+		return
+	}
+	u.IngressBytes += delta.IngressBytes
+	u.EgressBytes += delta.EgressBytes
+	u.BackupBytes += delta.BackupBytes
+	u.Uploads += delta.Uploads
+	u.Downloads += delta.Downloads
+}
+
+// Upload records a file stored by its owner.
+func (m *Meter) Upload(userID int, bytes int64) {
+	m.add(storage.DailyUsage{UserID: userID, IngressBytes: bytes, Uploads: 1})
+}
+
+// Download records bytes sent to the caller, of a whole file or a range.
+func (m *Meter) Download(userID int, bytes int64) {
+	m.add(storage.DailyUsage{UserID: userID, EgressBytes: bytes, Downloads: 1})
+}
+
+// Backup records a backup copy of a file of the user.
+func (m *Meter) Backup(userID int, bytes int64) {
+	m.add(storage.DailyUsage{UserID: userID, BackupBytes: bytes})
+}
+
+// Flush writes the pending counts. If that fails they are kept for the
+// next attempt.
+func (m *Meter) Flush(ctx context.Context) error {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[key]*storage.DailyUsage)
+	m.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	usage := make([]storage.DailyUsage, 0, len(pending))
+	for _, u := range pending {
+		usage = append(usage, *u)
+	}
+	if err := storage.AddDailyUsage(ctx, m.db, usage); err != nil {
+		m.mu.Lock()
+		for _, u := range usage {
+			m.merge(u)
+		}
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Run flushes the counts every interval until ctx is done. The final
+// flush is up to the caller.
+func (m *Meter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Flush(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				m.l.Errorw("Failed to write usage, it will be retried", zap.Error(err))
+			}
+		}
+	}
+}
+
+// ExportTopConsumers sets the top consumer gauges to the n users with the
+// most bytes of each kind within window, every interval until ctx is done.
+func (m *Meter) ExportTopConsumers(ctx context.Context, n int, window, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.exportTopConsumers(ctx, n, window)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Meter) exportTopConsumers(ctx context.Context, n int, window time.Duration) {
+	since := time.Now().UTC().Add(-window)
+	for _, kind := range kinds {
+		consumers, err := storage.TopConsumers(ctx, m.db, kind, since, n)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				m.l.Errorw("Failed to get top consumers", zap.String("kind", kind), zap.Error(err))
+			}
+			continue
+		}
+		// Users who dropped out of the top are removed
+		monitoring.TopConsumerBytes.DeletePartialMatch(map[string]string{"kind": kind})
+		for _, c := range consumers {
+			monitoring.TopConsumerBytes.WithLabelValues(c.Username, kind).Set(float64(c.Bytes))
+		}
+	}
+}
+
+// HandleBackup meters a backup reported by the handler to the owner of the
+// file.
+func (m *Meter) HandleBackup(msg *nats.Msg) {
+	var backup queue.BackupMessage
+	if err := json.Unmarshal(msg.Data, &backup); err != nil {
+		m.l.Errorw("Failed to unmarshal backup message", zap.Error(err))
+		msg.Term()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	owner, err := storage.GetFileOwner(ctx, m.db, backup.Filename)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Deleted before its backup was done
+		msg.Ack()
+		return
+	}
+	if err != nil {
+		m.l.Errorw("Failed to get file owner", zap.String("filename", backup.Filename), zap.Error(err))
+		msg.Nak()
+		return
+	}
+	m.Backup(owner, backup.Size)
+	msg.Ack()
+}
@@ -9,6 +9,75 @@ var FileUploadCount = prometheus.NewCounter(
 	},
 )
 
+var AuthzDecisions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "authz_decisions_total",
+		Help: "Authorization decisions by action and result",
+	},
+	[]string{"action", "result"},
+)
+
+var AuditEventsDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "audit_events_dropped_total",
+		Help: "Audit events that could not be written",
+	},
+)
+
+var LoginFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "login_failures_total",
+		Help: "Failed sign-in attempts by reason",
+	},
+	[]string{"reason"},
+)
+
+var RateLimitRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_rejections_total",
+		Help: "Requests rejected by rate limits and upload admission, by scope (ip, user, global) and limit",
+	},
+	[]string{"scope", "limit"},
+)
+
+var UploadsInFlight = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "uploads_in_flight",
+		Help: "Uploads currently admitted",
+	},
+)
+
+var TopConsumerBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "usage_top_consumer_bytes",
+		Help: "Bytes of the users with the most ingress, egress or backup within the metering window, or stored now",
+	},
+	[]string{"user", "kind"},
+)
+
+var LifecycleDeletions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "lifecycle_deletions_total",
+		Help: "Copies of files removed by lifecycle policies, by bucket",
+	},
+	[]string{"bucket"},
+)
+
+var LifecycleLeader = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "lifecycle_leader",
+		Help: "1 if this replica runs the lifecycle job",
+	},
+)
+
+var DeduplicatedUploads = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "deduplicated_uploads_total",
+		Help: "Uploads whose content was already stored, so only metadata was added",
+	},
+)
+
 func init() {
-	prometheus.MustRegister(FileUploadCount)
+	prometheus.MustRegister(FileUploadCount, AuthzDecisions, AuditEventsDropped, LoginFailures, RateLimitRejections, UploadsInFlight, TopConsumerBytes,
+		LifecycleDeletions, LifecycleLeader, DeduplicatedUploads)
 }
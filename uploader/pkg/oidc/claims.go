@@ -0,0 +1,141 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Claims of a verified ID token.
+type Claims map[string]interface{}
+
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim that may be a single string or a list of them.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Bool returns a boolean claim. Some providers send them as strings.
+func (c Claims) Bool(name string) bool {
+	switch v := c[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+func (c Claims) Time(name string) time.Time {
+	if v, ok := c[name].(float64); ok {
+		return time.Unix(int64(v), 0)
+	}
+	return time.Time{}
+}
+
+// ClaimMapping turns the claims of a provider's users into platform
+// accounts.
+type ClaimMapping struct {
+	UsernameClaim string
+	EmailClaim    string
+	GroupsClaim   string
+	// Roles granted to members of each provider group
+	GroupRoles map[string][]string
+	// Roles of users who are in none of the mapped groups. If empty,
+	// they cannot sign in.
+	DefaultRoles []string
+}
+
+// Identity is a provider user as seen by the platform.
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Username      string
+	Email         string
+	EmailVerified bool
+	Groups        []string
+	Roles         []string
+}
+
+// ParseGroupRoles parses group=role entries. A group may be listed more
+// than once to grant several roles.
+func ParseGroupRoles(entries []string) (map[string][]string, error) {
+	groupRoles := make(map[string][]string)
+	for _, entry := range entries {
+		group, role, ok := strings.Cut(entry, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" || role == "" {
+			return nil, fmt.Errorf("invalid group mapping %q, expected group=role", entry)
+		}
+		groupRoles[group] = append(groupRoles[group], role)
+	}
+	return groupRoles, nil
+}
+
+func (m *ClaimMapping) Identity(issuer string, claims Claims) *Identity {
+	id := &Identity{
+		Issuer:        issuer,
+		Subject:       claims.String("sub"),
+		Email:         claims.String(m.EmailClaim),
+		EmailVerified: claims.Bool("email_verified"),
+		Groups:        claims.Strings(m.GroupsClaim),
+	}
+
+	seen := make(map[string]bool)
+	for _, group := range id.Groups {
+		for _, role := range m.GroupRoles[group] {
+			if !seen[role] {
+				seen[role] = true
+				id.Roles = append(id.Roles, role)
+			}
+		}
+	}
+	if len(id.Roles) == 0 {
+		id.Roles = m.DefaultRoles
+	}
+
+	username := claims.String(m.UsernameClaim)
+	if username == "" {
+		username, _, _ = strings.Cut(id.Email, "@")
+	}
+	id.Username = cleanUsername(username, id.Subject)
+	return id
+}
+
+// cleanUsername makes name acceptable as a platform username, falling back
+// to one derived from the subject.
+func cleanUsername(name, subject string) string {
+	clean := strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-' {
+			return c
+		}
+		return '-'
+	}, name)
+	clean = strings.Trim(clean, "-.")
+	if len(clean) > 56 {
+		clean = clean[:56]
+	}
+	if len(clean) < 3 {
+		sum := sha256.Sum256([]byte(subject))
+		clean = "user-" + hex.EncodeToString(sum[:4])
+	}
+	return clean
+}
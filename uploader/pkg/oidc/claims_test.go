@@ -0,0 +1,92 @@
+package oidc
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestClaimMappingIdentity(t *testing.T) {
+	mapping := &ClaimMapping{
+		UsernameClaim: "preferred_username",
+		EmailClaim:    "email",
+		GroupsClaim:   "groups",
+		GroupRoles: map[string][]string{
+			"staff":    {"instructor"},
+			"admins":   {"admin", "instructor"},
+			"students": {"student"},
+		},
+		DefaultRoles: []string{"viewer"},
+	}
+	tests := []struct {
+		name         string
+		claims       Claims
+		wantRoles    []string
+		wantUsername string
+		wantVerified bool
+	}{
+		{
+			name:         "mapped groups",
+			claims:       Claims{"sub": "1", "preferred_username": "ada", "groups": []interface{}{"staff", "admins", "unmapped"}},
+			wantRoles:    []string{"instructor", "admin"},
+			wantUsername: "ada",
+		},
+		{
+			name:         "single group as string",
+			claims:       Claims{"sub": "2", "preferred_username": "bob", "groups": "students"},
+			wantRoles:    []string{"student"},
+			wantUsername: "bob",
+		},
+		{
+			name:         "default roles and username from email",
+			claims:       Claims{"sub": "3", "email": "carol.smith@example.com", "email_verified": "true"},
+			wantRoles:    []string{"viewer"},
+			wantUsername: "carol.smith",
+			wantVerified: true,
+		},
+		{
+			name:         "username cleaned",
+			claims:       Claims{"sub": "4", "preferred_username": "Dan O'Neil", "email_verified": true},
+			wantRoles:    []string{"viewer"},
+			wantUsername: "Dan-O-Neil",
+			wantVerified: true,
+		},
+		{
+			name:         "username derived from subject",
+			claims:       Claims{"sub": "5", "preferred_username": "é"},
+			wantRoles:    []string{"viewer"},
+			wantUsername: cleanUsername("", "5"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := mapping.Identity("https://idp.test", tt.claims)
+			if !slices.Equal(id.Roles, tt.wantRoles) {
+				t.Errorf("Roles = %v, want %v", id.Roles, tt.wantRoles)
+			}
+			if id.Username != tt.wantUsername {
+				t.Errorf("Username = %q, want %q", id.Username, tt.wantUsername)
+			}
+			if id.EmailVerified != tt.wantVerified {
+				t.Errorf("EmailVerified = %v, want %v", id.EmailVerified, tt.wantVerified)
+			}
+			if id.Issuer != "https://idp.test" || id.Subject != tt.claims.String("sub") {
+				t.Errorf("identity is %s %s", id.Issuer, id.Subject)
+			}
+		})
+	}
+}
+
+func TestParseGroupRoles(t *testing.T) {
+	groupRoles, err := ParseGroupRoles([]string{"staff=instructor", " staff = reviewer ", "admins=admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(groupRoles["staff"], []string{"instructor", "reviewer"}) || !slices.Equal(groupRoles["admins"], []string{"admin"}) {
+		t.Fatalf("unexpected mapping %v", groupRoles)
+	}
+	for _, entry := range []string{"staff", "=admin", "staff="} {
+		if _, err := ParseGroupRoles([]string{entry}); err == nil {
+			t.Errorf("ParseGroupRoles(%q) succeeded", entry)
+		}
+	}
+}
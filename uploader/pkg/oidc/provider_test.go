@@ -0,0 +1,232 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// mockProvider is an OIDC provider that signs users in without asking
+// anything. Its token endpoint checks the PKCE verifier against the
+// challenge of the last authorization request.
+type mockProvider struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	kid       string
+	challenge string
+	nonce     string
+	// Changes the claims of the next ID tokens
+	claims func(jwt.MapClaims)
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{key: key, kid: "mock-1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": m.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize stands in for the browser visiting the authorization URL.
+func (m *mockProvider) authorize(t *testing.T, authURL string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if got := query.Get("code_challenge_method"); got != "S256" {
+		t.Fatalf("code_challenge_method = %q, want S256", got)
+	}
+	m.challenge, m.nonce = query.Get("code_challenge"), query.Get("nonce")
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if r.PostFormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            m.URL,
+		"aud":            "uploader",
+		"sub":            "subject-1",
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"nonce":          m.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Minute).Unix(),
+	}
+	if m.claims != nil {
+		m.claims(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.kid
+	signed, err := token.SignedString(m.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+}
+
+func (m *mockProvider) provider() *Provider {
+	return NewProvider(Config{
+		Issuer:      m.URL,
+		ClientID:    "uploader",
+		RedirectURL: "http://uploader.test/auth/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+		Timeout:     5 * time.Second,
+	})
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	m := newMockProvider(t)
+	authURL, err := m.provider().AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, m.URL+"/authorize?") {
+		t.Fatalf("authorization URL %q does not use the discovered endpoint", authURL)
+	}
+	u, _ := url.Parse(authURL)
+	query := u.Query()
+	sum := sha256.Sum256([]byte("verifier"))
+	for name, want := range map[string]string{
+		"response_type":  "code",
+		"client_id":      "uploader",
+		"state":          "state",
+		"nonce":          "nonce",
+		"scope":          "openid email",
+		"code_challenge": base64.RawURLEncoding.EncodeToString(sum[:]),
+	} {
+		if got := query.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockProvider(t)
+	// Discovered at the same URL, but the issuer has to match exactly
+	p := NewProvider(Config{Issuer: m.URL + "/", ClientID: "uploader"})
+	if _, err := p.AuthCodeURL(context.Background(), "state", "nonce", "verifier"); err == nil {
+		t.Fatal("provider reporting another issuer was accepted")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	tests := []struct {
+		name     string
+		verifier string
+		nonce    string
+		claims   func(jwt.MapClaims)
+		wantErr  string
+	}{
+		{name: "valid"},
+		{name: "wrong verifier", verifier: "other", wantErr: "invalid_grant"},
+		{name: "nonce mismatch", nonce: "other", wantErr: "nonce"},
+		{name: "other audience", claims: func(c jwt.MapClaims) { c["aud"] = "someone-else" }, wantErr: "not meant for this client"},
+		{name: "other issuer", claims: func(c jwt.MapClaims) { c["iss"] = "https://evil.test" }, wantErr: "issued by"},
+		{name: "expired", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, wantErr: "expired"},
+		{name: "no subject", claims: func(c jwt.MapClaims) { delete(c, "sub") }, wantErr: "no subject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockProvider(t)
+			m.claims = tt.claims
+			p := m.provider()
+			ctx := context.Background()
+
+			verifier, _ := NewVerifier()
+			nonce, _ := NewVerifier()
+			authURL, err := p.AuthCodeURL(ctx, "state", nonce, verifier)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.authorize(t, authURL)
+			if tt.verifier != "" {
+				verifier = tt.verifier
+			}
+			if tt.nonce != "" {
+				nonce = tt.nonce
+			}
+
+			claims, err := p.Exchange(ctx, "code", verifier, nonce)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Exchange() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.String("sub") != "subject-1" || !claims.Bool("email_verified") {
+				t.Fatalf("unexpected claims %v", claims)
+			}
+		})
+	}
+}
+
+func TestExchangeUnknownKey(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	ctx := context.Background()
+	authURL, err := p.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.authorize(t, authURL)
+	if _, err := p.Exchange(ctx, "code", "verifier", "nonce"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys were fetched just now, so a rotated key is only picked up
+	// after keysRefetchInterval
+	m.kid = "mock-2"
+	if _, err := p.Exchange(ctx, "code", "verifier", "nonce"); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("Exchange() error = %v, want unknown signing key", err)
+	}
+	p.keysFetchedAt = time.Time{}
+	if _, err := p.Exchange(ctx, "code", "verifier", "nonce"); err != nil {
+		t.Fatalf("Exchange() after refetch: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/storage"
+)
+
+// DataPath is where the admin-managed data is published, i.e. the policy
+// reads it as data.platform.
+const DataPath = "platform"
+
+// KeysPath is where the public token signing keys are published as a JWKS,
+// i.e. the policy reads them as data.jwks.
+const KeysPath = "jwks"
+
+// DataTarget receives the data documents read by the policy.
+type DataTarget interface {
+	PutData(ctx context.Context, path string, doc interface{}) error
+}
+
+// RemoteData publishes documents to an OPA server through its data API.
+type RemoteData struct {
+	url    string
+	client *http.Client
+}
+
+func NewRemoteData(opaURL string, timeout time.Duration) *RemoteData {
+	return &RemoteData{url: opaURL + "/v1/data/", client: &http.Client{Timeout: timeout}}
+}
+
+func (d *RemoteData) PutData(ctx context.Context, path string, doc interface{}) error {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, d.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("publishing data failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// DataSync publishes the deny list, suspensions and upload limits stored in
+// Postgres to the policy, along with the public token signing keys. Admin
+// handlers publish after every change; Run republishes periodically so that
+// changes made on other replicas, expired entries and restarted OPA servers
+// are picked up.
+type DataSync struct {
+	db     *sql.DB
+	keys   *auth.KeySet
+	target DataTarget
+	l      *zap.SugaredLogger
+
+	mu       sync.Mutex
+	onChange []func()
+}
+
+func NewDataSync(db *sql.DB, keys *auth.KeySet, target DataTarget, l *zap.SugaredLogger) *DataSync {
+	return &DataSync{db: db, keys: keys, target: target, l: l}
+}
+
+// OnChange registers fn to be called after data was published.
+func (s *DataSync) OnChange(fn func()) {
+	s.onChange = append(s.onChange, fn)
+}
+
+func (s *DataSync) Publish(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The keys do not depend on Postgres, so tokens can be verified even
+	// while the database is unavailable
+	if err := s.target.PutData(ctx, KeysPath, s.keys.JWKS()); err != nil {
+		return fmt.Errorf("publishing signing keys: %w", err)
+	}
+	doc, err := BuildData(ctx, s.db)
+	if err != nil {
+		return fmt.Errorf("reading policy data: %w", err)
+	}
+	if err := s.target.PutData(ctx, DataPath, doc); err != nil {
+		return fmt.Errorf("publishing policy data: %w", err)
+	}
+	for _, fn := range s.onChange {
+		fn()
+	}
+	return nil
+}
+
+// Run publishes every interval until ctx is done.
+func (s *DataSync) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Publish(ctx); err != nil {
+				s.l.Errorw("Failed to publish policy data", zap.Error(err))
+			}
+		}
+	}
+}
+
+// BuildData returns the data.platform document. User ids are used as
+// object keys, so they are strings. Times are in nanoseconds to compare
+// with time.now_ns() in the policy.
+func BuildData(ctx context.Context, db *sql.DB) (map[string]interface{}, error) {
+	entries, err := storage.ListDenylist(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	suspensions, err := storage.ListSuspensions(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := storage.ListUploadLimits(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	denylist := []interface{}{}
+	for _, e := range entries {
+		entry := map[string]interface{}{
+			"type":    e.SubjectType,
+			"subject": e.Subject,
+			"action":  e.Action,
+			"reason":  e.Reason,
+		}
+		if e.ExpiresAt != nil {
+			entry["until_ns"] = e.ExpiresAt.UnixNano()
+		}
+		denylist = append(denylist, entry)
+	}
+
+	suspended := map[string]interface{}{}
+	for _, s := range suspensions {
+		suspension := map[string]interface{}{"reason": s.Reason}
+		if s.SuspendedUntil != nil {
+			suspension["until_ns"] = s.SuspendedUntil.UnixNano()
+		}
+		suspended[strconv.Itoa(s.UserID)] = suspension
+	}
+
+	uploadLimits := map[string]interface{}{}
+	for userID, maxBytes := range limits {
+		uploadLimits[strconv.Itoa(userID)] = maxBytes
+	}
+
+	return map[string]interface{}{
+		"denylist":      denylist,
+		"suspensions":   suspended,
+		"upload_limits": uploadLimits,
+	}, nil
+}
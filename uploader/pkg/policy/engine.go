@@ -0,0 +1,195 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/auth"
+)
+
+const decisionQuery = "data.authz.decision"
+
+// Engine evaluates the authorization policy in-process. The policy is loaded
+// from a bundle, see Source, and replaced whenever a newer revision is
+// found. Until the first bundle is loaded the engine cannot be created, so
+// a running engine always has a policy; failed reloads keep the old one.
+// Documents published with PutData are kept across bundle reloads.
+type Engine struct {
+	source  Source
+	timeout time.Duration
+	l       *zap.SugaredLogger
+
+	mu        sync.RWMutex
+	query     rego.PreparedEvalQuery
+	store     storage.Store
+	revision  string
+	published map[string]interface{}
+
+	onChange []func()
+}
+
+func NewEngine(ctx context.Context, source Source, timeout time.Duration, l *zap.SugaredLogger) (*Engine, error) {
+	e := &Engine{source: source, timeout: timeout, l: l, published: make(map[string]interface{})}
+	if _, err := e.reload(ctx); err != nil {
+		return nil, fmt.Errorf("loading policy bundle from %s: %w", source, err)
+	}
+	return e, nil
+}
+
+// OnChange registers fn to be called after a new policy was activated.
+func (e *Engine) OnChange(fn func()) {
+	e.onChange = append(e.onChange, fn)
+}
+
+// Revision returns the revision of the active bundle.
+func (e *Engine) Revision() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.revision
+}
+
+// Poll checks the source for a new bundle every interval until ctx is done.
+func (e *Engine) Poll(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := e.reload(ctx)
+			if err != nil {
+				e.l.Errorw("Failed to reload policy bundle, keeping the active one",
+					zap.Stringer("source", e.source), zap.String("revision", e.Revision()), zap.Error(err))
+				continue
+			}
+			if changed {
+				for _, fn := range e.onChange {
+					fn()
+				}
+			}
+		}
+	}
+}
+
+func (e *Engine) Authorize(ctx context.Context, input auth.AuthzInput) (*auth.Decision, error) {
+	// Round trip the input through JSON so the policy sees the same
+	// document as a remote OPA would
+	data, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	e.mu.RLock()
+	query, revision := e.query, e.revision
+	e.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	rs, err := query.Eval(ctx, rego.EvalInput(doc))
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+		return nil, fmt.Errorf("policy returned no decision")
+	}
+
+	result, err := json.Marshal(rs[0].Expressions[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	var decision auth.Decision
+	if err := json.Unmarshal(result, &decision); err != nil {
+		return nil, err
+	}
+	decision.Revision = revision
+	return &decision, nil
+}
+
+// reload fetches the bundle and activates it if its revision differs from
+// the active one.
+func (e *Engine) reload(ctx context.Context) (bool, error) {
+	b, err := e.source.Fetch(ctx)
+	if err != nil {
+		return false, err
+	}
+	if b == nil {
+		return false, nil
+	}
+	revision, err := bundleRevision(b)
+	if err != nil {
+		return false, err
+	}
+	if revision == e.Revision() {
+		return false, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	data := make(map[string]interface{})
+	for key, value := range b.Data {
+		data[key] = value
+	}
+	for key, value := range e.published {
+		data[key] = value
+	}
+	store := inmem.NewFromObject(data)
+	query, err := prepare(ctx, b, store)
+	if err != nil {
+		return false, err
+	}
+	e.query = query
+	e.store = store
+	e.revision = revision
+	e.l.Infow("Activated policy bundle", zap.Stringer("source", e.source), zap.String("revision", revision))
+	return true, nil
+}
+
+// PutData replaces the document at data.<path>. It takes effect for the
+// next evaluation without recompiling the policy.
+func (e *Engine) PutData(ctx context.Context, path string, doc interface{}) error {
+	// Store plain JSON values like a remote OPA would
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := storage.WriteOne(ctx, e.store, storage.AddOp, storage.Path{path}, value); err != nil {
+		return err
+	}
+	e.published[path] = value
+	return nil
+}
+
+func prepare(ctx context.Context, b *bundle.Bundle, store storage.Store) (rego.PreparedEvalQuery, error) {
+	options := []func(*rego.Rego){
+		rego.Query(decisionQuery),
+		rego.Store(store),
+	}
+	for _, module := range b.Modules {
+		options = append(options, rego.Module(module.Path, string(module.Raw)))
+	}
+	return rego.New(options...).PrepareForEval(ctx)
+}
@@ -0,0 +1,148 @@
+package policy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/auth"
+)
+
+const policyFile = "../../../volumes/opa/policy.rego"
+
+func writeKey(t *testing.T, dir, kid string, key crypto.Signer) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), block, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func generate(t *testing.T, kind string) crypto.Signer {
+	t.Helper()
+	var key crypto.Signer
+	var err error
+	switch kind {
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "p256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "p384":
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unknown key type %q", kind)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// tokenValid evaluates data.authz.token_valid with the keys published the
+// way DataSync publishes them.
+func tokenValid(t *testing.T, keys *auth.KeySet, token string) bool {
+	t.Helper()
+	module, err := os.ReadFile(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(keys.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwks interface{}
+	if err := json.Unmarshal(raw, &jwks); err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := rego.New(
+		rego.Query("data.authz.token_valid"),
+		rego.Module(policyFile, string(module)),
+		rego.Store(inmem.NewFromObject(map[string]interface{}{KeysPath: jwks})),
+		rego.Input(map[string]interface{}{
+			"subject": map[string]interface{}{"auth_method": "session"},
+			"token":   token,
+		}),
+	).Eval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) == 0 {
+		return false
+	}
+	valid, _ := rs[0].Expressions[0].Value.(bool)
+	return valid
+}
+
+func TestSigningKeysVerifyInPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "RS256", key: "rsa"},
+		{name: "ES256", key: "p256"},
+		{name: "ECDSA P-384 rejected", key: "p384", wantErr: true},
+		{name: "Ed25519 rejected", key: "ed25519", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeKey(t, dir, "test", generate(t, tt.key))
+			keys, err := auth.LoadKeySet(dir, "test", zap.NewNop().Sugar())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("LoadKeySet() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadKeySet() error = %v", err)
+			}
+
+			tokens := auth.NewTokenService(keys, "video-platform", "video-platform", time.Minute, time.Hour)
+			token, err := tokens.GenerateJWT("alice", 1, []string{"user"}, "session")
+			if err != nil {
+				t.Fatalf("GenerateJWT() error = %v", err)
+			}
+			if _, err := tokens.Parse(token); err != nil {
+				t.Errorf("Parse() error = %v", err)
+			}
+			if !tokenValid(t, keys, token) {
+				t.Error("policy rejected a token signed with a published key")
+			}
+
+			// A token signed with a key that was not published must fail
+			other := t.TempDir()
+			writeKey(t, other, "test", generate(t, tt.key))
+			otherKeys, err := auth.LoadKeySet(other, "test", zap.NewNop().Sugar())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tokenValid(t, otherKeys, token) {
+				t.Error("policy accepted a token signed with an unpublished key")
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package policy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/loader"
+)
+
+// Source provides policy bundles. Fetch returns nil when the bundle has not
+// changed since the last call.
+type Source interface {
+	Fetch(ctx context.Context) (*bundle.Bundle, error)
+	String() string
+}
+
+// NewSource picks the source for location: an http(s) URL of a bundle
+// tarball, a local tarball ending in .tar.gz, or a directory of .rego and
+// data files.
+func NewSource(location string, timeout time.Duration) Source {
+	switch {
+	case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+		return &httpSource{url: location, client: &http.Client{Timeout: timeout}}
+	default:
+		return fileSource(location)
+	}
+}
+
+type fileSource string
+
+func (s fileSource) Fetch(ctx context.Context) (*bundle.Bundle, error) {
+	path := string(s)
+	if strings.HasSuffix(path, ".tar.gz") {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		b, err := bundle.NewReader(f).Read()
+		return &b, err
+	}
+	return loader.NewFileLoader().AsBundle(path)
+}
+
+func (s fileSource) String() string {
+	return string(s)
+}
+
+// httpSource downloads a bundle tarball, using the ETag to skip unchanged
+// bundles.
+type httpSource struct {
+	url    string
+	client *http.Client
+	etag   string
+}
+
+func (s *httpSource) Fetch(ctx context.Context) (*bundle.Bundle, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	b, err := bundle.NewReader(resp.Body).Read()
+	if err != nil {
+		return nil, err
+	}
+	s.etag = resp.Header.Get("ETag")
+	return &b, nil
+}
+
+func (s *httpSource) String() string {
+	return s.url
+}
+
+// bundleRevision returns the manifest revision, or a hash of the contents
+// for bundles that do not set one, such as plain directories.
+func bundleRevision(b *bundle.Bundle) (string, error) {
+	if b.Manifest.Revision != "" {
+		return b.Manifest.Revision, nil
+	}
+	modules := append([]bundle.ModuleFile(nil), b.Modules...)
+	sort.Slice(modules, func(i, j int) bool { return modules[i].Path < modules[j].Path })
+
+	h := sha256.New()
+	for _, module := range modules {
+		h.Write([]byte(module.Path))
+		h.Write(module.Raw)
+	}
+	data, err := json.Marshal(b.Data)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
@@ -4,26 +4,57 @@ import (
 	"context"
 	"crypto/md5"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"hash"
 	"io"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/codes"
 )
 
-func ComputeChecksum(ctx context.Context, reader io.Reader) (string, string, error) {
+// Checksums are the hex encoded digests of some content.
+type Checksums struct {
+	MD5    string
+	SHA256 string
+	SHA512 string
+}
+
+// Hasher computes the Checksums of what is written to it.
+type Hasher struct {
+	md5, sha256, sha512 hash.Hash
+}
+
+func NewHasher() *Hasher {
+	return &Hasher{md5: md5.New(), sha256: sha256.New(), sha512: sha512.New()}
+}
+
+func (h *Hasher) Write(p []byte) (int, error) {
+	// Hashes never fail to write
+	h.md5.Write(p)
+	h.sha256.Write(p)
+	h.sha512.Write(p)
+	return len(p), nil
+}
+
+func (h *Hasher) Checksums() Checksums {
+	return Checksums{
+		MD5:    hex.EncodeToString(h.md5.Sum(nil)),
+		SHA256: hex.EncodeToString(h.sha256.Sum(nil)),
+		SHA512: hex.EncodeToString(h.sha512.Sum(nil)),
+	}
+}
+
+func ComputeChecksum(ctx context.Context, reader io.Reader) (Checksums, error) {
 	_, span := otel.Tracer("uploader").Start(ctx, "computeChecksum")
 	defer span.End()
 
-	hashMd5 := md5.New()
-	hashSha256 := sha256.New()
-	tee := io.MultiWriter(hashMd5, hashSha256)
-
-	if _, err := io.Copy(tee, reader); err != nil {
+	hasher := NewHasher()
+	if _, err := io.Copy(hasher, reader); err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "Failed to compute checksum")
-		return "", "", err
+		return Checksums{}, err
 	}
 
-	return hex.EncodeToString(hashMd5.Sum(nil)), hex.EncodeToString(hashSha256.Sum(nil)), nil
+	return hasher.Checksums(), nil
 }
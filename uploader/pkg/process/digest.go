@@ -0,0 +1,109 @@
+package process
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrInvalidDigest is returned for digest headers that cannot be parsed
+	ErrInvalidDigest = errors.New("invalid digest header")
+	// ErrDigestMismatch is returned when a digest does not match the content
+	ErrDigestMismatch = errors.New("digest mismatch")
+)
+
+// WantDigest lists the digest algorithms that are verified, by preference,
+// for the Want-Content-Digest and Want-Repr-Digest headers.
+const WantDigest = "sha-256=10, sha-512=5"
+
+// VerifyContentDigest checks the Content-Digest header of RFC 9530
+// against the checksums of the message content, the request body as sent.
+// Digests with other algorithms than sha-256 and sha-512 are ignored, as
+// the RFC asks.
+func VerifyContentDigest(h http.Header, content Checksums) error {
+	return verifyDigests(h, "Content-Digest", content)
+}
+
+// VerifyReprDigest checks the Repr-Digest header of RFC 9530 and the
+// legacy Content-MD5 header against the checksums of the uploaded file,
+// which is the representation the client sends.
+func VerifyReprDigest(h http.Header, file Checksums) error {
+	if err := verifyDigests(h, "Repr-Digest", file); err != nil {
+		return err
+	}
+	if value := h.Get("Content-MD5"); value != "" {
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%w: Content-MD5: %v", ErrInvalidDigest, err)
+		}
+		if hex.EncodeToString(digest) != file.MD5 {
+			return fmt.Errorf("%w: Content-MD5", ErrDigestMismatch)
+		}
+	}
+	return nil
+}
+
+func verifyDigests(h http.Header, name string, sums Checksums) error {
+	for _, value := range h.Values(name) {
+		digests, err := parseDigests(value)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidDigest, name, err)
+		}
+		for alg, digest := range digests {
+			var want string
+			switch alg {
+			case "sha-256":
+				want = sums.SHA256
+			case "sha-512":
+				want = sums.SHA512
+			default:
+				continue
+			}
+			if hex.EncodeToString(digest) != want {
+				return fmt.Errorf("%w: %s %s", ErrDigestMismatch, name, alg)
+			}
+		}
+	}
+	return nil
+}
+
+// ReprDigest returns the Repr-Digest header value for a hex encoded
+// SHA-256 checksum, or an empty string if the checksum is not one.
+func ReprDigest(sha256Checksum string) string {
+	digest, err := hex.DecodeString(sha256Checksum)
+	if err != nil || len(digest) != 32 {
+		return ""
+	}
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(digest) + ":"
+}
+
+// parseDigests parses a structured field dictionary of algorithms to byte
+// sequences, such as "sha-256=:AEGP...=:, sha-512=:YMAa...==:". Parameters
+// of the members are ignored.
+func parseDigests(value string) (map[string][]byte, error) {
+	digests := make(map[string][]byte)
+	for _, member := range strings.Split(value, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		alg, seq, ok := strings.Cut(member, "=")
+		if !ok {
+			return nil, fmt.Errorf("member %q has no value", member)
+		}
+		seq, _, _ = strings.Cut(seq, ";")
+		if len(seq) < 2 || seq[0] != ':' || seq[len(seq)-1] != ':' {
+			return nil, fmt.Errorf("value of %q is not a byte sequence", alg)
+		}
+		digest, err := base64.StdEncoding.DecodeString(seq[1 : len(seq)-1])
+		if err != nil {
+			return nil, fmt.Errorf("value of %q: %v", alg, err)
+		}
+		digests[strings.ToLower(alg)] = digest
+	}
+	return digests, nil
+}
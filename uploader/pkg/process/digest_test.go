@@ -0,0 +1,127 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const content = "hello world"
+
+func b64(sum []byte) string {
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+var (
+	sha256Sum = sha256.Sum256([]byte(content))
+	sha512Sum = sha512.Sum512([]byte(content))
+	md5Sum    = md5.Sum([]byte(content))
+)
+
+func TestParseDigests(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string][]byte
+		wantErr bool
+	}{
+		{name: "single", value: "sha-256=:" + b64(sha256Sum[:]) + ":", want: map[string][]byte{"sha-256": sha256Sum[:]}},
+		{
+			name:  "several with parameters",
+			value: "sha-256=:" + b64(sha256Sum[:]) + ":;foo=1,  sha-512=:" + b64(sha512Sum[:]) + ":",
+			want:  map[string][]byte{"sha-256": sha256Sum[:], "sha-512": sha512Sum[:]},
+		},
+		{name: "uppercase algorithm", value: "SHA-256=:" + b64(sha256Sum[:]) + ":", want: map[string][]byte{"sha-256": sha256Sum[:]}},
+		{name: "empty members", value: " , ", want: map[string][]byte{}},
+		{name: "no value", value: "sha-256", wantErr: true},
+		{name: "not a byte sequence", value: "sha-256=abc", wantErr: true},
+		{name: "unterminated byte sequence", value: "sha-256=:abc", wantErr: true},
+		{name: "invalid base64", value: "sha-256=:!!:", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDigests(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseDigests(%q) = %v, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseDigests(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+			for alg, digest := range tt.want {
+				if !bytes.Equal(got[alg], digest) {
+					t.Errorf("digest %s = %x, want %x", alg, got[alg], digest)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyDigests(t *testing.T) {
+	sums, err := ComputeChecksum(context.Background(), strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := sha256.Sum256([]byte("other"))
+	tests := []struct {
+		name    string
+		header  map[string]string
+		repr    bool
+		wantErr error
+	}{
+		{name: "no headers"},
+		{name: "content sha-256", header: map[string]string{"Content-Digest": "sha-256=:" + b64(sha256Sum[:]) + ":"}},
+		{name: "content sha-512 and unknown algorithm", header: map[string]string{"Content-Digest": "unixsum=:AA==:, sha-512=:" + b64(sha512Sum[:]) + ":"}},
+		{name: "content mismatch", header: map[string]string{"Content-Digest": "sha-256=:" + b64(other[:]) + ":"}, wantErr: ErrDigestMismatch},
+		{name: "content invalid", header: map[string]string{"Content-Digest": "sha-256=nope"}, wantErr: ErrInvalidDigest},
+		{name: "repr sha-256", header: map[string]string{"Repr-Digest": "sha-256=:" + b64(sha256Sum[:]) + ":"}, repr: true},
+		{name: "repr mismatch", header: map[string]string{"Repr-Digest": "sha-512=:" + b64(other[:]) + ":"}, repr: true, wantErr: ErrDigestMismatch},
+		{name: "content md5", header: map[string]string{"Content-MD5": b64(md5Sum[:])}, repr: true},
+		{name: "content md5 mismatch", header: map[string]string{"Content-MD5": b64(other[:16])}, repr: true, wantErr: ErrDigestMismatch},
+		{name: "content md5 invalid", header: map[string]string{"Content-MD5": "not base64!"}, repr: true, wantErr: ErrInvalidDigest},
+		{name: "repr ignores content digest", header: map[string]string{"Content-Digest": "sha-256=:" + b64(other[:]) + ":"}, repr: true},
+		{name: "content ignores repr digest", header: map[string]string{"Repr-Digest": "sha-256=:" + b64(other[:]) + ":"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for name, value := range tt.header {
+				h.Set(name, value)
+			}
+			verify := VerifyContentDigest
+			if tt.repr {
+				verify = VerifyReprDigest
+			}
+			if err := verify(h, sums); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReprDigest(t *testing.T) {
+	sums, err := ComputeChecksum(context.Background(), strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ReprDigest(sums.SHA256), "sha-256=:"+b64(sha256Sum[:])+":"; got != want {
+		t.Errorf("ReprDigest() = %q, want %q", got, want)
+	}
+	for _, checksum := range []string{"", "abc", sums.MD5} {
+		if got := ReprDigest(checksum); got != "" {
+			t.Errorf("ReprDigest(%q) = %q, want none", checksum, got)
+		}
+	}
+}
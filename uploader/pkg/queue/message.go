@@ -1,6 +1,62 @@
 package queue
 
+import "time"
+
+const (
+	UploadedSubject = "videos.uploaded"
+	// Published by the handler once the backup of a file is stored
+	BackedUpSubject = "videos.backedup"
+	DeletedSubject  = "videos.deleted"
+	// Asks the handler to restore the backup of an archived file into the
+	// primary bucket, which it reports on RehydratedSubject
+	RehydrateSubject  = "videos.rehydrate"
+	RehydratedSubject = "videos.rehydrated"
+)
+
+// Message reports an uploaded file version. Filename is the key of its
+// object.
 type Message struct {
 	Bucket   string `json:"bucket"`
 	Filename string `json:"filename"`
 }
+
+// DeletedMessage reports that a file was moved to the trash, or purged
+// with its objects.
+type DeletedMessage struct {
+	FileID   int       `json:"file_id"`
+	UserID   int       `json:"user_id"`
+	Bucket   string    `json:"bucket"`
+	Filename string    `json:"filename"`
+	Purged   bool      `json:"purged"`
+	Time     time.Time `json:"time"`
+}
+
+// BackupMessage reports the backup of a file version, stored under the
+// same key. Size is that of the stored, compressed copy.
+type BackupMessage struct {
+	Bucket   string `json:"bucket"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+}
+
+// RehydrateMessage asks for the backup of the current version of a file to
+// be decrypted, decompressed and stored as its primary copy. Checksum is
+// the SHA-256 of the original file, checked against the restored one.
+type RehydrateMessage struct {
+	FileID      int    `json:"file_id"`
+	Filename    string `json:"filename"`
+	ObjectKey   string `json:"object_key"`
+	ContentType string `json:"content_type"`
+	Checksum    string `json:"checksum"`
+}
+
+// RehydratedMessage reports a finished rehydration. Error is set if the
+// backup could not be restored and will not be retried.
+type RehydratedMessage struct {
+	FileID    int    `json:"file_id"`
+	Filename  string `json:"filename"`
+	ObjectKey string `json:"object_key"`
+	Bucket    string `json:"bucket"`
+	Size      int64  `json:"size"`
+	Error     string `json:"error,omitempty"`
+}
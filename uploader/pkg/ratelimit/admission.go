@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/config"
+	"video-platform/uploader/pkg/monitoring"
+)
+
+// Admission limits how many uploads run at the same time, per user and
+// across the instance. A user over their limit gets 429, everyone gets 503
+// while the instance is full.
+type Admission struct {
+	live       *config.Live
+	retryAfter time.Duration
+
+	mu      sync.Mutex
+	total   int
+	perUser map[int]int
+}
+
+func NewAdmission(live *config.Live, retryAfter time.Duration) *Admission {
+	return &Admission{live: live, retryAfter: retryAfter, perUser: make(map[int]int)}
+}
+
+// Limit admits the request to next if there is capacity. It has to run
+// after authentication.
+func (a *Admission) Limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rl := a.live.RateLimits()
+		userLimit := rl.ForRoles(principal.Roles).ConcurrentUploads
+
+		a.mu.Lock()
+		switch {
+		case userLimit > 0 && a.perUser[principal.UserID] >= userLimit:
+			a.mu.Unlock()
+			monitoring.RateLimitRejections.WithLabelValues("user", "concurrent_uploads").Inc()
+			reject(w, http.StatusTooManyRequests, a.retryAfter, "Too many uploads in progress")
+			return
+		case rl.MaxConcurrentUploads > 0 && a.total >= rl.MaxConcurrentUploads:
+			a.mu.Unlock()
+			monitoring.RateLimitRejections.WithLabelValues("global", "concurrent_uploads").Inc()
+			reject(w, http.StatusServiceUnavailable, a.retryAfter, "Upload capacity exhausted, try again later")
+			return
+		}
+		a.total++
+		a.perUser[principal.UserID]++
+		monitoring.UploadsInFlight.Set(float64(a.total))
+		a.mu.Unlock()
+
+		defer func() {
+			a.mu.Lock()
+			a.total--
+			if a.perUser[principal.UserID]--; a.perUser[principal.UserID] == 0 {
+				delete(a.perUser, principal.UserID)
+			}
+			monitoring.UploadsInFlight.Set(float64(a.total))
+			a.mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
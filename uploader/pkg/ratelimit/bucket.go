@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Buckets nobody used for this long are dropped, they would be full anyway
+const idleTimeout = 10 * time.Minute
+
+// bucket is a token bucket. Its rate and size are passed on every call, so
+// limit changes apply to existing buckets.
+type bucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time, rate, burst float64) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+}
+
+// allow takes one token if there is one, or returns how long until there
+// will be.
+func (b *bucket) allow(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now, rate, float64(max(burst, 1)))
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how long
+// to wait until the debt is paid off.
+func (b *bucket) reserve(now time.Time, rate float64, burst int64, n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now, rate, float64(max(burst, 1)))
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// buckets holds a bucket per key.
+type buckets struct {
+	mu      sync.Mutex
+	m       map[string]*bucketEntry
+	sweptAt time.Time
+}
+
+type bucketEntry struct {
+	bucket
+	used time.Time
+}
+
+func newBuckets() *buckets {
+	return &buckets{m: make(map[string]*bucketEntry)}
+}
+
+func (bs *buckets) get(key string, now time.Time) *bucket {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if now.Sub(bs.sweptAt) > time.Minute {
+		for k, e := range bs.m {
+			if now.Sub(e.used) > idleTimeout {
+				delete(bs.m, k)
+			}
+		}
+		bs.sweptAt = now
+	}
+	e, ok := bs.m[key]
+	if !ok {
+		e = &bucketEntry{}
+		bs.m[key] = e
+	}
+	e.used = now
+	return &e.bucket
+}
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/auth"
+	"video-platform/uploader/pkg/config"
+	"video-platform/uploader/pkg/monitoring"
+)
+
+// Limiter rejects requests above the request rate of their client IP or
+// user with 429, and slows reading request bodies down to the byte rate.
+// Limits are read from the live config on every request.
+type Limiter struct {
+	live *config.Live
+	l    *zap.SugaredLogger
+
+	ipRequests   *buckets
+	ipBytes      *buckets
+	userRequests *buckets
+	userBytes    *buckets
+}
+
+func NewLimiter(live *config.Live, l *zap.SugaredLogger) *Limiter {
+	return &Limiter{
+		live:         live,
+		l:            l,
+		ipRequests:   newBuckets(),
+		ipBytes:      newBuckets(),
+		userRequests: newBuckets(),
+		userBytes:    newBuckets(),
+	}
+}
+
+// PerIP limits every request by its client IP, except health checks and
+// metrics scrapes.
+func (lim *Limiter) PerIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+			next.ServeHTTP(w, r)
+			return
+		}
+		limits := lim.live.RateLimits().IP
+		ip := auth.ClientIP(r)
+		if !lim.admit(w, r, "ip", lim.ipRequests, ip, limits) {
+			return
+		}
+		lim.throttleBody(r, lim.ipBytes, ip, limits)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// PerUser limits requests of the authenticated caller by the limits of
+// their roles. It has to run after authentication, see Authenticator.Use.
+func (lim *Limiter) PerUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limits := lim.live.RateLimits().ForRoles(principal.Roles)
+		key := strconv.Itoa(principal.UserID)
+		if !lim.admit(w, r, "user", lim.userRequests, key, limits) {
+			return
+		}
+		lim.throttleBody(r, lim.userBytes, key, limits)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (lim *Limiter) admit(w http.ResponseWriter, r *http.Request, scope string, bs *buckets, key string, limits config.Limits) bool {
+	if limits.RequestsPerSecond <= 0 {
+		return true
+	}
+	now := time.Now()
+	ok, wait := bs.get(key, now).allow(now, limits.RequestsPerSecond, limits.RequestBurst)
+	if ok {
+		return true
+	}
+	monitoring.RateLimitRejections.WithLabelValues(scope, "requests").Inc()
+	lim.l.Debugw("Rate limited request", zap.String("scope", scope), zap.String("key", key), zap.String("path", r.URL.Path))
+	reject(w, http.StatusTooManyRequests, wait, "Too many requests")
+	return false
+}
+
+func (lim *Limiter) throttleBody(r *http.Request, bs *buckets, key string, limits config.Limits) {
+	if limits.BytesPerSecond <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	r.Body = &throttledBody{
+		ReadCloser: r.Body,
+		ctx:        r.Context(),
+		bucket:     bs.get(key, time.Now()),
+		limits:     limits,
+	}
+}
+
+// reject answers with status and a Retry-After of at least a second.
+func reject(w http.ResponseWriter, status int, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	http.Error(w, message, status)
+}
+
+// throttledBody delays reads so that they do not exceed the byte rate of
+// its bucket, which may be shared with other requests of the same key.
+type throttledBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *bucket
+	limits config.Limits
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if burst := b.limits.ByteBurst; burst > 0 && int64(len(p)) > burst {
+		p = p[:burst]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	wait := b.bucket.reserve(time.Now(), float64(b.limits.BytesPerSecond), b.limits.ByteBurst, n)
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-b.ctx.Done():
+			return n, b.ctx.Err()
+		}
+	}
+	return n, err
+}
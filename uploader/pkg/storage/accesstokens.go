@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+type AccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+
+	// Owner details, only set when the token is looked up by hash
+	Username   string   `json:"-"`
+	UserStatus string   `json:"-"`
+	UserRoles  []string `json:"-"`
+}
+
+func CreateAccessToken(ctx context.Context, db *sql.DB, t *AccessToken, tokenHash string) error {
+	return db.QueryRowContext(ctx, `
+		INSERT INTO personal_access_tokens (user_id, name, token_hash, prefix, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`,
+		t.UserID, t.Name, tokenHash, t.Prefix, strings.Join(t.Scopes, " "), t.ExpiresAt).Scan(&t.ID, &t.CreatedAt)
+}
+
+// GetAccessToken returns the token with the hash together with its owner.
+func GetAccessToken(ctx context.Context, db *sql.DB, tokenHash string) (*AccessToken, error) {
+	row := db.QueryRowContext(ctx, `
+		SELECT t.id, t.user_id, t.name, t.prefix, t.scopes, t.created_at, t.expires_at,
+			t.last_used_at, COALESCE(t.last_used_ip, ''), t.revoked_at, u.username, u.status
+		FROM personal_access_tokens t JOIN app_users u ON u.id = t.user_id
+		WHERE t.token_hash = $1`, tokenHash)
+	var t AccessToken
+	if err := scanAccessToken(row, &t, &t.Username, &t.UserStatus); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ListAccessTokens returns the tokens of the user that were not revoked.
+func ListAccessTokens(ctx context.Context, db *sql.DB, userID int) ([]AccessToken, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, user_id, name, prefix, scopes, created_at, expires_at,
+			last_used_at, COALESCE(last_used_ip, ''), revoked_at
+		FROM personal_access_tokens WHERE user_id = $1 AND revoked_at IS NULL ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []AccessToken{}
+	for rows.Next() {
+		var t AccessToken
+		if err := scanAccessToken(rows, &t); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAccessToken revokes a token of the user. It returns sql.ErrNoRows
+// if the user has no such token.
+func RevokeAccessToken(ctx context.Context, db *sql.DB, userID, tokenID int) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE personal_access_tokens SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`, tokenID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func TouchAccessToken(ctx context.Context, db *sql.DB, tokenID int, clientIP string) error {
+	_, err := db.ExecContext(ctx, `UPDATE personal_access_tokens SET last_used_at = NOW(), last_used_ip = $2 WHERE id = $1`, tokenID, clientIP)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanAccessToken scans the token columns followed by extra.
+func scanAccessToken(row scanner, t *AccessToken, extra ...interface{}) error {
+	var scopes string
+	var lastUsedAt, revokedAt sql.NullTime
+	dest := []interface{}{&t.ID, &t.UserID, &t.Name, &t.Prefix, &scopes, &t.CreatedAt, &t.ExpiresAt, &lastUsedAt, &t.LastUsedIP, &revokedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	t.Scopes = strings.Fields(scopes)
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		t.RevokedAt = &revokedAt.Time
+	}
+	return nil
+}
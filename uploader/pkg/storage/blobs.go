@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+)
+
+// BlobKey returns the object key of content with the SHA-256 checksum, the
+// same for every upload of it.
+func BlobKey(checksum string) string {
+	return "blobs/" + checksum
+}
+
+// acquireBlob adds a reference to the blob stored under the key, creating
+// it if needed. The blob stays locked until the transaction ends, which
+// MarkCopyDeleted and DropBlob wait for before removing its object. It
+// reports whether the object may be missing: the blob is new, or no
+// version has its primary copy any more.
+func acquireBlob(ctx context.Context, tx *sql.Tx, key, checksum string, size int64) (bool, error) {
+	var created bool
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO blobs (object_key, sha256, size, refcount) VALUES ($1, NULLIF($2, ''), $3, 1)
+		ON CONFLICT (object_key) DO UPDATE SET refcount = blobs.refcount + 1
+		RETURNING xmax = 0`, key, checksum, size).Scan(&created)
+	if err != nil || created {
+		return created, err
+	}
+	var missing bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT NOT EXISTS (SELECT 1 FROM file_versions WHERE object_key = $1 AND primary_deleted_at IS NULL)`, key).Scan(&missing)
+	return missing, err
+}
+
+// releaseBlobs drops the references of the versions matching the condition
+// on file_versions v, which the caller deletes next, and returns the keys
+// of the blobs left without any. Pass them to DropBlob once the
+// transaction is committed.
+func releaseBlobs(ctx context.Context, tx *sql.Tx, cond string, args ...interface{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE blobs b SET refcount = b.refcount - r.n
+		FROM (SELECT v.object_key, COUNT(*) AS n FROM file_versions v WHERE `+cond+` GROUP BY v.object_key) r
+		WHERE b.object_key = r.object_key
+		RETURNING b.object_key, b.refcount`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var unreferenced []string
+	for rows.Next() {
+		var key string
+		var refcount int
+		if err := rows.Scan(&key, &refcount); err != nil {
+			return nil, err
+		}
+		if refcount == 0 {
+			unreferenced = append(unreferenced, key)
+		}
+	}
+	return unreferenced, rows.Err()
+}
+
+// DropBlob removes the object of the blob under the key with remove, then
+// the blob, if no version uses it. The blob is locked meanwhile, and also
+// created if it was never recorded, so an upload of the same content waits
+// and stores the object again. If remove fails the unused blob is kept.
+func DropBlob(ctx context.Context, db *sql.DB, key string, remove func(key string) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var refcount int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO blobs (object_key, size, refcount) VALUES ($1, 0, 0)
+		ON CONFLICT (object_key) DO UPDATE SET refcount = blobs.refcount
+		RETURNING refcount`, key).Scan(&refcount)
+	if err != nil || refcount > 0 {
+		return err
+	}
+	if err := remove(key); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM blobs WHERE object_key = $1`, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ObjectHold returns the strongest hold of the files that use the object.
+func ObjectHold(ctx context.Context, db *sql.DB, key string) (Hold, error) {
+	var hold Hold
+	var retainUntil sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(BOOL_OR(f.legal_hold), FALSE), MAX(f.retain_until)
+		FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE v.object_key = $1`, key).Scan(&hold.LegalHold, &retainUntil)
+	hold.RetainUntil = nullTime(retainUntil)
+	return hold, err
+}
+
+// FileObject is an object a file uses, with the strongest hold of the
+// other files that use it too.
+type FileObject struct {
+	Key    string
+	Others Hold
+}
+
+// ListFileObjects returns the objects of all versions of the file.
+func ListFileObjects(ctx context.Context, db *sql.DB, fileID int) ([]FileObject, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT v.object_key, COALESCE(BOOL_OR(o.legal_hold), FALSE), MAX(o.retain_until)
+		FROM file_versions v
+		LEFT JOIN file_versions ov ON ov.object_key = v.object_key AND ov.file_id <> v.file_id
+		LEFT JOIN files o ON o.id = ov.file_id
+		WHERE v.file_id = $1
+		GROUP BY v.object_key ORDER BY v.object_key`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []FileObject
+	for rows.Next() {
+		var o FileObject
+		var retainUntil sql.NullTime
+		if err := rows.Scan(&o.Key, &o.Others.LegalHold, &retainUntil); err != nil {
+			return nil, err
+		}
+		o.Others.RetainUntil = nullTime(retainUntil)
+		objects = append(objects, o)
+	}
+	return objects, rows.Err()
+}
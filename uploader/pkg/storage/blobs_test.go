@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scriptedDB is a database/sql driver that answers statements containing
+// a given fragment with fixed rows, and logs what it was asked to do. It
+// only checks how the code reacts to the answers, the SQL itself needs
+// Postgres.
+type scriptedDB struct {
+	answers []answer
+	log     []string
+}
+
+type answer struct {
+	fragment string
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+func openScripted(t *testing.T, answers ...answer) (*sql.DB, *scriptedDB) {
+	s := &scriptedDB{answers: answers}
+	db := sql.OpenDB(s)
+	t.Cleanup(func() { db.Close() })
+	return db, s
+}
+
+func (s *scriptedDB) Connect(context.Context) (driver.Conn, error) { return s, nil }
+func (s *scriptedDB) Driver() driver.Driver                        { return nil }
+func (s *scriptedDB) Close() error                                 { return nil }
+func (s *scriptedDB) Begin() (driver.Tx, error)                    { return s, nil }
+
+func (s *scriptedDB) Commit() error {
+	s.log = append(s.log, "COMMIT")
+	return nil
+}
+
+func (s *scriptedDB) Rollback() error {
+	s.log = append(s.log, "ROLLBACK")
+	return nil
+}
+
+func (s *scriptedDB) Prepare(query string) (driver.Stmt, error) {
+	for _, a := range s.answers {
+		if strings.Contains(query, a.fragment) {
+			return &scriptedStmt{db: s, answer: a}, nil
+		}
+	}
+	return nil, errors.New("unexpected statement: " + query)
+}
+
+type scriptedStmt struct {
+	db     *scriptedDB
+	answer answer
+}
+
+func (st *scriptedStmt) Close() error  { return nil }
+func (st *scriptedStmt) NumInput() int { return -1 }
+
+func (st *scriptedStmt) Exec([]driver.Value) (driver.Result, error) {
+	st.db.log = append(st.db.log, st.answer.fragment)
+	return driver.RowsAffected(st.answer.affected), nil
+}
+
+func (st *scriptedStmt) Query([]driver.Value) (driver.Rows, error) {
+	st.db.log = append(st.db.log, st.answer.fragment)
+	return &scriptedRows{columns: st.answer.columns, rows: st.answer.rows}, nil
+}
+
+type scriptedRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *scriptedRows) Columns() []string { return r.columns }
+func (r *scriptedRows) Close() error      { return nil }
+
+func (r *scriptedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestDropBlob(t *testing.T) {
+	errRemove := errors.New("remove failed")
+	tests := []struct {
+		name        string
+		refcount    int64
+		removeErr   error
+		wantRemoved bool
+		wantErr     error
+		wantLog     []string
+	}{
+		{
+			name:     "still referenced",
+			refcount: 1,
+			wantLog:  []string{"INSERT INTO blobs", "ROLLBACK"},
+		},
+		{
+			name:        "unreferenced",
+			refcount:    0,
+			wantRemoved: true,
+			wantLog:     []string{"INSERT INTO blobs", "DELETE FROM blobs", "COMMIT"},
+		},
+		{
+			name:        "remove fails",
+			refcount:    0,
+			removeErr:   errRemove,
+			wantRemoved: true,
+			wantErr:     errRemove,
+			wantLog:     []string{"INSERT INTO blobs", "ROLLBACK"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := openScripted(t,
+				answer{fragment: "INSERT INTO blobs", columns: []string{"refcount"}, rows: [][]driver.Value{{tt.refcount}}},
+				answer{fragment: "DELETE FROM blobs", affected: 1},
+			)
+			var removed []string
+			err := DropBlob(context.Background(), db, "blobs/abc", func(key string) error {
+				removed = append(removed, key)
+				return tt.removeErr
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DropBlob() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantRemoved != (len(removed) == 1 && removed[0] == "blobs/abc") {
+				t.Errorf("removed %v, want removed %v", removed, tt.wantRemoved)
+			}
+			if !reflect.DeepEqual(script.log, tt.wantLog) {
+				t.Errorf("statements = %q, want %q", script.log, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestReleaseBlobs(t *testing.T) {
+	db, _ := openScripted(t, answer{
+		fragment: "UPDATE blobs b SET refcount",
+		columns:  []string{"object_key", "refcount"},
+		rows:     [][]driver.Value{{"blobs/a", int64(0)}, {"blobs/b", int64(2)}, {"blobs/c", int64(0)}},
+	})
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	got, err := releaseBlobs(context.Background(), tx, `v.file_id = $1`, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"blobs/a", "blobs/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("releaseBlobs() = %v, want the unreferenced %v", got, want)
+	}
+}
+
+func TestAcquireBlob(t *testing.T) {
+	tests := []struct {
+		name        string
+		created     bool
+		noPrimary   bool
+		wantMissing bool
+		wantLog     []string
+	}{
+		{name: "new blob", created: true, wantMissing: true, wantLog: []string{"INSERT INTO blobs"}},
+		{name: "existing blob", wantLog: []string{"INSERT INTO blobs", "SELECT NOT EXISTS"}},
+		{name: "existing blob without a primary copy", noPrimary: true, wantMissing: true, wantLog: []string{"INSERT INTO blobs", "SELECT NOT EXISTS"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := openScripted(t,
+				answer{fragment: "INSERT INTO blobs", columns: []string{"created"}, rows: [][]driver.Value{{tt.created}}},
+				answer{fragment: "SELECT NOT EXISTS", columns: []string{"missing"}, rows: [][]driver.Value{{tt.noPrimary}}},
+			)
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			missing, err := acquireBlob(context.Background(), tx, "blobs/abc", "abc", 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if missing != tt.wantMissing {
+				t.Errorf("acquireBlob() missing = %v, want %v", missing, tt.wantMissing)
+			}
+			if !reflect.DeepEqual(script.log, tt.wantLog) {
+				t.Errorf("statements = %q, want %q", script.log, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestBlobKey(t *testing.T) {
+	if BlobKey("abc") != BlobKey("abc") || BlobKey("abc") == BlobKey("abd") {
+		t.Error("BlobKey() is not one key per checksum")
+	}
+}
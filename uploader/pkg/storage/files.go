@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrFileExists = errors.New("an active file with the same name exists")
+
+const (
+	FileActive  = "active"
+	FileTrashed = "trashed"
+)
+
+// Tiers of a file, see tiering.Tiering
+const (
+	TierHot         = "hot"
+	TierArchived    = "archived"
+	TierRehydrating = "rehydrating"
+)
+
+// Hold keeps a file from being deleted while LegalHold is set or until
+// RetainUntil.
+type Hold struct {
+	LegalHold       bool       `json:"legal_hold"`
+	LegalHoldReason string     `json:"legal_hold_reason,omitempty"`
+	RetainUntil     *time.Time `json:"retain_until,omitempty"`
+}
+
+// Active reports whether the hold prevents deletion at the time.
+func (h Hold) Active(at time.Time) bool {
+	return h.LegalHold || (h.RetainUntil != nil && h.RetainUntil.After(at))
+}
+
+// Condition on files that may be deleted now
+const notHeld = `NOT legal_hold AND (retain_until IS NULL OR retain_until <= NOW())`
+
+// File is a file with the content of its current version.
+type File struct {
+	ID          int        `json:"id"`
+	Filename    string     `json:"filename"`
+	Version     int        `json:"version"`
+	ObjectKey   string     `json:"-"`
+	Filesize    int64      `json:"filesize"`
+	ContentType string     `json:"content_type"`
+	ETag        string     `json:"etag"`
+	FileURL     string     `json:"file_url"`
+	Checksum    string     `json:"checksum"`
+	UserID      int        `json:"user_id"`
+	UploadedAt  time.Time  `json:"upload_timestamp"`
+	Status      string     `json:"status"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Tier        string     `json:"tier"`
+	Hold
+}
+
+const fileColumns = `id, filename, version, object_key, filesize, COALESCE(content_type, ''), COALESCE(etag, ''), file_url,
+	COALESCE(checksum, ''), COALESCE(user_id, 0), upload_timestamp, status, deleted_at, tier,
+	legal_hold, COALESCE(legal_hold_reason, ''), retain_until`
+
+func scanFile(row scanner) (*File, error) {
+	var f File
+	var deletedAt, retainUntil sql.NullTime
+	if err := row.Scan(&f.ID, &f.Filename, &f.Version, &f.ObjectKey, &f.Filesize, &f.ContentType, &f.ETag, &f.FileURL,
+		&f.Checksum, &f.UserID, &f.UploadedAt, &f.Status, &deletedAt, &f.Tier,
+		&f.LegalHold, &f.LegalHoldReason, &retainUntil); err != nil {
+		return nil, err
+	}
+	f.DeletedAt, f.RetainUntil = nullTime(deletedAt), nullTime(retainUntil)
+	return &f, nil
+}
+
+// GetFile returns the file whatever its status.
+func GetFile(ctx context.Context, db *sql.DB, id int) (*File, error) {
+	return scanFile(db.QueryRowContext(ctx, `SELECT `+fileColumns+` FROM files WHERE id = $1`, id))
+}
+
+func listFiles(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]File, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []File{}
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, *f)
+	}
+	return files, rows.Err()
+}
+
+// ListFiles returns the files with the status, of the user or of everyone
+// if userID is 0.
+func ListFiles(ctx context.Context, db *sql.DB, userID int, status string) ([]File, error) {
+	return listFiles(ctx, db, `
+		SELECT `+fileColumns+` FROM files
+		WHERE status = $1 AND ($2 = 0 OR user_id = $2) ORDER BY id`, status, userID)
+}
+
+// TrashFile moves an active file to the trash. It returns sql.ErrNoRows if
+// there is no such active file or it is held.
+func TrashFile(ctx context.Context, db *sql.DB, id, deletedBy int) (time.Time, error) {
+	var deletedAt time.Time
+	err := db.QueryRowContext(ctx, `
+		UPDATE files SET status = 'trashed', deleted_at = NOW(), deleted_by = NULLIF($2, 0)
+		WHERE id = $1 AND status = 'active' AND `+notHeld+` RETURNING deleted_at`, id, deletedBy).Scan(&deletedAt)
+	return deletedAt, err
+}
+
+// RestoreFile makes a file trashed after since active again. It returns
+// sql.ErrNoRows if there is no such file and ErrFileExists if the owner has
+// an active file with the same name, e.g. one uploaded after the trashed
+// file was deleted.
+func RestoreFile(ctx context.Context, db *sql.DB, id int, since time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var filename string
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id, filename FROM files
+		WHERE id = $1 AND status = 'trashed' AND deleted_at > $2`, id, since).Scan(&userID, &filename)
+	if err != nil {
+		return err
+	}
+	// Serialized with uploads, which create files under the same lock
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM app_users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return err
+	}
+	existing, err := ActiveFileID(ctx, tx, userID, filename)
+	if err != nil {
+		return err
+	}
+	if existing != 0 {
+		return ErrFileExists
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE files SET status = 'active', deleted_at = NULL, deleted_by = NULL
+		WHERE id = $1 AND status = 'trashed' AND deleted_at > $2`, id, since)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// ListExpiredTrash returns up to limit files trashed before the time that
+// are not held.
+func ListExpiredTrash(ctx context.Context, db *sql.DB, before time.Time, limit int) ([]File, error) {
+	return listFiles(ctx, db, `
+		SELECT `+fileColumns+` FROM files
+		WHERE status = 'trashed' AND deleted_at <= $1 AND `+notHeld+`
+		ORDER BY deleted_at LIMIT $2`, before, limit)
+}
+
+// DeleteTrashedFile removes the rows of a trashed file and its versions.
+// It returns sql.ErrNoRows if the file is not in the trash, e.g. because it
+// was restored or another replica purged it first, or if it is held. It
+// returns the keys of blobs no longer used by any version, for DropBlob.
+func DeleteTrashedFile(ctx context.Context, db *sql.DB, id int) ([]string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var locked int
+	err = tx.QueryRowContext(ctx, `
+		SELECT id FROM files WHERE id = $1 AND status = 'trashed' AND `+notHeld+` FOR UPDATE`, id).Scan(&locked)
+	if err != nil {
+		return nil, err
+	}
+	unreferenced, err := releaseBlobs(ctx, tx, `v.file_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM files WHERE id = $1`, id); err != nil {
+		return nil, err
+	}
+	return unreferenced, tx.Commit()
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SetLegalHold places or releases the legal hold of a file. It returns
+// sql.ErrNoRows if there is no such file.
+func SetLegalHold(ctx context.Context, db *sql.DB, id int, hold bool, reason string, updatedBy int) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE files SET legal_hold = $2, legal_hold_reason = NULLIF($3, ''),
+			hold_updated_by = NULLIF($4, 0), hold_updated_at = NOW()
+		WHERE id = $1`, id, hold, reason, updatedBy)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetRetainUntil sets until when a file must be kept, nil for no
+// retention. It returns sql.ErrNoRows if there is no such file.
+func SetRetainUntil(ctx context.Context, db *sql.DB, id int, until *time.Time, updatedBy int) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE files SET retain_until = $2, hold_updated_by = NULLIF($3, 0), hold_updated_at = NOW()
+		WHERE id = $1`, id, until, updatedBy)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListHeldFiles returns the files under a legal hold or retention, whatever
+// their status.
+func ListHeldFiles(ctx context.Context, db *sql.DB) ([]File, error) {
+	return listFiles(ctx, db, `
+		SELECT `+fileColumns+` FROM files
+		WHERE NOT (`+notHeld+`) ORDER BY id`)
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrIdentityLinked = errors.New("identity is already linked to a user")
+
+type Identity struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"-"`
+	Issuer      string     `json:"issuer"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// OIDCLoginState is an authorization request waiting for its callback.
+type OIDCLoginState struct {
+	Nonce        string
+	CodeVerifier string
+	LinkUserID   int
+}
+
+// GetIdentityUser returns the user linked to the identity, or
+// sql.ErrNoRows.
+func GetIdentityUser(ctx context.Context, db *sql.DB, issuer, subject string) (int, error) {
+	var userID int
+	err := db.QueryRowContext(ctx, `SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2`, issuer, subject).Scan(&userID)
+	return userID, err
+}
+
+// LinkIdentity links the identity to the user. It returns
+// ErrIdentityLinked if it is linked already.
+func LinkIdentity(ctx context.Context, db *sql.DB, userID int, id *Identity) error {
+	return linkIdentity(ctx, db, userID, id)
+}
+
+// execer is a *sql.DB or *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func linkIdentity(ctx context.Context, db execer, userID int, id *Identity) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO user_identities (user_id, issuer, subject, email, last_login_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NOW())`, userID, id.Issuer, id.Subject, id.Email)
+	if isUniqueViolation(err) {
+		return ErrIdentityLinked
+	}
+	return err
+}
+
+// TouchIdentity records a sign-in through the identity and the email the
+// provider reported for it.
+func TouchIdentity(ctx context.Context, db *sql.DB, issuer, subject, email string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE user_identities SET last_login_at = NOW(), email = NULLIF($3, '')
+		WHERE issuer = $1 AND subject = $2`, issuer, subject, email)
+	return err
+}
+
+func ListIdentities(ctx context.Context, db *sql.DB, userID int) ([]Identity, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, user_id, issuer, subject, COALESCE(email, ''), created_at, last_login_at
+		FROM user_identities WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var id Identity
+		if err := rows.Scan(&id.ID, &id.UserID, &id.Issuer, &id.Subject, &id.Email, &id.CreatedAt, &id.LastLoginAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	return identities, rows.Err()
+}
+
+// UnlinkIdentity removes an identity of the user. It returns sql.ErrNoRows
+// if there is no such identity.
+func UnlinkIdentity(ctx context.Context, db *sql.DB, userID, identityID int) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM user_identities WHERE id = $1 AND user_id = $2`, identityID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func StoreOIDCLoginState(ctx context.Context, db *sql.DB, stateHash string, s *OIDCLoginState, expiresAt time.Time) error {
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO oidc_login_states (state_hash, nonce, code_verifier, link_user_id, expires_at)
+		VALUES ($1, $2, $3, NULLIF($4, 0), $5)`, stateHash, s.Nonce, s.CodeVerifier, s.LinkUserID, expiresAt); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, `DELETE FROM oidc_login_states WHERE expires_at < NOW()`)
+	return err
+}
+
+// TakeOIDCLoginState removes and returns a state that has not expired, or
+// sql.ErrNoRows. Each state can be used once.
+func TakeOIDCLoginState(ctx context.Context, db *sql.DB, stateHash string) (*OIDCLoginState, error) {
+	var s OIDCLoginState
+	var linkUserID sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+		DELETE FROM oidc_login_states WHERE state_hash = $1 AND expires_at > NOW()
+		RETURNING nonce, code_verifier, link_user_id`, stateHash).Scan(&s.Nonce, &s.CodeVerifier, &linkUserID)
+	if err != nil {
+		return nil, err
+	}
+	s.LinkUserID = int(linkUserID.Int64)
+	return &s, nil
+}
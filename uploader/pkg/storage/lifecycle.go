@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Copies of a file version tracked by the lifecycle job, also the prefix of
+// their columns in file_versions
+const (
+	CopyPrimary = "primary"
+	CopyBackup  = "backup"
+)
+
+// CopyState is the lifecycle state of one copy of a file version.
+type CopyState struct {
+	Policy    string     `json:"policy,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// LifecycleFile is a version of an active file with what lifecycle
+// policies match on and the hold of the file, which keeps expired copies.
+// Policies apply to each version from its own upload.
+type LifecycleFile struct {
+	ID         int
+	Filename   string
+	UserID     int
+	VersionID  int
+	Version    int
+	ObjectKey  string
+	Current    bool
+	UploadedAt time.Time
+	Roles      []string
+	Tags       []string
+	Copies     map[string]*CopyState
+	// When the primary copy was last restored from the backup
+	RehydratedAt *time.Time
+	Hold
+}
+
+// ListLifecycleFiles returns up to limit versions of active files with an
+// id above afterID, in id order.
+func ListLifecycleFiles(ctx context.Context, db *sql.DB, afterID, limit int) ([]LifecycleFile, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT f.id, f.filename, COALESCE(f.user_id, 0), v.id, v.version, v.object_key, v.version = f.version, v.uploaded_at,
+			COALESCE((SELECT STRING_AGG(r.name, ',') FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+				WHERE ur.user_id = f.user_id), ''),
+			COALESCE((SELECT STRING_AGG(t.tag, ',') FROM file_tags t WHERE t.file_id = f.id), ''),
+			COALESCE(v.primary_policy, ''), v.primary_expires_at, v.primary_deleted_at,
+			COALESCE(v.backup_policy, ''), v.backup_expires_at, v.backup_deleted_at,
+			v.rehydrated_at, f.legal_hold, f.retain_until
+		FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE f.status = 'active' AND v.id > $1
+		ORDER BY v.id LIMIT $2`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []LifecycleFile
+	for rows.Next() {
+		var f LifecycleFile
+		var roles, tags string
+		var primary, backup CopyState
+		var primaryExpires, primaryDeleted, backupExpires, backupDeleted, rehydratedAt, retainUntil sql.NullTime
+		if err := rows.Scan(&f.ID, &f.Filename, &f.UserID, &f.VersionID, &f.Version, &f.ObjectKey, &f.Current, &f.UploadedAt, &roles, &tags,
+			&primary.Policy, &primaryExpires, &primaryDeleted,
+			&backup.Policy, &backupExpires, &backupDeleted, &rehydratedAt, &f.LegalHold, &retainUntil); err != nil {
+			return nil, err
+		}
+		f.Roles, f.Tags = splitList(roles), splitList(tags)
+		primary.ExpiresAt, primary.DeletedAt = nullTime(primaryExpires), nullTime(primaryDeleted)
+		backup.ExpiresAt, backup.DeletedAt = nullTime(backupExpires), nullTime(backupDeleted)
+		f.RehydratedAt, f.RetainUntil = nullTime(rehydratedAt), nullTime(retainUntil)
+		f.Copies = map[string]*CopyState{CopyPrimary: &primary, CopyBackup: &backup}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// copyColumn returns the column of a copy, which must be CopyPrimary or
+// CopyBackup.
+func copyColumn(which, column string) string {
+	if which != CopyPrimary && which != CopyBackup {
+		panic("storage: unknown copy " + which)
+	}
+	return which + "_" + column
+}
+
+// SetCopyLifecycle records the policy of a copy of a file version and when
+// the copy expires, nil if never.
+func SetCopyLifecycle(ctx context.Context, db *sql.DB, versionID int, which, policy string, expiresAt *time.Time) error {
+	_, err := db.ExecContext(ctx, `UPDATE file_versions SET `+copyColumn(which, "policy")+` = NULLIF($2, ''), `+
+		copyColumn(which, "expires_at")+` = $3 WHERE id = $1`, versionID, policy, expiresAt)
+	return err
+}
+
+// MarkCopyDeleted records that a copy of a version of an active file is
+// removed, which archives the file if it is the primary copy of the current
+// version, and removes its object with remove unless other versions of the
+// same content still have their copy. The blob of the object is locked
+// until then, so uploads of the same content wait and find the copy gone.
+// It returns sql.ErrNoRows if the file is no longer active, is held or the
+// copy was already removed.
+func MarkCopyDeleted(ctx context.Context, db *sql.DB, versionID int, which string, remove func(key string) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var key string
+	err = tx.QueryRowContext(ctx, `
+		SELECT b.object_key FROM blobs b JOIN file_versions v ON v.object_key = b.object_key
+		WHERE v.id = $1 FOR UPDATE OF b`, versionID).Scan(&key)
+	if err != nil {
+		return err
+	}
+
+	var fileID int
+	var current bool
+	err = tx.QueryRowContext(ctx, `
+		UPDATE file_versions v SET `+copyColumn(which, "deleted_at")+` = NOW()
+		FROM files f
+		WHERE v.id = $1 AND f.id = v.file_id AND f.status = 'active' AND `+notHeld+` AND v.`+copyColumn(which, "deleted_at")+` IS NULL
+		RETURNING f.id, v.version = f.version`, versionID).Scan(&fileID, &current)
+	if err != nil {
+		return err
+	}
+	if which == CopyPrimary && current {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE files SET tier = 'archived', tier_changed_at = NOW() WHERE id = $1`, fileID); err != nil {
+			return err
+		}
+	}
+
+	var shared bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM file_versions WHERE object_key = $1 AND id <> $2 AND `+copyColumn(which, "deleted_at")+` IS NULL)`,
+		key, versionID).Scan(&shared)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		if err := remove(key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// TryAdvisoryLock takes a session level advisory lock on the connection,
+// without waiting. It is held until the session ends, returning the
+// connection to the pool does not release it.
+func TryAdvisoryLock(ctx context.Context, conn *sql.Conn, key int64) (bool, error) {
+	var locked bool
+	err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&locked)
+	return locked, err
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type LoginLock struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// LoginLockRemaining returns how long the longest lock on any of the keys
+// lasts, or 0 if none of them is locked.
+func LoginLockRemaining(ctx context.Context, db *sql.DB, keys []string) (time.Duration, error) {
+	var seconds sql.NullFloat64
+	err := db.QueryRowContext(ctx, `
+		SELECT EXTRACT(EPOCH FROM MAX(locked_until) - NOW())::float8 FROM login_attempts
+		WHERE key = ANY($1) AND locked_until > NOW()`, keys).Scan(&seconds)
+	if err != nil || !seconds.Valid {
+		return 0, err
+	}
+	return time.Duration(seconds.Float64 * float64(time.Second)), nil
+}
+
+// RecordLoginFailure counts a failed attempt for the key and returns the
+// number of failures. The count starts over if the previous failure is
+// older than resetAfter.
+func RecordLoginFailure(ctx context.Context, db *sql.DB, key string, resetAfter time.Duration) (int, error) {
+	var failures int
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO login_attempts (key, failures) VALUES ($1, 1)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < NOW() - $2::float8 * INTERVAL '1 second'
+				THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = NOW()
+		RETURNING failures`, key, resetAfter.Seconds()).Scan(&failures)
+	return failures, err
+}
+
+func LockLogin(ctx context.Context, db *sql.DB, key string, d time.Duration) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE login_attempts SET locked_until = NOW() + $2::float8 * INTERVAL '1 second'
+		WHERE key = $1`, key, d.Seconds())
+	return err
+}
+
+// ClearLoginFailures forgets the failures and lock of the key. It returns
+// sql.ErrNoRows if there were none.
+func ClearLoginFailures(ctx context.Context, db *sql.DB, key string) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM login_attempts WHERE key = $1`, key)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListLoginLocks returns the keys that are currently locked.
+func ListLoginLocks(ctx context.Context, db *sql.DB) ([]LoginLock, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT key, failures, locked_until FROM login_attempts
+		WHERE locked_until > NOW() ORDER BY locked_until DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locks := []LoginLock{}
+	for rows.Next() {
+		var lock LoginLock
+		if err := rows.Scan(&lock.Key, &lock.Failures, &lock.LockedUntil); err != nil {
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, rows.Err()
+}
+
+// PruneLoginAttempts removes unlocked entries whose last failure is older
+// than resetAfter.
+func PruneLoginAttempts(ctx context.Context, db *sql.DB, resetAfter time.Duration) error {
+	_, err := db.ExecContext(ctx, `
+		DELETE FROM login_attempts
+		WHERE last_failure_at < NOW() - $1::float8 * INTERVAL '1 second'
+		AND (locked_until IS NULL OR locked_until < NOW())`, resetAfter.Seconds())
+	return err
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type MFA struct {
+	Secret      string
+	Enabled     bool
+	LastCounter int64
+}
+
+// GetMFA returns the TOTP enrollment of the user, or sql.ErrNoRows.
+func GetMFA(ctx context.Context, db *sql.DB, userID int) (*MFA, error) {
+	var m MFA
+	err := db.QueryRowContext(ctx, `SELECT secret, enabled_at IS NOT NULL, last_counter FROM user_mfa WHERE user_id = $1`, userID).
+		Scan(&m.Secret, &m.Enabled, &m.LastCounter)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// StartMFAEnrollment stores a new, not yet enabled secret. An enabled
+// enrollment is left alone and sql.ErrNoRows is returned.
+func StartMFAEnrollment(ctx context.Context, db *sql.DB, userID int, secret string) error {
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO user_mfa (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, created_at = NOW(), last_counter = 0
+		WHERE user_mfa.enabled_at IS NULL`, userID, secret)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UseMFACounter records counter as the last accepted time step. It returns
+// false if an equal or later step was already used.
+func UseMFACounter(ctx context.Context, db *sql.DB, userID int, counter int64) (bool, error) {
+	res, err := db.ExecContext(ctx, `UPDATE user_mfa SET last_counter = $2 WHERE user_id = $1 AND last_counter < $2`, userID, counter)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// EnableMFA enables the enrollment and replaces the recovery codes.
+func EnableMFA(ctx context.Context, db *sql.DB, userID int, recoveryHashes []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE user_mfa SET enabled_at = NOW() WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func ReplaceRecoveryCodes(ctx context.Context, db *sql.DB, userID int, recoveryHashes []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, recoveryHashes []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryHashes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode marks an unused recovery code as used and reports whether
+// there was one.
+func UseRecoveryCode(ctx context.Context, db *sql.DB, userID int, codeHash string) (bool, error) {
+	res, err := db.ExecContext(ctx, `
+		UPDATE mfa_recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// DisableMFA removes the enrollment and recovery codes. It returns
+// sql.ErrNoRows if the user had none.
+func DisableMFA(ctx context.Context, db *sql.DB, userID int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM user_mfa WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func StoreMFAChallenge(ctx context.Context, db *sql.DB, tokenHash string, userID int, expiresAt time.Time) error {
+	if _, err := db.ExecContext(ctx, `INSERT INTO mfa_challenges (token_hash, user_id, expires_at) VALUES ($1, $2, $3)`, tokenHash, userID, expiresAt); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, `DELETE FROM mfa_challenges WHERE expires_at < NOW()`)
+	return err
+}
+
+// GetMFAChallenge returns the user of a challenge that has not expired and
+// has fewer than maxAttempts failed attempts, or sql.ErrNoRows.
+func GetMFAChallenge(ctx context.Context, db *sql.DB, tokenHash string, maxAttempts int) (int, error) {
+	var userID int
+	err := db.QueryRowContext(ctx, `
+		SELECT user_id FROM mfa_challenges
+		WHERE token_hash = $1 AND expires_at > NOW() AND attempts < $2`, tokenHash, maxAttempts).Scan(&userID)
+	return userID, err
+}
+
+func FailMFAChallenge(ctx context.Context, db *sql.DB, tokenHash string) error {
+	_, err := db.ExecContext(ctx, `UPDATE mfa_challenges SET attempts = attempts + 1 WHERE token_hash = $1`, tokenHash)
+	return err
+}
+
+func DeleteMFAChallenge(ctx context.Context, db *sql.DB, tokenHash string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM mfa_challenges WHERE token_hash = $1`, tokenHash)
+	return err
+}
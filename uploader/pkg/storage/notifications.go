@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type Notification struct {
+	ID        int        `json:"id"`
+	Kind      string     `json:"kind"`
+	Message   string     `json:"message"`
+	FileID    *int       `json:"file_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+// AddNotifications notifies each of the users, about the file if fileID is
+// not 0.
+func AddNotifications(ctx context.Context, db *sql.DB, userIDs []int, kind, message string, fileID int) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = int64(id)
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO notifications (user_id, kind, message, file_id)
+		SELECT UNNEST($1::integer[]), $2, $3, NULLIF($4, 0)`, ids, kind, message, fileID)
+	return err
+}
+
+// ListNotifications returns the latest notifications of the user, only the
+// unread ones if unread is set.
+func ListNotifications(ctx context.Context, db *sql.DB, userID int, unread bool, limit int) ([]Notification, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, kind, message, file_id, created_at, read_at FROM notifications
+		WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)
+		ORDER BY created_at DESC, id DESC LIMIT $3`, userID, unread, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var fileID sql.NullInt64
+		var readAt sql.NullTime
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Message, &fileID, &n.CreatedAt, &readAt); err != nil {
+			return nil, err
+		}
+		if fileID.Valid {
+			id := int(fileID.Int64)
+			n.FileID = &id
+		}
+		n.ReadAt = nullTime(readAt)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// MarkNotificationsRead marks the notifications of the user with ids up to
+// upTo as read, or all of them if upTo is 0.
+func MarkNotificationsRead(ctx context.Context, db *sql.DB, userID, upTo int) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE notifications SET read_at = NOW()
+		WHERE user_id = $1 AND read_at IS NULL AND ($2 = 0 OR id <= $2)`, userID, upTo)
+	return err
+}
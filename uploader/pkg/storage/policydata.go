@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type DenylistEntry struct {
+	ID          int        `json:"id"`
+	SubjectType string     `json:"type"`
+	Subject     string     `json:"subject"`
+	Action      string     `json:"action"`
+	Reason      string     `json:"reason"`
+	CreatedBy   int        `json:"created_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+type Suspension struct {
+	UserID         int        `json:"user_id"`
+	Reason         string     `json:"reason"`
+	SuspendedBy    int        `json:"suspended_by,omitempty"`
+	SuspendedAt    time.Time  `json:"suspended_at"`
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty"`
+}
+
+func AddDenylistEntry(ctx context.Context, db *sql.DB, e *DenylistEntry) error {
+	return db.QueryRowContext(ctx, `
+		INSERT INTO authz_denylist (subject_type, subject, action, reason, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6) RETURNING id, created_at`,
+		e.SubjectType, e.Subject, e.Action, e.Reason, e.CreatedBy, e.ExpiresAt).Scan(&e.ID, &e.CreatedAt)
+}
+
+func DeleteDenylistEntry(ctx context.Context, db *sql.DB, id int) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM authz_denylist WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListDenylist returns the entries that have not expired.
+func ListDenylist(ctx context.Context, db *sql.DB) ([]DenylistEntry, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, subject_type, subject, action, reason, COALESCE(created_by, 0), created_at, expires_at
+		FROM authz_denylist WHERE expires_at IS NULL OR expires_at > NOW() ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []DenylistEntry{}
+	for rows.Next() {
+		var e DenylistEntry
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&e.ID, &e.SubjectType, &e.Subject, &e.Action, &e.Reason, &e.CreatedBy, &e.CreatedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			e.ExpiresAt = &expiresAt.Time
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// SetSuspension suspends the user or replaces their suspension. It returns
+// sql.ErrNoRows if the user does not exist.
+func SetSuspension(ctx context.Context, db *sql.DB, s *Suspension) error {
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO user_suspensions (user_id, reason, suspended_by, suspended_until)
+		SELECT id, $2, NULLIF($3, 0), $4 FROM app_users WHERE id = $1
+		ON CONFLICT (user_id) DO UPDATE SET
+			reason = EXCLUDED.reason,
+			suspended_by = EXCLUDED.suspended_by,
+			suspended_at = NOW(),
+			suspended_until = EXCLUDED.suspended_until
+		RETURNING suspended_at`,
+		s.UserID, s.Reason, s.SuspendedBy, s.SuspendedUntil).Scan(&s.SuspendedAt)
+	return err
+}
+
+func DeleteSuspension(ctx context.Context, db *sql.DB, userID int) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM user_suspensions WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListSuspensions returns the suspensions that have not ended.
+func ListSuspensions(ctx context.Context, db *sql.DB) ([]Suspension, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT user_id, reason, COALESCE(suspended_by, 0), suspended_at, suspended_until
+		FROM user_suspensions WHERE suspended_until IS NULL OR suspended_until > NOW() ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suspensions := []Suspension{}
+	for rows.Next() {
+		var s Suspension
+		var until sql.NullTime
+		if err := rows.Scan(&s.UserID, &s.Reason, &s.SuspendedBy, &s.SuspendedAt, &until); err != nil {
+			return nil, err
+		}
+		if until.Valid {
+			s.SuspendedUntil = &until.Time
+		}
+		suspensions = append(suspensions, s)
+	}
+	return suspensions, rows.Err()
+}
+
+// SetUploadLimit overrides the upload size limit of the user. It returns
+// sql.ErrNoRows if the user does not exist.
+func SetUploadLimit(ctx context.Context, db *sql.DB, userID int, maxBytes int64, updatedBy int) error {
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO user_upload_limits (user_id, max_upload_bytes, updated_by)
+		SELECT id, $2, NULLIF($3, 0) FROM app_users WHERE id = $1
+		ON CONFLICT (user_id) DO UPDATE SET
+			max_upload_bytes = EXCLUDED.max_upload_bytes,
+			updated_by = EXCLUDED.updated_by,
+			updated_at = NOW()`,
+		userID, maxBytes, updatedBy)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func DeleteUploadLimit(ctx context.Context, db *sql.DB, userID int) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM user_upload_limits WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListUploadLimits returns the upload size limit overrides by user id.
+func ListUploadLimits(ctx context.Context, db *sql.DB) (map[int]int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT user_id, max_upload_bytes FROM user_upload_limits`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limits := make(map[int]int64)
+	for rows.Next() {
+		var userID int
+		var maxBytes int64
+		if err := rows.Scan(&userID, &maxBytes); err != nil {
+			return nil, err
+		}
+		limits[userID] = maxBytes
+	}
+	return limits, rows.Err()
+}
@@ -3,13 +3,20 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 )
 
-func StoreFileMetadata(ctx context.Context, db *sql.DB, filename string, filesize int64, contentType, etag, fileURL, checksum string, userID int) error {
+// StoreFileMetadata records an upload stored under objectKey and returns
+// its version: a new version of the active file of the user with the same
+// name if there is one, otherwise version 1 of a new file. If the object may
+// have been removed since the caller stored or found it, ensureObject is
+// called before the commit to store it again if needed.
+func StoreFileMetadata(ctx context.Context, db *sql.DB, filename, objectKey string, filesize int64, contentType, etag, fileURL, checksum string, userID int, tags []string,
+	ensureObject func() error) (int, error) {
 	tracer := otel.Tracer("uploader")
 	_, span := tracer.Start(ctx, "storeFileMetadata")
 	defer span.End()
@@ -17,6 +24,7 @@ func StoreFileMetadata(ctx context.Context, db *sql.DB, filename string, filesiz
 	// Add attributes to the span
 	span.SetAttributes(
 		attribute.String("filename", filename),
+		attribute.String("object_key", objectKey),
 		attribute.Int64("filesize", filesize),
 		attribute.String("content_type", contentType),
 		attribute.String("etag", etag),
@@ -32,11 +40,102 @@ func StoreFileMetadata(ctx context.Context, db *sql.DB, filename string, filesiz
 		attribute.String("content_type", contentType),
 	))
 
-	query := `INSERT INTO files (filename, filesize, content_type, etag, file_url, checksum, user_id) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err := db.ExecContext(ctx, query, filename, filesize, contentType, etag, fileURL, checksum, userID)
+	version, err := storeFileMetadata(ctx, db, filename, objectKey, filesize, contentType, etag, fileURL, checksum, userID, tags, ensureObject)
 	if err != nil {
 		span.SetStatus(codes.Error, "Failed to execute query")
 		span.RecordError(err)
 	}
-	return err
+	return version, err
+}
+
+// storeFileMetadata inserts the version and its tags if it fits the quota of its
+// owner, otherwise it returns a *QuotaError. Uploads of the same user are
+// serialized on their row, so parallel ones cannot overshoot together nor
+// create the same file twice.
+func storeFileMetadata(ctx context.Context, db *sql.DB, filename, objectKey string, filesize int64, contentType, etag, fileURL, checksum string, userID int, tags []string,
+	ensureObject func() error) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM app_users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return 0, err
+	}
+	id, err := ActiveFileID(ctx, tx, userID, filename)
+	if err != nil {
+		return 0, err
+	}
+	quota, err := GetQuota(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	usage, err := GetUsage(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if id != 0 {
+		err = quota.CheckVersion(usage, filesize)
+	} else {
+		err = quota.Check(usage, filesize)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Removals of the object wait for the commit from here on
+	missing, err := acquireBlob(ctx, tx, objectKey, checksum, filesize)
+	if err != nil {
+		return 0, err
+	}
+	if missing {
+		if err := ensureObject(); err != nil {
+			return 0, err
+		}
+	}
+
+	version := 1
+	if id == 0 {
+		query := `INSERT INTO files (filename, object_key, filesize, content_type, etag, file_url, checksum, user_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+		if err := tx.QueryRowContext(ctx, query, filename, objectKey, filesize, contentType, etag, fileURL, checksum, userID).Scan(&id); err != nil {
+			return 0, err
+		}
+	} else {
+		// The new version becomes the current one, hot whatever the tier
+		// of the previous one
+		err := tx.QueryRowContext(ctx, `
+			UPDATE files SET
+				version = (SELECT MAX(version) + 1 FROM file_versions WHERE file_id = $1),
+				object_key = $2, filesize = $3, content_type = $4, etag = $5, file_url = $6, checksum = $7,
+				tier = 'hot', tier_changed_at = CASE WHEN tier = 'hot' THEN tier_changed_at ELSE NOW() END
+			WHERE id = $1 RETURNING version`, id, objectKey, filesize, contentType, etag, fileURL, checksum).Scan(&version)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO file_versions (file_id, version, object_key, filesize, content_type, etag, file_url, checksum, uploaded_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		id, version, objectKey, filesize, contentType, etag, fileURL, checksum, userID); err != nil {
+		return 0, err
+	}
+	if len(tags) > 0 {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO file_tags (file_id, tag) SELECT $1, UNNEST($2::text[]) ON CONFLICT DO NOTHING`, id, tags); err != nil {
+			return 0, err
+		}
+	}
+	return version, tx.Commit()
+}
+
+// ActiveFileID returns the id of the active file of the user with the name,
+// or 0 if there is none. There is at most one, see RestoreFile.
+func ActiveFileID(ctx context.Context, db querier, userID int, filename string) (int, error) {
+	var id int
+	err := db.QueryRowContext(ctx, `
+		SELECT id FROM files WHERE user_id = $1 AND filename = $2 AND status = 'active'`, userID, filename).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
 }
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Quota limits what a user can store. A nil limit is unlimited.
+type Quota struct {
+	MaxBytes     *int64 `json:"max_bytes"`
+	MaxFiles     *int64 `json:"max_files"`
+	MaxFileBytes *int64 `json:"max_file_bytes"`
+	// "user" for an override, "role" otherwise
+	Source string `json:"source,omitempty"`
+}
+
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+// QuotaError reports which limit an upload would exceed.
+type QuotaError struct {
+	// "max_bytes", "max_files" or "max_file_bytes"
+	Limit string
+	Max   int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota %s of %d exceeded", e.Limit, e.Max)
+}
+
+// Check returns a *QuotaError if adding a file of size bytes to usage
+// would exceed the quota.
+func (q *Quota) Check(usage Usage, size int64) error {
+	switch {
+	case q.MaxFileBytes != nil && size > *q.MaxFileBytes:
+		return &QuotaError{Limit: "max_file_bytes", Max: *q.MaxFileBytes}
+	case q.MaxFiles != nil && usage.Files+1 > *q.MaxFiles:
+		return &QuotaError{Limit: "max_files", Max: *q.MaxFiles}
+	case q.MaxBytes != nil && usage.Bytes+size > *q.MaxBytes:
+		return &QuotaError{Limit: "max_bytes", Max: *q.MaxBytes}
+	}
+	return nil
+}
+
+// CheckVersion is Check for a new version of a stored file, which adds
+// bytes but no file.
+func (q *Quota) CheckVersion(usage Usage, size int64) error {
+	usage.Files--
+	return q.Check(usage, size)
+}
+
+// RemainingBytes returns how much the user can still store, or nil if that
+// is not limited.
+func (q *Quota) RemainingBytes(usage Usage) *int64 {
+	if q.MaxBytes == nil {
+		return nil
+	}
+	remaining := max(0, *q.MaxBytes-usage.Bytes)
+	return &remaining
+}
+
+func (q *Quota) RemainingFiles(usage Usage) *int64 {
+	if q.MaxFiles == nil {
+		return nil
+	}
+	remaining := max(0, *q.MaxFiles-usage.Files)
+	return &remaining
+}
+
+// Validate returns an error that can be shown to the caller if a limit is
+// negative.
+func (q *Quota) Validate() error {
+	for name, limit := range map[string]*int64{"max_bytes": q.MaxBytes, "max_files": q.MaxFiles, "max_file_bytes": q.MaxFileBytes} {
+		if limit != nil && *limit < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// querier is a *sql.DB or *sql.Tx
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// GetQuota returns the quota that applies to the user: their override, or
+// the most generous limits of their roles.
+func GetQuota(ctx context.Context, db querier, userID int) (*Quota, error) {
+	var maxBytes, maxFiles, maxFileBytes sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+		SELECT max_bytes, max_files, max_file_bytes FROM user_quotas WHERE user_id = $1`, userID).
+		Scan(&maxBytes, &maxFiles, &maxFileBytes)
+	if err == nil {
+		return newQuota(maxBytes, maxFiles, maxFileBytes, "user"), nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// A role without a limit makes it unlimited. So is everything for users
+	// none of whose roles has a quota.
+	err = db.QueryRowContext(ctx, `
+		SELECT
+			CASE WHEN BOOL_OR(q.max_bytes IS NULL) THEN NULL ELSE MAX(q.max_bytes) END,
+			CASE WHEN BOOL_OR(q.max_files IS NULL) THEN NULL ELSE MAX(q.max_files) END,
+			CASE WHEN BOOL_OR(q.max_file_bytes IS NULL) THEN NULL ELSE MAX(q.max_file_bytes) END
+		FROM user_roles ur JOIN role_quotas q ON q.role_id = ur.role_id
+		WHERE ur.user_id = $1`, userID).Scan(&maxBytes, &maxFiles, &maxFileBytes)
+	if err != nil {
+		return nil, err
+	}
+	return newQuota(maxBytes, maxFiles, maxFileBytes, "role"), nil
+}
+
+func newQuota(maxBytes, maxFiles, maxFileBytes sql.NullInt64, source string) *Quota {
+	return &Quota{
+		MaxBytes:     nullInt64(maxBytes),
+		MaxFiles:     nullInt64(maxFiles),
+		MaxFileBytes: nullInt64(maxFileBytes),
+		Source:       source,
+	}
+}
+
+func nullInt64(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// GetUsage returns what the user stores, all versions of their files. Files
+// in the trash count until they are purged.
+func GetUsage(ctx context.Context, db querier, userID int) (Usage, error) {
+	var u Usage
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(v.filesize), 0), COUNT(DISTINCT f.id)
+		FROM files f JOIN file_versions v ON v.file_id = f.id WHERE f.user_id = $1`, userID).Scan(&u.Bytes, &u.Files)
+	return u, err
+}
+
+// SetUserQuota overrides the role quotas of the user. It returns
+// sql.ErrNoRows if the user does not exist.
+func SetUserQuota(ctx context.Context, db *sql.DB, userID int, q *Quota, updatedBy int) error {
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO user_quotas (user_id, max_bytes, max_files, max_file_bytes, updated_by)
+		SELECT id, $2, $3, $4, NULLIF($5, 0) FROM app_users WHERE id = $1
+		ON CONFLICT (user_id) DO UPDATE SET
+			max_bytes = EXCLUDED.max_bytes,
+			max_files = EXCLUDED.max_files,
+			max_file_bytes = EXCLUDED.max_file_bytes,
+			updated_by = EXCLUDED.updated_by,
+			updated_at = NOW()`,
+		userID, q.MaxBytes, q.MaxFiles, q.MaxFileBytes, updatedBy)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func DeleteUserQuota(ctx context.Context, db *sql.DB, userID int) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM user_quotas WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetRoleQuota sets the quota of a role. It returns ErrUnknownRole if there
+// is no such role.
+func SetRoleQuota(ctx context.Context, db *sql.DB, role string, q *Quota, updatedBy int) error {
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO role_quotas (role_id, max_bytes, max_files, max_file_bytes, updated_by)
+		SELECT id, $2, $3, $4, NULLIF($5, 0) FROM roles WHERE name = $1
+		ON CONFLICT (role_id) DO UPDATE SET
+			max_bytes = EXCLUDED.max_bytes,
+			max_files = EXCLUDED.max_files,
+			max_file_bytes = EXCLUDED.max_file_bytes,
+			updated_by = EXCLUDED.updated_by,
+			updated_at = NOW()`,
+		role, q.MaxBytes, q.MaxFiles, q.MaxFileBytes, updatedBy)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUnknownRole
+	}
+	return nil
+}
+
+// DeleteRoleQuota removes the quota of a role, so it no longer limits its
+// members.
+func DeleteRoleQuota(ctx context.Context, db *sql.DB, role string) error {
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM role_quotas WHERE role_id = (SELECT id FROM roles WHERE name = $1)`, role)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListRoleQuotas returns the quotas by role name.
+func ListRoleQuotas(ctx context.Context, db *sql.DB) (map[string]*Quota, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT r.name, q.max_bytes, q.max_files, q.max_file_bytes
+		FROM role_quotas q JOIN roles r ON r.id = q.role_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quotas := make(map[string]*Quota)
+	for rows.Next() {
+		var role string
+		var maxBytes, maxFiles, maxFileBytes sql.NullInt64
+		if err := rows.Scan(&role, &maxBytes, &maxFiles, &maxFileBytes); err != nil {
+			return nil, err
+		}
+		quotas[role] = newQuota(maxBytes, maxFiles, maxFileBytes, "")
+	}
+	return quotas, rows.Err()
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func limit(n int64) *int64 {
+	return &n
+}
+
+func TestQuotaCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		quota     Quota
+		usage     Usage
+		size      int64
+		version   bool
+		wantLimit string
+	}{
+		{name: "unlimited", usage: Usage{Bytes: 1 << 40, Files: 1 << 20}, size: 1 << 40},
+		{name: "fits", quota: Quota{MaxBytes: limit(100), MaxFiles: limit(3), MaxFileBytes: limit(50)}, usage: Usage{Bytes: 50, Files: 2}, size: 50},
+		{name: "exactly the file limit", quota: Quota{MaxFileBytes: limit(50)}, size: 50},
+		{name: "file too large", quota: Quota{MaxFileBytes: limit(50)}, size: 51, wantLimit: "max_file_bytes"},
+		{name: "exactly the byte limit", quota: Quota{MaxBytes: limit(100)}, usage: Usage{Bytes: 60}, size: 40},
+		{name: "over the byte limit", quota: Quota{MaxBytes: limit(100)}, usage: Usage{Bytes: 60}, size: 41, wantLimit: "max_bytes"},
+		{name: "already over the byte limit", quota: Quota{MaxBytes: limit(100)}, usage: Usage{Bytes: 150}, size: 0, wantLimit: "max_bytes"},
+		{name: "last file", quota: Quota{MaxFiles: limit(3)}, usage: Usage{Files: 2}, size: 1},
+		{name: "too many files", quota: Quota{MaxFiles: limit(3)}, usage: Usage{Files: 3}, size: 1, wantLimit: "max_files"},
+		{name: "no files allowed", quota: Quota{MaxFiles: limit(0)}, size: 1, wantLimit: "max_files"},
+		{name: "empty file at the byte limit", quota: Quota{MaxBytes: limit(100)}, usage: Usage{Bytes: 100}, size: 0},
+		{name: "file limit checked first", quota: Quota{MaxBytes: limit(10), MaxFiles: limit(1), MaxFileBytes: limit(5)}, usage: Usage{Files: 1}, size: 20, wantLimit: "max_file_bytes"},
+		{name: "file count checked before bytes", quota: Quota{MaxBytes: limit(10), MaxFiles: limit(1)}, usage: Usage{Files: 1}, size: 20, wantLimit: "max_files"},
+		{name: "version at the file limit", quota: Quota{MaxFiles: limit(3)}, usage: Usage{Files: 3}, size: 1, version: true},
+		{name: "version over the byte limit", quota: Quota{MaxBytes: limit(100), MaxFiles: limit(3)}, usage: Usage{Bytes: 90, Files: 3}, size: 11, version: true, wantLimit: "max_bytes"},
+		{name: "version too large", quota: Quota{MaxFileBytes: limit(50)}, usage: Usage{Files: 1}, size: 51, version: true, wantLimit: "max_file_bytes"},
+		{name: "version over the file limit", quota: Quota{MaxFiles: limit(3)}, usage: Usage{Files: 4}, size: 1, version: true, wantLimit: "max_files"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := tt.quota.Check
+			if tt.version {
+				check = tt.quota.CheckVersion
+			}
+			err := check(tt.usage, tt.size)
+			if tt.wantLimit == "" {
+				if err != nil {
+					t.Fatalf("error = %v, want none", err)
+				}
+				return
+			}
+			var quotaErr *QuotaError
+			if !errors.As(err, &quotaErr) {
+				t.Fatalf("error = %v, want a *QuotaError", err)
+			}
+			if quotaErr.Limit != tt.wantLimit {
+				t.Errorf("exceeded limit = %s, want %s", quotaErr.Limit, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestQuotaRemaining(t *testing.T) {
+	q := Quota{MaxBytes: limit(100), MaxFiles: limit(3)}
+	tests := []struct {
+		name      string
+		usage     Usage
+		wantBytes int64
+		wantFiles int64
+	}{
+		{name: "empty", wantBytes: 100, wantFiles: 3},
+		{name: "partly used", usage: Usage{Bytes: 40, Files: 1}, wantBytes: 60, wantFiles: 2},
+		{name: "over the quota", usage: Usage{Bytes: 150, Files: 5}, wantBytes: 0, wantFiles: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := q.RemainingBytes(tt.usage); got == nil || *got != tt.wantBytes {
+				t.Errorf("RemainingBytes() = %v, want %d", got, tt.wantBytes)
+			}
+			if got := q.RemainingFiles(tt.usage); got == nil || *got != tt.wantFiles {
+				t.Errorf("RemainingFiles() = %v, want %d", got, tt.wantFiles)
+			}
+		})
+	}
+
+	var unlimited Quota
+	if got := unlimited.RemainingBytes(Usage{Bytes: 10}); got != nil {
+		t.Errorf("RemainingBytes() = %d, want unlimited", *got)
+	}
+	if got := unlimited.RemainingFiles(Usage{Files: 10}); got != nil {
+		t.Errorf("RemainingFiles() = %d, want unlimited", *got)
+	}
+}
+
+func TestQuotaValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		quota   Quota
+		wantErr bool
+	}{
+		{name: "unlimited"},
+		{name: "zero limits", quota: Quota{MaxBytes: limit(0), MaxFiles: limit(0), MaxFileBytes: limit(0)}},
+		{name: "negative bytes", quota: Quota{MaxBytes: limit(-1)}, wantErr: true},
+		{name: "negative files", quota: Quota{MaxFiles: limit(-1)}, wantErr: true},
+		{name: "negative file bytes", quota: Quota{MaxFileBytes: limit(-1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.quota.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+type Session struct {
+	UserID   int
+	Username string
+	FamilyID string
+}
+
+func StoreRefreshToken(ctx context.Context, db *sql.DB, userID int, familyID, tokenHash string, expiresAt time.Time) error {
+	_, span := otel.Tracer("uploader").Start(ctx, "storeRefreshToken")
+	defer span.End()
+	span.SetAttributes(attribute.Int("user_id", userID))
+
+	query := `INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)`
+	_, err := db.ExecContext(ctx, query, userID, familyID, tokenHash, expiresAt)
+	if err != nil {
+		span.SetStatus(codes.Error, "Failed to execute query")
+		span.RecordError(err)
+	}
+	return err
+}
+
+// RotateRefreshToken consumes the refresh token with oldHash and stores
+// newHash in the same family. Presenting a token that was already used or
+// revoked revokes the whole family and returns ErrRefreshTokenReused together
+// with the session, so the caller can also revoke its access tokens.
+func RotateRefreshToken(ctx context.Context, db *sql.DB, oldHash, newHash string, expiresAt time.Time) (*Session, error) {
+	_, span := otel.Tracer("uploader").Start(ctx, "rotateRefreshToken")
+	defer span.End()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var session Session
+	var tokenExpiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+		SELECT t.user_id, u.username, t.family_id, t.expires_at, t.used_at, t.revoked_at
+		FROM refresh_tokens t JOIN app_users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND u.status = 'active' FOR UPDATE OF t`, oldHash).
+		Scan(&session.UserID, &session.Username, &session.FamilyID, &tokenExpiresAt, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, "Failed to query refresh token")
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("user_id", session.UserID))
+
+	if usedAt.Valid || revokedAt.Valid {
+		span.AddEvent("Refresh token reuse detected, revoking session family")
+		if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, session.FamilyID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return &session, ErrRefreshTokenReused
+	}
+	if time.Now().After(tokenExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = NOW() WHERE token_hash = $1`, oldHash); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)`,
+		session.UserID, session.FamilyID, newHash, expiresAt); err != nil {
+		return nil, err
+	}
+	return &session, tx.Commit()
+}
+
+func RevokeSessionFamily(ctx context.Context, db *sql.DB, familyID string) error {
+	_, err := db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, familyID)
+	return err
+}
+
+// RevokeUserSessions revokes every refresh token and personal access token
+// of the user and rejects all access tokens issued to them so far.
+func RevokeUserSessions(ctx context.Context, db *sql.DB, userID int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE personal_access_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, userID); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE app_users SET tokens_valid_after = NOW() WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+func StoreRevokedToken(ctx context.Context, db *sql.DB, tokenID string, expiresAt time.Time) error {
+	query := `INSERT INTO revoked_tokens (token_id, expires_at) VALUES ($1, $2) ON CONFLICT (token_id) DO NOTHING`
+	if _, err := db.ExecContext(ctx, query, tokenID, expiresAt); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expires_at < NOW()`)
+	return err
+}
+
+// IsTokenRevoked reports whether any of the token ids is on the denylist or
+// the token was issued before the user's sessions were revoked. Tokens only
+// carry the second they were issued in, so those issued in the second of
+// the revocation stay valid, like the ones issued to the caller right after.
+func IsTokenRevoked(ctx context.Context, db *sql.DB, tokenIDs []string, userID int, issuedAt time.Time) (bool, error) {
+	var denied, expired bool
+	err := db.QueryRowContext(ctx, `
+		SELECT
+			EXISTS (SELECT 1 FROM revoked_tokens WHERE token_id = ANY($1)),
+			COALESCE((SELECT date_trunc('second', tokens_valid_after) > $3 FROM app_users WHERE id = $2), FALSE)`,
+		tokenIDs, userID, issuedAt).Scan(&denied, &expired)
+	if err != nil {
+		return false, err
+	}
+	return denied || expired, nil
+}
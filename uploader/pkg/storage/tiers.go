@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// RequestRehydration records that the user waits for an archived file and
+// moves it to rehydrating. It reports whether this request started the
+// rehydration, false if one is already running. It returns sql.ErrNoRows
+// if the file is neither archived nor rehydrating.
+func RequestRehydration(ctx context.Context, db *sql.DB, id, userID int) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var tier string
+	err = tx.QueryRowContext(ctx, `
+		SELECT tier FROM files WHERE id = $1 AND status = 'active' AND tier <> 'hot' FOR UPDATE`, id).Scan(&tier)
+	if err != nil {
+		return false, err
+	}
+	if tier == TierArchived {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE files SET tier = 'rehydrating', tier_changed_at = NOW() WHERE id = $1`, id); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO rehydration_requests (file_id, user_id) VALUES ($1, $2)
+		ON CONFLICT (file_id, user_id) DO NOTHING`, id, userID); err != nil {
+		return false, err
+	}
+	return tier == TierArchived, tx.Commit()
+}
+
+// ClaimStaleRehydrations returns up to limit files rehydrating since before
+// the time and marks them as requested again, so replicas do not claim the
+// same ones.
+func ClaimStaleRehydrations(ctx context.Context, db *sql.DB, before time.Time, limit int) ([]File, error) {
+	return listFiles(ctx, db, `
+		UPDATE files SET tier_changed_at = NOW()
+		WHERE id IN (
+			SELECT id FROM files WHERE tier = 'rehydrating' AND tier_changed_at < $1
+			ORDER BY tier_changed_at LIMIT $2 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+fileColumns, before, limit)
+}
+
+// RehydratedFile is a file whose rehydration finished, with the users who
+// waited for it.
+type RehydratedFile struct {
+	ID       int
+	Filename string
+	Users    []int
+}
+
+// CompleteRehydration records the primary copy of the object as restored
+// for every version stored under it, as files with the same content share
+// it. Files whose current version uses it become hot again. It returns
+// those files and the file the rehydration was for with the users who
+// waited for them, or sql.ErrNoRows if no version uses the object anymore.
+func CompleteRehydration(ctx context.Context, db *sql.DB, id int, objectKey string) ([]RehydratedFile, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE file_versions SET primary_deleted_at = NULL, rehydrated_at = NOW()
+		WHERE object_key = $1 AND (file_id = $2 OR primary_deleted_at IS NOT NULL)`, objectKey, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	files, err := hotFiles(ctx, tx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The file asked for is done even if a newer version was promoted
+	// meanwhile
+	found := false
+	for _, f := range files {
+		found = found || f.ID == id
+	}
+	if !found {
+		f := RehydratedFile{ID: id}
+		err := tx.QueryRowContext(ctx, `SELECT filename FROM files WHERE id = $1`, id).Scan(&f.Filename)
+		if err == nil {
+			files = append(files, f)
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	for i := range files {
+		if files[i].Users, err = takeRequests(ctx, tx, files[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return files, tx.Commit()
+}
+
+// hotFiles moves the files whose current version is stored under the
+// object to the hot tier and returns them.
+func hotFiles(ctx context.Context, tx *sql.Tx, objectKey string) ([]RehydratedFile, error) {
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE files SET tier = 'hot', tier_changed_at = NOW()
+		WHERE object_key = $1 AND tier <> 'hot' RETURNING id, filename`, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []RehydratedFile
+	for rows.Next() {
+		var f RehydratedFile
+		if err := rows.Scan(&f.ID, &f.Filename); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// FailRehydration moves a rehydrating file back to archived. It returns the
+// users who waited for it, or sql.ErrNoRows if the file is not rehydrating.
+func FailRehydration(ctx context.Context, db *sql.DB, id int) ([]int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE files SET tier = 'archived', tier_changed_at = NOW() WHERE id = $1 AND tier = 'rehydrating'`, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	users, err := takeRequests(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	return users, tx.Commit()
+}
+
+// takeRequests removes the rehydration requests of the file and returns who
+// made them.
+func takeRequests(ctx context.Context, tx *sql.Tx, id int) ([]int, error) {
+	rows, err := tx.QueryContext(ctx, `DELETE FROM rehydration_requests WHERE file_id = $1 RETURNING user_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// DailyUsage is what a user transferred on one UTC day.
+type DailyUsage struct {
+	UserID       int       `json:"user_id"`
+	Username     string    `json:"username,omitempty"`
+	Day          time.Time `json:"day"`
+	IngressBytes int64     `json:"ingress_bytes"`
+	EgressBytes  int64     `json:"egress_bytes"`
+	BackupBytes  int64     `json:"backup_bytes"`
+	Uploads      int64     `json:"uploads"`
+	Downloads    int64     `json:"downloads"`
+}
+
+// AddDailyUsage adds the counters to the rows of their user and day.
+func AddDailyUsage(ctx context.Context, db *sql.DB, usage []DailyUsage) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, u := range usage {
+		// Users deleted in the meantime are skipped
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO usage_daily (user_id, day, ingress_bytes, egress_bytes, backup_bytes, uploads, downloads)
+			SELECT id, $2, $3, $4, $5, $6, $7 FROM app_users WHERE id = $1
+			ON CONFLICT (user_id, day) DO UPDATE SET
+				ingress_bytes = usage_daily.ingress_bytes + EXCLUDED.ingress_bytes,
+				egress_bytes = usage_daily.egress_bytes + EXCLUDED.egress_bytes,
+				backup_bytes = usage_daily.backup_bytes + EXCLUDED.backup_bytes,
+				uploads = usage_daily.uploads + EXCLUDED.uploads,
+				downloads = usage_daily.downloads + EXCLUDED.downloads`,
+			u.UserID, u.Day, u.IngressBytes, u.EgressBytes, u.BackupBytes, u.Uploads, u.Downloads)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UsageReportRow sums the usage of a user over a range of days. StoredBytes
+// and StoredFiles are what the user stores now.
+type UsageReportRow struct {
+	DailyUsage
+	StoredBytes int64 `json:"stored_bytes"`
+	StoredFiles int64 `json:"stored_files"`
+}
+
+// UsageReport returns the usage between the days from and to, both
+// included, per user, or only that of userID if it is not 0.
+func UsageReport(ctx context.Context, db *sql.DB, from, to time.Time, userID int) ([]UsageReportRow, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, u.username, SUM(d.ingress_bytes), SUM(d.egress_bytes), SUM(d.backup_bytes),
+			SUM(d.uploads), SUM(d.downloads),
+			(SELECT COALESCE(SUM(v.filesize), 0) FROM files f JOIN file_versions v ON v.file_id = f.id WHERE f.user_id = u.id),
+			(SELECT COUNT(*) FROM files WHERE user_id = u.id)
+		FROM usage_daily d JOIN app_users u ON u.id = d.user_id
+		WHERE d.day BETWEEN $1 AND $2 AND ($3 = 0 OR d.user_id = $3)
+		GROUP BY u.id, u.username
+		ORDER BY SUM(d.ingress_bytes + d.egress_bytes + d.backup_bytes) DESC, u.id`, from, to, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := []UsageReportRow{}
+	for rows.Next() {
+		var r UsageReportRow
+		if err := rows.Scan(&r.UserID, &r.Username, &r.IngressBytes, &r.EgressBytes, &r.BackupBytes,
+			&r.Uploads, &r.Downloads, &r.StoredBytes, &r.StoredFiles); err != nil {
+			return nil, err
+		}
+		report = append(report, r)
+	}
+	return report, rows.Err()
+}
+
+// DailyUsageReport returns the usage rows between the days from and to,
+// both included, or only those of userID if it is not 0.
+func DailyUsageReport(ctx context.Context, db *sql.DB, from, to time.Time, userID int) ([]DailyUsage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, u.username, d.day, d.ingress_bytes, d.egress_bytes, d.backup_bytes, d.uploads, d.downloads
+		FROM usage_daily d JOIN app_users u ON u.id = d.user_id
+		WHERE d.day BETWEEN $1 AND $2 AND ($3 = 0 OR d.user_id = $3)
+		ORDER BY d.day, u.id`, from, to, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := []DailyUsage{}
+	for rows.Next() {
+		var u DailyUsage
+		if err := rows.Scan(&u.UserID, &u.Username, &u.Day, &u.IngressBytes, &u.EgressBytes, &u.BackupBytes,
+			&u.Uploads, &u.Downloads); err != nil {
+			return nil, err
+		}
+		report = append(report, u)
+	}
+	return report, rows.Err()
+}
+
+// Consumer is a user and how many bytes they used of one kind.
+type Consumer struct {
+	Username string
+	Bytes    int64
+}
+
+// TopConsumers returns the n users with the most bytes of the kind
+// (ingress, egress, backup or stored) since the day of since. Stored bytes
+// are the current ones.
+func TopConsumers(ctx context.Context, db *sql.DB, kind string, since time.Time, n int) ([]Consumer, error) {
+	var query string
+	args := []interface{}{n}
+	switch kind {
+	case "ingress", "egress", "backup":
+		query = fmt.Sprintf(`
+			SELECT u.username, SUM(d.%s_bytes) AS bytes
+			FROM usage_daily d JOIN app_users u ON u.id = d.user_id
+			WHERE d.day >= $2::date
+			GROUP BY u.username ORDER BY bytes DESC LIMIT $1`, kind)
+		args = append(args, since)
+	case "stored":
+		query = `
+			SELECT u.username, SUM(v.filesize) AS bytes
+			FROM files f JOIN file_versions v ON v.file_id = f.id JOIN app_users u ON u.id = f.user_id
+			GROUP BY u.username ORDER BY bytes DESC LIMIT $1`
+	default:
+		return nil, fmt.Errorf("unknown usage kind %q", kind)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consumers := []Consumer{}
+	for rows.Next() {
+		var c Consumer
+		if err := rows.Scan(&c.Username, &c.Bytes); err != nil {
+			return nil, err
+		}
+		consumers = append(consumers, c)
+	}
+	return consumers, rows.Err()
+}
+
+// GetFileOwner returns the owner of the latest file version stored under
+// the object key.
+func GetFileOwner(ctx context.Context, db *sql.DB, objectKey string) (int, error) {
+	var userID int
+	err := db.QueryRowContext(ctx, `
+		SELECT f.user_id FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE v.object_key = $1 AND f.user_id IS NOT NULL
+		ORDER BY v.id DESC LIMIT 1`, objectKey).Scan(&userID)
+	return userID, err
+}
@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+const (
+	UserPending  = "pending"
+	UserActive   = "active"
+	UserDisabled = "disabled"
+)
+
+var (
+	ErrUserExists    = errors.New("username or email is already taken")
+	ErrInviteInvalid = errors.New("invite is invalid, expired or already used")
+	ErrFilesHeld     = errors.New("files are under a legal hold or retention")
+)
+
+type User struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email,omitempty"`
+	Status    string    `json:"status"`
+	Roles     []string  `json:"roles"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginUser is what login needs to know about the account named by a
+// username or email.
+type LoginUser struct {
+	ID           int
+	Username     string
+	PasswordHash string
+	Status       string
+}
+
+type NewUser struct {
+	Username     string
+	Email        string
+	PasswordHash string
+	Status       string
+	Roles        []string
+	// InviteHash, if set, is consumed in the same transaction
+	InviteHash string
+	// Identity, if set, is linked in the same transaction
+	Identity *Identity
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// GetLoginUser looks the user up by username or email, ignoring case.
+func GetLoginUser(ctx context.Context, db *sql.DB, login string) (*LoginUser, error) {
+	var u LoginUser
+	err := db.QueryRowContext(ctx, `
+		SELECT id, username, password, status FROM app_users
+		WHERE LOWER(username) = LOWER($1) OR LOWER(email) = LOWER($1)`, login).
+		Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Status)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetLoginUserByEmail is GetLoginUser matching the email only.
+func GetLoginUserByEmail(ctx context.Context, db *sql.DB, email string) (*LoginUser, error) {
+	var u LoginUser
+	err := db.QueryRowContext(ctx, `
+		SELECT id, username, password, status FROM app_users WHERE LOWER(email) = LOWER($1)`, email).
+		Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Status)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetLoginUserByID is GetLoginUser for a known user id.
+func GetLoginUserByID(ctx context.Context, db *sql.DB, userID int) (*LoginUser, error) {
+	var u LoginUser
+	err := db.QueryRowContext(ctx, `SELECT id, username, password, status FROM app_users WHERE id = $1`, userID).
+		Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Status)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetPasswordHash returns the password hash of the user.
+func GetPasswordHash(ctx context.Context, db *sql.DB, userID int) (string, error) {
+	var hash string
+	err := db.QueryRowContext(ctx, `SELECT password FROM app_users WHERE id = $1`, userID).Scan(&hash)
+	return hash, err
+}
+
+// CreateUser stores the user with their roles. It returns ErrUserExists if
+// the username or email is taken and ErrInviteInvalid if the invite cannot
+// be used.
+func CreateUser(ctx context.Context, db *sql.DB, u *NewUser) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	roles := u.Roles
+	if u.InviteHash != "" {
+		var role string
+		var email sql.NullString
+		err := tx.QueryRowContext(ctx, `
+			SELECT role, email FROM invites
+			WHERE code_hash = $1 AND used_at IS NULL AND expires_at > NOW() FOR UPDATE`, u.InviteHash).Scan(&role, &email)
+		if err == sql.ErrNoRows {
+			return 0, ErrInviteInvalid
+		}
+		if err != nil {
+			return 0, err
+		}
+		if email.Valid && !strings.EqualFold(email.String, u.Email) {
+			return 0, ErrInviteInvalid
+		}
+		roles = []string{role}
+	}
+
+	var userID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO app_users (username, email, password, status, password_changed_at)
+		VALUES ($1, NULLIF($2, ''), $3, $4, NOW()) RETURNING id`,
+		u.Username, u.Email, u.PasswordHash, u.Status).Scan(&userID)
+	if isUniqueViolation(err) {
+		return 0, ErrUserExists
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO user_roles (user_id, role_id)
+		SELECT $1, id FROM roles WHERE name = ANY($2)`, userID, roles)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n != int64(len(roles)) {
+		return 0, ErrUnknownRole
+	}
+
+	if u.Identity != nil {
+		if err := linkIdentity(ctx, tx, userID, u.Identity); err != nil {
+			return 0, err
+		}
+	}
+	if u.InviteHash != "" {
+		if _, err := tx.ExecContext(ctx, `UPDATE invites SET used_at = NOW(), used_by = $2 WHERE code_hash = $1`, u.InviteHash, userID); err != nil {
+			return 0, err
+		}
+	}
+	return userID, tx.Commit()
+}
+
+func ListUsers(ctx context.Context, db *sql.DB) ([]User, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, u.username, COALESCE(u.email, ''), u.status, u.created_at,
+			COALESCE(STRING_AGG(r.name, ',' ORDER BY r.name), '')
+		FROM app_users u
+		LEFT JOIN user_roles ur ON ur.user_id = u.id
+		LEFT JOIN roles r ON r.id = ur.role_id
+		GROUP BY u.id ORDER BY u.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		var roles string
+		if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.Status, &u.CreatedAt, &roles); err != nil {
+			return nil, err
+		}
+		u.Roles = []string{}
+		if roles != "" {
+			u.Roles = strings.Split(roles, ",")
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// SetUserStatus returns sql.ErrNoRows if the user does not exist.
+func SetUserStatus(ctx context.Context, db *sql.DB, userID int, status string) error {
+	res, err := db.ExecContext(ctx, `UPDATE app_users SET status = $2 WHERE id = $1`, userID, status)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetPassword returns sql.ErrNoRows if the user does not exist.
+func SetPassword(ctx context.Context, db *sql.DB, userID int, passwordHash string) error {
+	res, err := db.ExecContext(ctx, `UPDATE app_users SET password = $2, password_changed_at = NOW() WHERE id = $1`, userID, passwordHash)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpgradePasswordHash replaces a password hash with an equivalent one, e.g.
+// made with newer parameters. Nothing happens if the password was changed
+// in the meantime.
+func UpgradePasswordHash(ctx context.Context, db *sql.DB, userID int, oldHash, newHash string) error {
+	_, err := db.ExecContext(ctx, `UPDATE app_users SET password = $3 WHERE id = $1 AND password = $2`, userID, oldHash, newHash)
+	return err
+}
+
+// UserFile is a stored object owned by a user, one per file version.
+type UserFile struct {
+	ID        int
+	ObjectKey string
+	// Under a legal hold or retention, so it must not be deleted
+	Held bool
+}
+
+func ListUserFiles(ctx context.Context, db *sql.DB, userID int) ([]UserFile, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT f.id, v.object_key, NOT (`+notHeld+`)
+		FROM files f JOIN file_versions v ON v.file_id = f.id
+		WHERE f.user_id = $1 ORDER BY f.id, v.version`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []UserFile{}
+	for rows.Next() {
+		var f UserFile
+		if err := rows.Scan(&f.ID, &f.ObjectKey, &f.Held); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// DeleteUser removes the user and everything that references them. Their
+// files are handed to transferTo, or their metadata is deleted when it is 0,
+// releasing their objects. It returns the keys of blobs no longer used by
+// any version, for DropBlob once the user is gone. It returns
+// sql.ErrNoRows if either user does not exist and ErrFilesHeld if files to
+// delete are held.
+func DeleteUser(ctx context.Context, db *sql.DB, userID, transferTo int) (int64, []string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var res sql.Result
+	var keys []string
+	if transferTo != 0 {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM app_users WHERE id = $1)`, transferTo).Scan(&exists); err != nil {
+			return 0, nil, err
+		}
+		if !exists {
+			return 0, nil, sql.ErrNoRows
+		}
+		res, err = tx.ExecContext(ctx, `UPDATE files SET user_id = $2 WHERE user_id = $1`, userID, transferTo)
+	} else {
+		// A hold placed meanwhile keeps its file, which fails the delete
+		keys, err = releaseBlobs(ctx, tx, `v.file_id IN (SELECT id FROM files WHERE user_id = $1 AND `+notHeld+`)`, userID)
+		if err != nil {
+			return 0, nil, err
+		}
+		res, err = tx.ExecContext(ctx, `DELETE FROM files WHERE user_id = $1 AND `+notHeld, userID)
+		if err != nil {
+			return 0, nil, err
+		}
+		var held bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM files WHERE user_id = $1)`, userID).Scan(&held); err != nil {
+			return 0, nil, err
+		}
+		if held {
+			return 0, nil, ErrFilesHeld
+		}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	files, _ := res.RowsAffected()
+
+	res, err = tx.ExecContext(ctx, `DELETE FROM app_users WHERE id = $1`, userID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, nil, sql.ErrNoRows
+	}
+	return files, keys, tx.Commit()
+}
+
+func CreateInvite(ctx context.Context, db *sql.DB, codeHash, email, role string, createdBy int, expiresAt time.Time) (int, error) {
+	var id int
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO invites (code_hash, email, role, created_by, expires_at)
+		SELECT $1, NULLIF($2, ''), name, NULLIF($4, 0), $5 FROM roles WHERE name = $3
+		RETURNING id`, codeHash, email, role, createdBy, expiresAt).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrUnknownRole
+	}
+	return id, err
+}
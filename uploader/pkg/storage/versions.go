@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// FileVersion is one upload of a file. Versions with the same content
+// share an object, see BlobKey.
+type FileVersion struct {
+	ID          int       `json:"-"`
+	FileID      int       `json:"file_id"`
+	Version     int       `json:"version"`
+	ObjectKey   string    `json:"-"`
+	Filesize    int64     `json:"filesize"`
+	ContentType string    `json:"content_type"`
+	ETag        string    `json:"etag"`
+	FileURL     string    `json:"file_url"`
+	Checksum    string    `json:"checksum"`
+	UploadedBy  int       `json:"uploaded_by"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	// Only the backup is left, see MarkCopyDeleted
+	Archived bool `json:"archived"`
+	Current  bool `json:"current"`
+}
+
+const versionColumns = `v.id, v.file_id, v.version, v.object_key, v.filesize, COALESCE(v.content_type, ''), COALESCE(v.etag, ''),
+	v.file_url, COALESCE(v.checksum, ''), COALESCE(v.uploaded_by, 0), v.uploaded_at, v.primary_deleted_at IS NOT NULL,
+	v.version = f.version`
+
+func scanVersion(row scanner) (*FileVersion, error) {
+	var v FileVersion
+	if err := row.Scan(&v.ID, &v.FileID, &v.Version, &v.ObjectKey, &v.Filesize, &v.ContentType, &v.ETag,
+		&v.FileURL, &v.Checksum, &v.UploadedBy, &v.UploadedAt, &v.Archived, &v.Current); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// ListVersions returns the versions of the file, newest first.
+func ListVersions(ctx context.Context, db *sql.DB, fileID int) ([]FileVersion, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+versionColumns+` FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE v.file_id = $1 ORDER BY v.version DESC`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []FileVersion{}
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *v)
+	}
+	return versions, rows.Err()
+}
+
+// GetVersion returns a version of the file, or sql.ErrNoRows if there is
+// no such version.
+func GetVersion(ctx context.Context, db *sql.DB, fileID, version int) (*FileVersion, error) {
+	return scanVersion(db.QueryRowContext(ctx, `
+		SELECT `+versionColumns+` FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE v.file_id = $1 AND v.version = $2`, fileID, version))
+}
+
+// PromoteVersion makes a version of an active file its current one again.
+// The file is archived if only the backup of the version is left. It
+// returns sql.ErrNoRows if there is no such version or the file is not
+// active or is being rehydrated.
+func PromoteVersion(ctx context.Context, db *sql.DB, fileID, version int) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE files f SET
+			version = v.version, object_key = v.object_key, filesize = v.filesize, content_type = v.content_type,
+			etag = v.etag, file_url = v.file_url, checksum = v.checksum,
+			tier = CASE WHEN v.primary_deleted_at IS NULL THEN 'hot' ELSE 'archived' END,
+			tier_changed_at = CASE WHEN (v.primary_deleted_at IS NULL) = (f.tier = 'hot') THEN f.tier_changed_at ELSE NOW() END
+		FROM file_versions v
+		WHERE f.id = $1 AND v.file_id = f.id AND v.version = $2
+			AND f.status = 'active' AND f.tier <> 'rehydrating'`, fileID, version)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteVersion removes the row of a version that is not the current one
+// of its file. It returns sql.ErrNoRows if the version is gone or current,
+// or if the file is held. It returns the keys of blobs no longer used by
+// any version, for DropBlob.
+func DeleteVersion(ctx context.Context, db *sql.DB, versionID int) ([]string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the file keeps it from being promoted or held meanwhile
+	var fileID int
+	err = tx.QueryRowContext(ctx, `
+		SELECT f.id FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE v.id = $1 AND v.version <> f.version AND `+notHeld+` FOR UPDATE`, versionID).Scan(&fileID)
+	if err != nil {
+		return nil, err
+	}
+	unreferenced, err := releaseBlobs(ctx, tx, `v.id = $1`, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM file_versions WHERE id = $1`, versionID); err != nil {
+		return nil, err
+	}
+	return unreferenced, tx.Commit()
+}
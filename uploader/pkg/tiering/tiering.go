@@ -0,0 +1,145 @@
+package tiering
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/holds"
+	"video-platform/uploader/pkg/queue"
+	"video-platform/uploader/pkg/storage"
+)
+
+// Rehydrations requested again per run of the retry job at most
+const retryBatchSize = 100
+
+// Tiering moves files between tiers. Files are archived when lifecycle
+// policies remove their primary copy; downloading one asks the handler to
+// rehydrate it from the backup, and the users who asked are notified when
+// it is hot again.
+type Tiering struct {
+	db        *sql.DB
+	publisher *queue.Publisher
+	holds     *holds.Holds
+	l         *zap.SugaredLogger
+}
+
+func New(db *sql.DB, publisher *queue.Publisher, fileHolds *holds.Holds, l *zap.SugaredLogger) *Tiering {
+	return &Tiering{db: db, publisher: publisher, holds: fileHolds, l: l}
+}
+
+// Rehydrate records that the user waits for the archived file and starts
+// its rehydration unless it is already running. It returns sql.ErrNoRows
+// if the file is hot.
+func (t *Tiering) Rehydrate(ctx context.Context, f *storage.File, userID int) error {
+	started, err := storage.RequestRehydration(ctx, t.db, f.ID, userID)
+	if err != nil {
+		return err
+	}
+	f.Tier = storage.TierRehydrating
+	if started {
+		t.l.Infow("Rehydrating archived file", zap.Int("file_id", f.ID), zap.String("filename", f.Filename))
+		t.request(ctx, f)
+	}
+	return nil
+}
+
+func (t *Tiering) request(ctx context.Context, f *storage.File) {
+	t.publisher.PublishRehydrate(ctx, queue.RehydrateMessage{
+		FileID:      f.ID,
+		Filename:    f.Filename,
+		ObjectKey:   f.ObjectKey,
+		ContentType: f.ContentType,
+		Checksum:    f.Checksum,
+	})
+}
+
+// HandleRehydrated makes a rehydrated file hot again, along with the files
+// that share its content, or archived if it could not be restored, and
+// notifies the users who waited for them. The restored object is stored
+// anew, so the holds of the files using it are placed on it before any of
+// them is hot again.
+func (t *Tiering) HandleRehydrated(msg *nats.Msg) {
+	var done queue.RehydratedMessage
+	if err := json.Unmarshal(msg.Data, &done); err != nil {
+		t.l.Errorw("Failed to unmarshal rehydrated message", zap.Error(err))
+		msg.Term()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var files []storage.RehydratedFile
+	var err error
+	if done.Error == "" {
+		if err := t.holds.ApplyToObject(ctx, done.ObjectKey); err != nil {
+			t.l.Errorw("Failed to apply holds to rehydrated object", zap.String("object_key", done.ObjectKey), zap.Error(err))
+			msg.Nak()
+			return
+		}
+		files, err = storage.CompleteRehydration(ctx, t.db, done.FileID, done.ObjectKey)
+	} else {
+		var users []int
+		users, err = storage.FailRehydration(ctx, t.db, done.FileID)
+		files = []storage.RehydratedFile{{ID: done.FileID, Filename: done.Filename, Users: users}}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		// Deleted meanwhile, or a duplicate
+		msg.Ack()
+		return
+	}
+	if err != nil {
+		t.l.Errorw("Failed to finish rehydration", zap.Int("file_id", done.FileID), zap.Error(err))
+		msg.Nak()
+		return
+	}
+
+	kind, suffix := "file.ready", " is ready to download"
+	if done.Error != "" {
+		kind, suffix = "file.rehydration_failed", " could not be restored from the archive"
+		t.l.Errorw("Rehydration failed", zap.Int("file_id", done.FileID), zap.String("error", done.Error))
+	}
+	for _, f := range files {
+		if done.Error == "" {
+			t.l.Infow("Rehydrated file", zap.Int("file_id", f.ID), zap.String("filename", f.Filename))
+		}
+		if err := storage.AddNotifications(ctx, t.db, f.Users, kind, f.Filename+suffix, f.ID); err != nil {
+			t.l.Errorw("Failed to notify users", zap.Int("file_id", f.ID), zap.Ints("users", f.Users), zap.Error(err))
+		}
+	}
+	msg.Ack()
+}
+
+// Run requests rehydrations again that have not finished after retryAfter,
+// e.g. because the request was lost, every interval until ctx is done.
+func (t *Tiering) Run(ctx context.Context, interval, retryAfter time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.retryStale(ctx, retryAfter)
+		}
+	}
+}
+
+func (t *Tiering) retryStale(ctx context.Context, retryAfter time.Duration) {
+	files, err := storage.ClaimStaleRehydrations(ctx, t.db, time.Now().Add(-retryAfter), retryBatchSize)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			t.l.Errorw("Failed to list stale rehydrations", zap.Error(err))
+		}
+		return
+	}
+	for i := range files {
+		t.l.Warnw("Requesting stale rehydration again", zap.Int("file_id", files[i].ID), zap.String("filename", files[i].Filename))
+		t.request(ctx, &files[i])
+	}
+}
@@ -0,0 +1,158 @@
+package trash
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+
+	"video-platform/uploader/pkg/config"
+	"video-platform/uploader/pkg/queue"
+	"video-platform/uploader/pkg/storage"
+)
+
+// Files purged per run of the purge job at most
+const purgeBatchSize = 100
+
+// ErrRestoreExpired is returned for files that were deleted too long ago
+// to be restored.
+var ErrRestoreExpired = errors.New("restore window has passed")
+
+// ErrHeld is returned for files under a legal hold or retention.
+var ErrHeld = errors.New("file is held")
+
+// Trash moves deleted files to the trash, from where they can be restored
+// until they are purged after the trash retention.
+type Trash struct {
+	db        *sql.DB
+	minio     *minio.Client
+	buckets   []string
+	publisher *queue.Publisher
+	live      *config.Live
+	l         *zap.SugaredLogger
+}
+
+// New returns a Trash that purges objects from the primary bucket and the
+// backup buckets.
+func New(db *sql.DB, minioClient *minio.Client, buckets []string, publisher *queue.Publisher, live *config.Live, l *zap.SugaredLogger) *Trash {
+	return &Trash{db: db, minio: minioClient, buckets: buckets, publisher: publisher, live: live, l: l}
+}
+
+// RestoreUntil returns until when a file deleted at deletedAt can be
+// restored.
+func (t *Trash) RestoreUntil(deletedAt time.Time) time.Time {
+	return deletedAt.Add(t.live.TrashRetention())
+}
+
+// Delete moves an active file to the trash. It returns sql.ErrNoRows if it
+// is not active and ErrHeld if it is held.
+func (t *Trash) Delete(ctx context.Context, f *storage.File, deletedBy int) error {
+	if f.Hold.Active(time.Now()) {
+		return ErrHeld
+	}
+	deletedAt, err := storage.TrashFile(ctx, t.db, f.ID, deletedBy)
+	if err != nil {
+		return err
+	}
+	f.Status, f.DeletedAt = storage.FileTrashed, &deletedAt
+	t.publish(ctx, f, false)
+	return nil
+}
+
+// Restore makes a trashed file active again. It returns
+// storage.ErrFileExists if the owner has an active file with the same name.
+func (t *Trash) Restore(ctx context.Context, f *storage.File) error {
+	if f.Status != storage.FileTrashed {
+		return sql.ErrNoRows
+	}
+	err := storage.RestoreFile(ctx, t.db, f.ID, time.Now().Add(-t.live.TrashRetention()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRestoreExpired
+	}
+	if err != nil {
+		return err
+	}
+	f.Status, f.DeletedAt = storage.FileActive, nil
+	return nil
+}
+
+// Purge removes a trashed file with all its versions, and the objects no
+// other file uses. It returns sql.ErrNoRows if the file is not in the trash
+// and ErrHeld if it is held.
+func (t *Trash) Purge(ctx context.Context, f *storage.File) error {
+	if f.Hold.Active(time.Now()) {
+		return ErrHeld
+	}
+	keys, err := storage.DeleteTrashedFile(ctx, t.db, f.ID)
+	if err != nil {
+		return err
+	}
+	// The rows are gone, so failures leave orphaned objects behind
+	for _, key := range keys {
+		if err := storage.DropBlob(ctx, t.db, key, func(key string) error { return t.removeObject(ctx, key) }); err != nil {
+			t.l.Errorw("Failed to remove purged object", zap.String("object_key", key), zap.Error(err))
+		}
+	}
+	t.publish(ctx, f, true)
+	return nil
+}
+
+// removeObject removes the object from every bucket.
+func (t *Trash) removeObject(ctx context.Context, key string) error {
+	for _, bucket := range t.buckets {
+		if err := t.minio.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Trash) publish(ctx context.Context, f *storage.File, purged bool) {
+	t.publisher.PublishDeleted(ctx, queue.DeletedMessage{
+		FileID:   f.ID,
+		UserID:   f.UserID,
+		Bucket:   t.buckets[0],
+		Filename: f.Filename,
+		Purged:   purged,
+		Time:     time.Now(),
+	})
+}
+
+// Run purges files whose restore window has passed every interval until
+// ctx is done. Replicas may race for the same file, only one purges it.
+func (t *Trash) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.purgeExpired(ctx)
+		}
+	}
+}
+
+func (t *Trash) purgeExpired(ctx context.Context) {
+	files, err := storage.ListExpiredTrash(ctx, t.db, time.Now().Add(-t.live.TrashRetention()), purgeBatchSize)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			t.l.Errorw("Failed to list expired trash", zap.Error(err))
+		}
+		return
+	}
+	for i := range files {
+		err := t.Purge(ctx, &files[i])
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			t.l.Errorw("Failed to purge file", zap.Int("file_id", files[i].ID), zap.Error(err))
+			continue
+		}
+		t.l.Infow("Purged file", zap.Int("file_id", files[i].ID), zap.String("filename", files[i].Filename))
+	}
+}
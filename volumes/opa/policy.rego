@@ -1,10 +1,149 @@
 package authz
 
-import input.token as token
+# Input sent by the uploader:
+#   subject:  the verified caller {id, username, roles, auth_method, scopes}
+#   action:   e.g. "file.upload", "file.download", "file.list", "file.delete"
+#   request:  {method, path, content_length, client_ip}
+#   resource: the object acted on {type, id, owner_id, name, size, content_type, scope}
+#   token:    the raw JWT, absent for personal access tokens
+#
+# The result is data.authz.decision: {allow, reasons, obligations}.
+#
+# Admin-managed data is published by the uploader to data.platform:
+#   denylist:      [{type: "user" | "ip", subject, action, reason, until_ns}]
+#   suspensions:   {<user id>: {reason, until_ns}}
+#   upload_limits: {<user id>: bytes}
+# Entries without until_ns do not expire.
+#
+# The public token signing keys are published to data.jwks as a JWKS.
 
-default allow = false
+default role_max_upload_bytes = 2147483648
+
+# Tokens are signed by the uploader with asymmetric keys; only the public
+# keys are published here, so OPA cannot mint tokens itself.
+jwks := json.marshal(data.jwks)
+
+token_valid {
+    input.subject.auth_method == "session"
+    [isValid, _, _] := io.jwt.decode_verify(input.token, {"cert": jwks, "iss": "video-platform", "aud": "video-platform"})
+    isValid
+}
+
+# Personal access tokens are opaque and checked against their hash by the
+# uploader
+token_valid {
+    input.subject.auth_method == "access_token"
+}
+
+has_role(role) {
+    input.subject.roles[_] == role
+}
+
+owns_resource {
+    input.resource.owner_id == input.subject.id
+}
+
+user_key := sprintf("%d", [input.subject.id])
+
+active(entry) {
+    not entry.until_ns
+}
+
+active(entry) {
+    entry.until_ns > time.now_ns()
+}
+
+denied_subject(entry) {
+    entry.type == "user"
+    entry.subject == user_key
+}
+
+denied_subject(entry) {
+    entry.type == "ip"
+    entry.subject == input.request.client_ip
+}
+
+denied_action(entry) {
+    entry.action == "*"
+}
+
+denied_action(entry) {
+    entry.action == input.action
+}
+
+deny["invalid token"] {
+    not token_valid
+}
+
+deny[reason] {
+    entry := data.platform.denylist[_]
+    denied_subject(entry)
+    denied_action(entry)
+    active(entry)
+    reason := entry.reason
+}
+
+deny[reason] {
+    suspension := data.platform.suspensions[user_key]
+    active(suspension)
+    reason := sprintf("user is suspended: %s", [suspension.reason])
+}
+
+deny["file belongs to another user"] {
+    {"file.download", "file.version.list"}[input.action]
+    input.resource
+    not owns_resource
+    not has_role("admin")
+    not has_role("auditor")
+}
+
+deny["file belongs to another user"] {
+    {"file.delete", "file.restore", "file.purge", "file.version.promote"}[input.action]
+    input.resource
+    not owns_resource
+    not has_role("admin")
+}
+
+deny["only admins and auditors can list all files"] {
+    input.action == "file.list"
+    input.resource.scope == "all"
+    not has_role("admin")
+    not has_role("auditor")
+}
+
+deny["upload exceeds the allowed size"] {
+    input.action == "file.upload"
+    upload_size > max_upload_bytes
+}
+
+upload_size = input.resource.size {
+    input.resource.size
+} else = input.request.content_length
+
+role_max_upload_bytes = 21474836480 {
+    has_role("admin")
+}
+
+role_max_upload_bytes = 10737418240 {
+    has_role("instructor")
+    not has_role("admin")
+}
+
+# A per-user limit replaces the role based one, in either direction
+max_upload_bytes = limit {
+    limit := data.platform.upload_limits[user_key]
+} else = role_max_upload_bytes
+
+obligations["max_upload_bytes"] = max_upload_bytes {
+    input.action == "file.upload"
+}
 
 allow {
-    [isValid, header, payload] := io.jwt.decode_verify(token, {"secret": "supersecretkey"})
-    payload.username != "user3"
-}
\ No newline at end of file
+    count(deny) == 0
+}
+
+decision := {
+    "allow": count(deny) == 0,
+    "reasons": [reason | deny[reason]],
+    "obligations": obligations,
+}
@@ -5,19 +5,24 @@ import httpx
 import io
 import jwt
 
-JWT_SECRET = "supersecretkey"
-
 app = FastAPI()
 templates = Jinja2Templates(directory="templates")
 
 uploader_service_url = "http://uploader:8080"
 
+# Tokens are verified against the uploader's public keys
+JWT_ISSUER = "video-platform"
+JWT_AUDIENCE = "video-platform"
+jwks_client = jwt.PyJWKClient(f"{uploader_service_url}/.well-known/jwks.json")
+
 async def get_user_id_from_token(token: str):
     token = token.split(" ")[1]
     try:
-        payload = jwt.decode(token, JWT_SECRET, algorithms=["HS256"])
+        signing_key = jwks_client.get_signing_key_from_jwt(token)
+        payload = jwt.decode(token, signing_key.key, algorithms=["RS256", "EdDSA"],
+                             audience=JWT_AUDIENCE, issuer=JWT_ISSUER)
         return payload.get("id"), payload.get("username")
-    except (jwt.ExpiredSignatureError, jwt.InvalidTokenError) as e:
+    except jwt.PyJWTError as e:
         print(e)
         return None, None
 
@@ -81,14 +86,14 @@ async def files_get(request: Request):
     return templates.TemplateResponse("files.html", {"request": request, "error": "Failed to fetch files"})
 
 @app.get("/download", response_class=HTMLResponse)
-async def download_post(request: Request, etag: str = Query(...), archived: bool = Query(...)):
+async def download_post(request: Request, id: int = Query(...), etag: str = Query(...), archived: bool = Query(...)):
     token = request.cookies.get("Authorization")
     if not token:
         return RedirectResponse(url="/login", status_code=302)
 
     headers = {"Authorization": token}
     async with httpx.AsyncClient() as client:
-        response = await client.get(f"{uploader_service_url}/download", params={"etag": etag, "archived": archived}, headers=headers)
+        response = await client.get(f"{uploader_service_url}/download", params={"id": id, "etag": etag, "archived": archived}, headers=headers)
     
     if response.status_code == 200:
         file_content = response.content